@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"tempo/crates"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checkAdminPassword compares provided with the admin password in constant
+// time. Without a configured password nothing matches, so the admin routes
+// and admin bearer tokens stay closed.
+func checkAdminPassword(provided string) bool {
+	password := currentConfig().Server.AdminPassword
+	if password == "" {
+		slog.Warn("Admin password is not configured (ADMPASSWORD), refusing admin login")
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(password)) == 1
+}
+
+// findAPIKey returns the API key with the given access key.
+func findAPIKey(accessKey string) (APIKey, bool) {
+	for _, key := range currentConfig().APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key.AccessKey), []byte(accessKey)) == 1 {
+			return key, true
+		}
+	}
+	return APIKey{}, false
+}
+
+// findAPISecret returns the API key whose secret is token.
+func findAPISecret(token string) (APIKey, bool) {
+	var found APIKey
+	ok := false
+	for _, key := range currentConfig().APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key.SecretKey), []byte(token)) == 1 {
+			found, ok = key, true
+		}
+	}
+	return found, ok
+}
+
+// label names the key in logs and statistics.
+func (k APIKey) label() string {
+	if k.Name != "" {
+		return "key:" + k.Name
+	}
+	return "key:" + k.AccessKey
+}
+
+// bearerIdentity checks an "Authorization: Bearer <token>" value holding the
+// admin password or an API key secret and returns who sent it.
+func bearerIdentity(authorization string) (string, bool) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return "", false
+	}
+	if key, ok := findAPISecret(token); ok {
+		return key.label(), true
+	}
+	if checkAdminPassword(token) {
+		return "admin", true
+	}
+	return "", false
+}
+
+// apiAuth checks the Authorization header with bearerIdentity.
+func apiAuth(ctx *gin.Context) {
+	identity, ok := bearerIdentity(ctx.GetHeader("Authorization"))
+	if !ok {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication failed"})
+		return
+	}
+	ctx.Request = ctx.Request.WithContext(withUploader(ctx.Request.Context(), identity))
+	ctx.Next()
+}
+
+// adminBearer lets requests through that carry the admin password as
+// bearer token.
+func adminBearer(ctx *gin.Context) {
+	password, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if !ok || !checkAdminPassword(password) {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication failed"})
+		return
+	}
+	ctx.Next()
+}
+
+// fileNames returns just the names of infos.
+func fileNames(infos []crates.FileInfo) []string {
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	return names
+}
+
+// uploadErrorStatus picks the HTTP status for an error from StoreFile.
+func uploadErrorStatus(err error) int {
+	if errors.Is(err, errInvalidName) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, errHookRejected) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// registerAPI adds the JSON API under /api/v1 and the public share links.
+func (a *App) registerAPI(r *gin.Engine) {
+	api := r.Group("/api/v1", apiAuth)
+
+	// GET route to list stored files with their metadata
+	api.GET("/files", func(ctx *gin.Context) {
+		infos, err := a.ListFiles(ctx.Request.Context(), ctx.Query("prefix"))
+		if err != nil {
+			reqLogger(a.logger, ctx).Error("Failed to list database files", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list files"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"files": infos})
+	})
+
+	// GET route for the metadata of one file
+	api.GET("/files/:name", func(ctx *gin.Context) {
+		info, err := a.store.Stat(ctx.Request.Context(), ctx.Param("name"))
+		if errors.Is(err, crates.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		} else if err != nil {
+			reqLogger(a.logger, ctx).Error("Failed to stat file", "filename", ctx.Param("name"), "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file metadata"})
+			return
+		}
+		ctx.JSON(http.StatusOK, info)
+	})
+
+	// GET route for the content of one file
+	api.GET("/files/:name/content", func(ctx *gin.Context) {
+		a.ServeFile(ctx, ctx.Param("name"))
+	})
+
+	// GET route for a thumbnail of an image, ?w= picks the width
+	api.GET("/files/:name/thumb", a.serveThumb)
+
+	// POST route to upload one or more files, each in a "file" form field
+	api.POST("/files", func(ctx *gin.Context) {
+		form, err := ctx.MultipartForm()
+		if err != nil || len(form.File["file"]) == 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Failed to receive file"})
+			return
+		}
+
+		type result struct {
+			Name    string           `json:"name"`
+			Size    int64            `json:"size,omitempty"`
+			File    *crates.FileInfo `json:"file,omitempty"`
+			Entries []ExtractResult  `json:"entries,omitempty"` // With ?extract=true
+			Error   string           `json:"error,omitempty"`
+		}
+		extract := extractRequested(ctx)
+		results := make([]result, 0, len(form.File["file"]))
+		status := http.StatusOK
+		for _, header := range form.File["file"] {
+			res := result{Name: filepath.Base(header.Filename)}
+			file, err := header.Open()
+			if err == nil && extract {
+				var prefix string
+				if prefix, err = extractPrefix(ctx, res.Name); err == nil {
+					res.Entries, err = a.ExtractArchive(ctx.Request.Context(), file, header.Size, prefix, false)
+				}
+				file.Close()
+				for _, entry := range res.Entries {
+					if entry.Error != "" {
+						status = http.StatusMultiStatus
+					}
+				}
+			} else if err == nil {
+				res.Size, res.File, err = a.StoreFile(ctx.Request.Context(), res.Name, file, false)
+				file.Close()
+			}
+			if err != nil {
+				reqLogger(a.logger, ctx).Error("Failed to store upload", "filename", res.Name, "error", err)
+				res.Error = err.Error()
+				status = http.StatusMultiStatus
+			} else if extract {
+				reqLogger(a.logger, ctx).Info("Archive extracted", "filename", res.Name, "entries", len(res.Entries))
+			} else {
+				reqLogger(a.logger, ctx).Info("File uploaded to server and database", "filename", res.Name, "bytes", res.Size)
+			}
+			results = append(results, res)
+		}
+		ctx.JSON(status, gin.H{"files": results})
+	})
+
+	// PUT route to upload the request body as name, which may contain "/"
+	// escaped as %2F to keep a directory layout
+	api.PUT("/files/:name", func(ctx *gin.Context) {
+		name := ctx.Param("name")
+		if extractRequested(ctx) {
+			a.extractUpload(ctx, ctx.Request.Context(), name, ctx.Request.Body, 0, false)
+			return
+		}
+		written, info, err := a.StoreFile(ctx.Request.Context(), name, ctx.Request.Body, false)
+		if err != nil {
+			reqLogger(a.logger, ctx).Error("Failed to store upload", "filename", name, "error", err)
+			ctx.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		reqLogger(a.logger, ctx).Info("File uploaded to server and database", "filename", info.Name, "bytes", written)
+		ctx.JSON(http.StatusCreated, info)
+	})
+
+	// DELETE route to remove a file from the server and database
+	api.DELETE("/files/:name", func(ctx *gin.Context) {
+		name := ctx.Param("name")
+		err := a.RemoveFile(ctx.Request.Context(), name)
+		if errors.Is(err, crates.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		} else if errors.Is(err, errHookRejected) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			reqLogger(a.logger, ctx).Error("Error removing file", "filename", name, "error", err)
+			ctx.JSON(uploadErrorStatus(err), gin.H{"error": "Failed to remove file"})
+			return
+		}
+		reqLogger(a.logger, ctx).Info("File removed", "filename", name)
+		ctx.JSON(http.StatusOK, gin.H{"message": "File removed", "name": name})
+	})
+
+	// GET route streaming file events as Server-Sent Events or over a WebSocket
+	api.GET("/events", a.streamEvents)
+
+	// POST route to create a share link for a stored file
+	api.POST("/shares", func(ctx *gin.Context) {
+		var req struct {
+			Name string `json:"name"`
+			TTL  string `json:"ttl"`
+		}
+		if err := ctx.ShouldBindJSON(&req); err != nil || req.Name == "" {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Expected a JSON body with a file name"})
+			return
+		}
+
+		shareCfg := currentConfig().Share
+		ttl := shareCfg.DefaultTTL
+		if req.TTL != "" {
+			parsed, err := time.ParseDuration(req.TTL)
+			if err != nil || parsed <= 0 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be a positive duration such as 1h"})
+				return
+			}
+			ttl = min(parsed, shareCfg.MaxTTL)
+		}
+
+		if _, err := a.store.Stat(ctx.Request.Context(), req.Name); errors.Is(err, crates.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		} else if err != nil {
+			reqLogger(a.logger, ctx).Error("Failed to stat file", "filename", req.Name, "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file metadata"})
+			return
+		}
+
+		share, err := a.shares.Create(req.Name, ttl)
+		if err != nil {
+			reqLogger(a.logger, ctx).Error("Failed to create share link", "filename", req.Name, "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+			return
+		}
+
+		reqLogger(a.logger, ctx).Info("Share link created", "filename", req.Name, "expires_at", share.ExpiresAt)
+		ctx.JSON(http.StatusCreated, gin.H{
+			"token":      share.Token,
+			"name":       share.Name,
+			"url":        requestBaseURL(ctx) + "/s/" + url.PathEscape(share.Token),
+			"expires_at": share.ExpiresAt,
+		})
+	})
+
+	// POST route streaming a ZIP or tar.gz of several files, or starting a
+	// job that builds it in the storage
+	api.POST("/archive", a.createArchive)
+	api.GET("/archive/jobs/:id", a.archiveJob)
+
+	// POST route to store the request body as a text paste
+	api.POST("/paste", a.createPaste)
+
+	// GET routes for pastes, no authentication needed; POST confirms the
+	// view of a burn-after-reading paste in a browser
+	r.GET("/p/:id", a.viewPaste(false))
+	r.GET("/p/:id/raw", a.viewPaste(true))
+	r.POST("/p/:id", a.viewPaste(false))
+
+	// GET route for share links, no authentication needed
+	r.GET("/s/:token", func(ctx *gin.Context) {
+		share, ok := a.shares.Open(ctx.Param("token"))
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Share link not found or expired"})
+			return
+		}
+		ctx.Header("Content-Disposition", `attachment; filename="`+strings.ReplaceAll(share.Name, `"`, "")+`"`)
+		a.ServeFile(ctx, share.Name)
+	})
+}
+
+// requestBaseURL rebuilds the scheme and host the client used to reach us.
+func requestBaseURL(ctx *gin.Context) string {
+	scheme := "http"
+	if ctx.Request.TLS != nil || ctx.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + ctx.Request.Host
+}
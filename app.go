@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"tempo/crates"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// App holds the state shared by the HTTP routes and every other frontend
+// that stores files through the server.
+type App struct {
+	cfg       *Config // Startup configuration, use currentConfig() for reloadable settings
+	logger    *slog.Logger
+	uploadDir string
+	workDir   string // Spools and unfinished uploads, outside uploadDir so no route serves them
+	queue     *FileQueue
+	health    *Health
+	scrubber  *Scrubber
+	shares    *ShareStore
+	pastes    *PasteStore
+	archives  *ArchiveJobs
+	hooks     *Hooks
+	store     crates.Backend
+	buckets   crates.Buckets // Every bucket, store is the default one
+	internal  crates.Buckets // The same storage without hooks, events or quota, for the server's own files
+	events    *Events
+
+	ctx        context.Context // Cancelled when the server starts shutting down
+	background sync.WaitGroup  // Short-lived goroutines the shutdown waits for
+}
+
+// internalBucketPrefix starts the names of the buckets the server keeps its
+// own files in, like the pastes. S3 bucket names cannot start with it.
+const internalBucketPrefix = "_"
+
+// publicBuckets leaves the internal buckets out of the bucket listings.
+type publicBuckets struct {
+	crates.Buckets
+}
+
+func (b publicBuckets) Names(ctx context.Context) ([]string, error) {
+	names, err := b.Buckets.Names(ctx)
+	return slices.DeleteFunc(names, func(name string) bool {
+		return strings.HasPrefix(name, internalBucketPrefix)
+	}), err
+}
+
+// errInvalidName is returned for file names that cannot be stored.
+var errInvalidName = errors.New("invalid file name")
+
+// cleanName reduces a client supplied name to a relative, slash separated
+// path that cannot leave the upload directory, e.g. "docs/a.txt".
+func cleanName(name string) (string, error) {
+	name = strings.ReplaceAll(strings.TrimSpace(name), `\`, "/")
+	name = path.Clean("/" + name)[1:] // Rooted first so ".." cannot climb out
+	if name == "" {
+		return "", errInvalidName
+	}
+	return name, nil
+}
+
+// localPath returns where name is kept in the upload directory.
+func (a *App) localPath(name string) string {
+	return filepath.Join(a.uploadDir, filepath.FromSlash(name))
+}
+
+// StoreFile writes r to the upload directory as name and queues it; unless
+// localOnly is set the saved copy is then uploaded to GridFS. This is the
+// path every upload takes, whatever frontend it came from. The content only
+// replaces an earlier copy of name once the hooks and the quota accept it.
+func (a *App) StoreFile(ctx context.Context, name string, r io.Reader, localOnly bool) (int64, *crates.FileInfo, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	filePath := a.localPath(name)
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return 0, nil, fmt.Errorf("failed to create directory on server: %w", err)
+	}
+	out, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create file on server: %w", err)
+	}
+	tmpPath := out.Name()
+	defer os.Remove(tmpPath) // Gone by then unless something failed
+	received := sha256.New()
+	source := io.TeeReader(r, received)
+	written, err := io.Copy(out, stripMetadata(name, source))
+	if err == nil {
+		_, err = io.Copy(io.Discard, source) // Trailing bytes the stripping left unread
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to save file: %w", err)
+	}
+	ctx = withStripped(ctx)
+
+	// The hooks see the saved copy, so a rewrite shows in both places
+	file := HookFile{Stage: HookPreUpload, Name: name, Size: written, Path: tmpPath, Client: uploaderFrom(ctx)}
+	if !localOnly {
+		file.Bucket = crates.DefaultBucket()
+	}
+	if a.hooks.has(HookPreUpload) {
+		if err := a.hooks.Run(ctx, &file); err != nil {
+			return 0, nil, err
+		}
+		if stat, err := os.Stat(tmpPath); err == nil {
+			written = stat.Size()
+		}
+	}
+	ctx = withHooksRan(ctx)
+
+	if err := checkQuota(ctx, a.store, name, written); err != nil {
+		return 0, nil, err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return 0, nil, fmt.Errorf("failed to save file: %w", err)
+	}
+
+	if !a.queue.Contains(name) {
+		a.queue.Enqueue(name)
+	}
+	bytesUploaded.Add(float64(written))
+	if localOnly {
+		activity.recordUpload(ctx, written)
+		a.events.Publish(Event{Type: EventUploaded, Name: name,
+			File: &crates.FileInfo{Name: name, Size: written, UploadedAt: time.Now().UTC()}})
+		file.Size = written
+		a.hooks.After(ctx, file)
+		return written, nil, nil
+	}
+
+	saved, err := os.Open(filePath)
+	if err != nil {
+		return written, nil, fmt.Errorf("failed to reopen saved file: %w", err)
+	}
+	defer saved.Close()
+
+	info, err := a.store.Upload(ctx, name, saved)
+	if err != nil {
+		return written, nil, fmt.Errorf("failed to upload file to database: %w", err)
+	}
+	// Clients checking the stored hash against theirs need to know
+	if sum := hex.EncodeToString(received.Sum(nil)); sum != info.SHA256 {
+		info.OriginalSHA256 = sum
+	}
+	file.Size, file.SHA256 = info.Size, info.SHA256
+	a.hooks.After(ctx, file)
+	return written, info, nil
+}
+
+// uploadToDatabase answers POST /up, storing the file field on the server
+// and in the database.
+func (a *App) uploadToDatabase(ctx *gin.Context) {
+	file, header, err := ctx.Request.FormFile("file")
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Failed to receive file"})
+		return
+	}
+	defer file.Close()
+
+	// Save on the server, add to queue and database
+	filename := filepath.Base(header.Filename) // Sanitize filename
+	uploadCtx := withUploader(ctx.Request.Context(), "ip:"+ctx.ClientIP())
+	if extractRequested(ctx) {
+		a.extractUpload(ctx, uploadCtx, filename, file, header.Size, false)
+		return
+	}
+	written, info, err := a.StoreFile(uploadCtx, filename, file, false)
+	if err != nil {
+		reqLogger(a.logger, ctx).Error("Failed to store upload", "filename", filename, "error", err)
+		ctx.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	reqLogger(a.logger, ctx).Info("File uploaded to server and database", "filename", filename, "bytes", written)
+	a.queue.PrintQueue()
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "File uploaded successfully to server and database",
+		"size":    written,
+		"file":    info,
+	})
+}
+
+// ListFiles returns the stored files whose names start with prefix, sorted
+// by name.
+func (a *App) ListFiles(ctx context.Context, prefix string) ([]crates.FileInfo, error) {
+	infos, err := a.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filtered := infos[:0]
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name, prefix) {
+			filtered = append(filtered, info)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i].Name < filtered[j].Name })
+	return filtered, nil
+}
+
+// RemoveFile deletes name from the upload directory, the queue and GridFS.
+// It returns crates.ErrNotFound when the file existed nowhere.
+func (a *App) RemoveFile(ctx context.Context, name string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if err := a.preDelete(ctx, name); err != nil {
+		return err
+	}
+	ctx = withHooksRan(ctx)
+
+	local := false
+	if a.queue.Contains(name) {
+		switch err := os.Remove(a.localPath(name)); {
+		case err == nil:
+			local = true
+		case !os.IsNotExist(err):
+			return fmt.Errorf("failed to remove file: %w", err)
+		}
+	}
+	// Remove from queue regardless if file exists (clean up queue)
+	a.queue.Remove(name)
+
+	err = a.store.Delete(ctx, name)
+	if errors.Is(err, crates.ErrNotFound) && local {
+		err = nil // Only ever stored on the server
+	}
+	if err == nil {
+		a.shares.RemoveFile(name)
+	}
+	return err
+}
+
+// preDelete runs the pre_delete hooks for name, a file in the storage or
+// only in the upload directory, unless ctx says they ran already.
+func (a *App) preDelete(ctx context.Context, name string) error {
+	if hooksRan(ctx) || !a.hooks.has(HookPreDelete) {
+		return nil
+	}
+	file := HookFile{Stage: HookPreDelete, Bucket: crates.DefaultBucket(), Name: name, Client: uploaderFrom(ctx)}
+	info, err := a.store.Stat(ctx, name)
+	switch {
+	case err == nil:
+		file.Size, file.SHA256 = info.Size, info.SHA256
+	case errors.Is(err, crates.ErrNotFound) && a.hasLocalCopy(name):
+		stat, statErr := os.Stat(a.localPath(name))
+		if statErr != nil {
+			return statErr
+		}
+		file.Bucket, file.Size = "", stat.Size()
+	case errors.Is(err, crates.ErrNotFound):
+		return nil // RemoveFile reports it missing
+	default:
+		return err
+	}
+	return a.hooks.Run(ctx, &file)
+}
+
+// hasLocalCopy reports whether name, already cleaned, is still in the upload
+// directory from an upload.
+func (a *App) hasLocalCopy(name string) bool {
+	_, err := os.Stat(a.localPath(name))
+	return err == nil && a.queue.Contains(name)
+}
+
+// dropLocalCopy removes the upload directory copy of name, for when the
+// stored file changed in a way the copy does not follow, like a rename.
+func (a *App) dropLocalCopy(name string) {
+	if !a.queue.Contains(name) {
+		return
+	}
+	a.queue.Remove(name)
+	if err := os.Remove(a.localPath(name)); err != nil && !os.IsNotExist(err) {
+		a.logger.Warn("Failed to remove local copy", "filename", name, "error", err)
+	}
+}
+
+// ServeFile sends a stored file to the client. Files still on disk from an
+// upload are served directly; anything else is fetched from GridFS into the
+// upload directory and removed again after a short delay.
+func (a *App) ServeFile(ctx *gin.Context, name string) {
+	log := reqLogger(a.logger, ctx)
+	name, err := cleanName(name)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	outputPath := a.localPath(name)
+
+	// Files uploaded through this server are still on disk until the
+	// auto-cleanup removes them, so serve those without a GridFS round trip
+	if a.hasLocalCopy(name) {
+		downloadCache.WithLabelValues("hit").Inc()
+		ctx.File(outputPath)
+		bytesDownloaded.Add(float64(ctx.Writer.Size()))
+		a.events.Publish(Event{Type: EventDownloaded, Bucket: crates.DefaultBucket(), Name: name})
+		log.Info("File downloaded from local copy", "filename", name)
+		return
+	}
+	downloadCache.WithLabelValues("miss").Inc()
+
+	err = os.MkdirAll(filepath.Dir(outputPath), 0755)
+	var out *os.File
+	if err == nil {
+		out, err = os.Create(outputPath)
+	}
+	if err != nil {
+		log.Error("Failed to create temporary file", "filename", name, "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file from database"})
+		return
+	}
+	_, err = a.store.Download(ctx.Request.Context(), name, out)
+	out.Close()
+	if err != nil {
+		os.Remove(outputPath)
+		if errors.Is(err, crates.ErrNotFound) {
+			log.Warn("File not found in database", "filename", name)
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "File not found in database"})
+			return
+		}
+		log.Error("Failed to retrieve file from database", "filename", name, "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file from database"})
+		return
+	}
+
+	// Send file to client
+	ctx.File(outputPath)
+	bytesDownloaded.Add(float64(ctx.Writer.Size()))
+	log.Info("File downloaded from database", "filename", name)
+
+	// Clean up file after sending
+	a.background.Add(1)
+	go func() {
+		defer a.background.Done()
+
+		// Give time for the file to be sent, unless the server is stopping
+		select {
+		case <-time.After(currentConfig().Server.TempFileDelay):
+		case <-a.ctx.Done():
+		}
+		if a.queue.Contains(name) {
+			return // Uploaded again meanwhile, the copy is no longer temporary
+		}
+		if err := os.Remove(outputPath); err != nil {
+			a.logger.Error("Error removing temporary file", "filename", name, "error", err)
+		} else {
+			a.logger.Debug("Removed temporary file", "filename", name)
+		}
+	}()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStoreFileKeepsCopyOnRejectedUpload(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.Quota.MaxFileMB = 1 })
+	app, _ := newTestApp(t)
+	ctx := context.Background()
+	if _, _, err := app.StoreFile(ctx, "a.txt", strings.NewReader("old"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	large := bytes.Repeat([]byte("x"), 2<<20)
+	if _, _, err := app.StoreFile(ctx, "a.txt", bytes.NewReader(large), true); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("upload over quota: %v, want errQuotaExceeded", err)
+	}
+	if data, err := os.ReadFile(app.localPath("a.txt")); err != nil || string(data) != "old" {
+		t.Fatalf("copy after the rejected upload: %q, %v, want the earlier one", data, err)
+	}
+	if !app.hasLocalCopy("a.txt") {
+		t.Error("earlier copy no longer served")
+	}
+	entries, err := os.ReadDir(app.uploadDir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("upload directory holds %v, %v, want only a.txt", entries, err)
+	}
+}
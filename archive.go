@@ -0,0 +1,347 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"tempo/crates"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// archiveFolder holds the archives built by jobs.
+const archiveFolder = "archive"
+
+// archiveManifest is the last entry of every archive.
+const archiveManifest = "MANIFEST.json"
+
+// archiveJobKeep is how long finished jobs can still be looked up.
+const archiveJobKeep = 24 * time.Hour
+
+// archiveFormats maps the accepted formats to their file extension.
+var archiveFormats = map[string]string{
+	"zip":    ".zip",
+	"tar.gz": ".tar.gz",
+	"tgz":    ".tar.gz",
+}
+
+// archiveRequest is the body of POST /api/v1/archive. Names and Prefix
+// select the files; with neither every file is included.
+type archiveRequest struct {
+	Names  []string `json:"names"`
+	Prefix string   `json:"prefix"`
+	Format string   `json:"format"` // zip (default), tar.gz or tgz
+	Async  bool     `json:"async"`  // Build it in the storage as a job instead of streaming it
+}
+
+// selectArchiveFiles returns the stored files the request asks for, sorted
+// by name, and the asked names that do not exist.
+func (a *App) selectArchiveFiles(ctx context.Context, req archiveRequest) ([]crates.FileInfo, []string, error) {
+	infos, err := a.ListFiles(ctx, req.Prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(req.Names) == 0 {
+		return infos, nil, nil
+	}
+
+	byName := make(map[string]crates.FileInfo, len(infos))
+	for _, info := range infos {
+		byName[info.Name] = info
+	}
+	var selected []crates.FileInfo
+	var missing []string
+	seen := make(map[string]bool)
+	for _, name := range req.Names {
+		name, err := cleanName(name)
+		if err != nil || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if info, ok := byName[name]; ok {
+			selected = append(selected, info)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	slices.SortFunc(selected, func(x, y crates.FileInfo) int { return strings.Compare(x.Name, y.Name) })
+	return selected, missing, nil
+}
+
+// archiveWriter is what writeArchive needs from the zip and tar writers.
+type archiveWriter interface {
+	add(info crates.FileInfo) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct{ *zip.Writer }
+
+func (z zipArchive) add(info crates.FileInfo) (io.Writer, error) {
+	return z.CreateHeader(&zip.FileHeader{Name: info.Name, Method: zip.Deflate, Modified: info.UploadedAt})
+}
+
+type tarArchive struct {
+	*tar.Writer
+	gz *gzip.Writer
+}
+
+func (t tarArchive) add(info crates.FileInfo) (io.Writer, error) {
+	err := t.WriteHeader(&tar.Header{Name: info.Name, Mode: 0644, Size: info.Size, ModTime: info.UploadedAt, Typeflag: tar.TypeReg})
+	return t.Writer, err
+}
+
+func (t tarArchive) Close() error {
+	if err := t.Writer.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+// writeArchive streams files from the storage into w, one entry at a time,
+// followed by a manifest. Nothing is buffered on disk. On error the archive
+// is left unfinished so clients notice it is broken.
+func (a *App) writeArchive(ctx context.Context, w io.Writer, format string, files []crates.FileInfo) error {
+	var archive archiveWriter
+	if format == "zip" {
+		archive = zipArchive{zip.NewWriter(w)}
+	} else {
+		gz := gzip.NewWriter(w)
+		archive = tarArchive{Writer: tar.NewWriter(gz), gz: gz}
+	}
+
+	for _, info := range files {
+		entry, err := archive.add(info)
+		if err != nil {
+			return err
+		}
+		written, err := a.store.Download(ctx, info.Name, entry)
+		if err != nil {
+			return fmt.Errorf("%s: %w", info.Name, err)
+		}
+		if written != info.Size {
+			return fmt.Errorf("%s: read %d bytes, expected %d", info.Name, written, info.Size)
+		}
+	}
+
+	manifest, err := json.MarshalIndent(map[string]any{
+		"created_at": time.Now().UTC(),
+		"files":      files,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	entry, err := archive.add(crates.FileInfo{Name: archiveManifest, Size: int64(len(manifest)), UploadedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if _, err := entry.Write(manifest); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// ArchiveJob builds an archive into the storage in the background.
+type ArchiveJob struct {
+	ID         string    `json:"id"`
+	Status     string    `json:"status"` // pending, running, done or failed
+	Format     string    `json:"format"`
+	Name       string    `json:"name"` // Stored archive
+	Files      int       `json:"files"`
+	Bytes      int64     `json:"bytes"` // Of the selected files
+	Size       int64     `json:"size,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+}
+
+// Archive job states.
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// ArchiveJobs tracks the archive jobs in memory; the archives they build
+// are ordinary stored files.
+type ArchiveJobs struct {
+	mutex sync.Mutex
+	jobs  map[string]*ArchiveJob
+	slots chan struct{} // Limits how many archives are built at once
+}
+
+func NewArchiveJobs() *ArchiveJobs {
+	return &ArchiveJobs{jobs: make(map[string]*ArchiveJob), slots: make(chan struct{}, 2)}
+}
+
+// add registers a new job and forgets the ones finished long ago.
+func (j *ArchiveJobs) add(job *ArchiveJob) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for id, old := range j.jobs {
+		if !old.FinishedAt.IsZero() && time.Since(old.FinishedAt) > archiveJobKeep {
+			delete(j.jobs, id)
+		}
+	}
+	j.jobs[job.ID] = job
+}
+
+// get returns a copy of the job id.
+func (j *ArchiveJobs) get(id string) (ArchiveJob, bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return ArchiveJob{}, false
+	}
+	return *job, true
+}
+
+// update changes the job id under the lock.
+func (j *ArchiveJobs) update(id string, change func(job *ArchiveJob)) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if job, ok := j.jobs[id]; ok {
+		change(job)
+	}
+}
+
+// runArchiveJob streams the archive straight into the storage through a
+// pipe, so large sets need no disk space on the server.
+func (a *App) runArchiveJob(job ArchiveJob, files []crates.FileInfo) {
+	defer a.background.Done()
+	select {
+	case a.archives.slots <- struct{}{}:
+		defer func() { <-a.archives.slots }()
+	case <-a.ctx.Done():
+		a.archives.update(job.ID, func(j *ArchiveJob) {
+			j.Status, j.Error, j.FinishedAt = JobFailed, "server shutting down", time.Now().UTC()
+		})
+		return
+	}
+	a.archives.update(job.ID, func(j *ArchiveJob) { j.Status = JobRunning })
+	ctx := withUploader(a.ctx, "archive")
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(a.writeArchive(ctx, writer, job.Format, files))
+	}()
+	info, err := a.store.Upload(ctx, job.Name, reader)
+	reader.CloseWithError(err) // Stops the writer if the upload failed first
+
+	if err != nil {
+		a.logger.Error("Archive job failed", "job", job.ID, "error", err)
+		a.store.Delete(context.WithoutCancel(ctx), job.Name)
+		a.archives.update(job.ID, func(j *ArchiveJob) {
+			j.Status, j.Error, j.FinishedAt = JobFailed, err.Error(), time.Now().UTC()
+		})
+		return
+	}
+	a.logger.Info("Archive job done", "job", job.ID, "filename", job.Name, "files", job.Files, "bytes", info.Size)
+	a.archives.update(job.ID, func(j *ArchiveJob) {
+		j.Status, j.Size, j.FinishedAt = JobDone, info.Size, time.Now().UTC()
+	})
+}
+
+// archiveJobJSON adds the links of a job to its state.
+func archiveJobJSON(ctx *gin.Context, job ArchiveJob) gin.H {
+	base := requestBaseURL(ctx) + "/api/v1"
+	body := gin.H{"job": job, "status_url": base + "/archive/jobs/" + url.PathEscape(job.ID)}
+	if job.Status == JobDone {
+		body["download_url"] = base + "/files/" + url.PathEscape(job.Name) + "/content"
+	}
+	return body
+}
+
+// createArchive answers POST /api/v1/archive, streaming the archive or
+// starting a job for it.
+func (a *App) createArchive(ctx *gin.Context) {
+	var req archiveRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Expected a JSON body with names or a prefix"})
+		return
+	}
+	if req.Format == "" {
+		req.Format = "zip"
+	}
+	ext, ok := archiveFormats[req.Format]
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "format must be zip, tar.gz or tgz"})
+		return
+	}
+
+	files, missing, err := a.selectArchiveFiles(ctx.Request.Context(), req)
+	if err != nil {
+		reqLogger(a.logger, ctx).Error("Failed to list database files", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list files"})
+		return
+	}
+	if len(missing) > 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Files not found", "missing": missing})
+		return
+	}
+	if len(files) == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "No files match"})
+		return
+	}
+	var total int64
+	for _, info := range files {
+		total += info.Size
+	}
+
+	if req.Async {
+		id, err := randomHex(8)
+		if err != nil {
+			reqLogger(a.logger, ctx).Error("Failed to create archive job", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create archive job"})
+			return
+		}
+		name := archiveFolder + "/" + id + ext
+		if err := checkQuota(ctx.Request.Context(), a.store, name, total); err != nil {
+			ctx.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		job := &ArchiveJob{ID: id, Status: JobPending, Format: req.Format, Name: name,
+			Files: len(files), Bytes: total, CreatedAt: time.Now().UTC()}
+		a.archives.add(job)
+		a.background.Add(1)
+		go a.runArchiveJob(*job, files)
+		reqLogger(a.logger, ctx).Info("Archive job started", "job", id, "files", len(files), "bytes", total)
+		ctx.JSON(http.StatusAccepted, archiveJobJSON(ctx, *job))
+		return
+	}
+
+	ctx.Header("Content-Disposition", `attachment; filename="files`+ext+`"`)
+	if req.Format == "zip" {
+		ctx.Header("Content-Type", "application/zip")
+	} else {
+		ctx.Header("Content-Type", "application/gzip")
+	}
+	ctx.Status(http.StatusOK)
+	if err := a.writeArchive(ctx.Request.Context(), ctx.Writer, req.Format, files); err != nil {
+		// The status is already sent; the unfinished archive shows the failure
+		reqLogger(a.logger, ctx).Error("Failed to stream archive", "files", len(files), "error", err)
+		return
+	}
+	reqLogger(a.logger, ctx).Info("Archive streamed", "format", req.Format, "files", len(files), "bytes", total)
+}
+
+// archiveJob answers GET /api/v1/archive/jobs/:id.
+func (a *App) archiveJob(ctx *gin.Context) {
+	job, ok := a.archives.get(ctx.Param("id"))
+	if !ok {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Archive job not found"})
+		return
+	}
+	ctx.JSON(http.StatusOK, archiveJobJSON(ctx, job))
+}
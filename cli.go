@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/joho/godotenv"
+)
+
+// command is one subcommand of the tempo binary.
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	// Assigned here because help refers back to the list
+	commands = []command{
+		{"serve", "[flags]", "run the HTTP server (default when no command is given)", serveCommand},
+		{"upload", "[flags] <file|glob>...", "upload local files", uploadCommand},
+		{"download", "[flags] <name|glob>...", "download stored files", downloadCommand},
+		{"list", "[flags] [prefix]", "list stored files", listCommand},
+		{"delete", "[flags] <name|glob>...", "delete stored files", deleteCommand},
+		{"sync", "[flags] <dir>", "mirror a local directory onto the server, optionally both ways", syncCommand},
+		{"watch", "[flags] <dir>", "upload files as they appear in a directory", watchCommand},
+		{"share", "[flags] <name>", "create a share link for a stored file", shareCommand},
+		{"discover", "[flags]", "find servers on the local network", discoverCommand},
+		{"admin", "[flags] listserver|listdatabase|ip|addresses|scrub|scrub-report", "run an admin action on the server", adminCommand},
+		{"help", "", "show this help", helpCommand},
+	}
+}
+
+// runCLI dispatches args to a subcommand and returns the exit code.
+func runCLI(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return serveCommand(args) // Plain "tempo -port 9000" keeps starting the server
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "tempo: unknown command %q\n\n", args[0])
+	printUsage(os.Stderr)
+	return 2
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: tempo <command> [flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "tempo <command> -h" for the flags of a command.`)
+}
+
+func helpCommand([]string) int {
+	printUsage(os.Stdout)
+	return 0
+}
+
+// serveCommand starts the server; this was main before subcommands existed.
+func serveCommand(args []string) int {
+	cfg, opts, err := loadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if opts.printConfig {
+		if err := printConfig(os.Stdout, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	Server(cfg, args)
+	return 0
+}
+
+// clientOptions are the flags shared by every client command.
+type clientOptions struct {
+	server   string
+	password string
+	json     bool
+	direct   bool
+	quiet    bool
+}
+
+// newClientFlags returns a flag set for name with the shared client flags.
+func newClientFlags(name string) (*flag.FlagSet, *clientOptions) {
+	godotenv.Load() // Optional, same .env the server reads
+
+	opts := &clientOptions{}
+	server := os.Getenv("TEMPO_SERVER")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&opts.server, "server", server, "server base URL (TEMPO_SERVER)")
+	flags.StringVar(&opts.password, "password", "", "admin password (default TEMPO_PASSWORD or ADMPASSWORD)")
+	flags.BoolVar(&opts.json, "json", false, "print results as JSON")
+	flags.BoolVar(&opts.direct, "direct", false, "use the storage backend directly instead of a server")
+	flags.BoolVar(&opts.quiet, "quiet", false, "hide progress bars")
+	for _, cmd := range commands {
+		if cmd.name == name {
+			flags.Usage = func() {
+				summary := strings.ToUpper(cmd.summary[:1]) + cmd.summary[1:]
+				fmt.Fprintf(flags.Output(), "Usage: tempo %s %s\n\n%s.\n\nFlags:\n", name, cmd.usage, summary)
+				flags.PrintDefaults()
+			}
+		}
+	}
+	return flags, opts
+}
+
+// parseClientFlags parses args and reports the exit code to use when the
+// command should stop right away.
+func parseClientFlags(flags *flag.FlagSet, opts *clientOptions, args []string, minArgs int) (int, bool) {
+	if err := flags.Parse(args); errors.Is(err, flag.ErrHelp) {
+		return 0, false
+	} else if err != nil {
+		return 2, false
+	}
+	// Read here rather than as the flag default so -h never prints it
+	if opts.password == "" {
+		opts.password = os.Getenv("TEMPO_PASSWORD")
+	}
+	if opts.password == "" {
+		opts.password = os.Getenv("ADMPASSWORD")
+	}
+	if flags.NArg() < minArgs {
+		flags.Usage()
+		return 2, false
+	}
+	return 0, true
+}
+
+// remote opens the HTTP client or, with -direct, the storage backend.
+func (o *clientOptions) remote() (Remote, error) {
+	if o.direct {
+		return newDirectRemote()
+	}
+	return NewClient(o.server, o.password), nil
+}
+
+// cliContext is cancelled on Ctrl-C so transfers stop cleanly.
+func cliContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// printJSON writes v indented to stdout.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// fail prints err for the command and returns the failure exit code.
+func fail(name string, err error) int {
+	fmt.Fprintf(os.Stderr, "tempo %s: %v\n", name, err)
+	return 1
+}
+
+// hasMeta reports whether pattern uses glob syntax.
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// transferResult is one line of upload/download/delete output.
+type transferResult struct {
+	Name  string `json:"name"`
+	Path  string `json:"path,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// report prints results and returns 1 if any of them failed.
+func report(opts *clientOptions, verb string, results []transferResult) int {
+	code := 0
+	for _, res := range results {
+		if res.Error != "" {
+			code = 1
+		}
+	}
+	if opts.json {
+		if err := printJSON(results); err != nil {
+			return 1
+		}
+		return code
+	}
+	for _, res := range results {
+		switch {
+		case res.Error != "":
+			fmt.Fprintf(os.Stderr, "%s: %s\n", res.Name, res.Error)
+		case !opts.quiet:
+			fmt.Printf("%s %s (%s)\n", verb, res.Name, formatBytes(res.Size))
+		}
+	}
+	return code
+}
+
+func uploadCommand(args []string) int {
+	flags, opts := newClientFlags("upload")
+	if code, ok := parseClientFlags(flags, opts, args, 1); !ok {
+		return code
+	}
+
+	// Expand globs here too, for shells that don't (and quoted patterns)
+	var paths []string
+	for _, arg := range flags.Args() {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return fail("upload", fmt.Errorf("%s: %w", arg, err))
+		}
+		if len(matches) == 0 {
+			matches = []string{arg} // Reported as missing below
+		}
+		paths = append(paths, matches...)
+	}
+
+	remote, err := opts.remote()
+	if err != nil {
+		return fail("upload", err)
+	}
+	ctx, stop := cliContext()
+	defer stop()
+	defer remote.Close(context.Background())
+
+	var results []transferResult
+	for _, p := range paths {
+		res := transferResult{Name: filepath.Base(p), Path: p}
+		if err := uploadOne(ctx, remote, opts, p, &res); err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return report(opts, "uploaded", results)
+}
+
+func uploadOne(ctx context.Context, remote Remote, opts *clientOptions, p string, res *transferResult) error {
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.New("is a directory")
+	}
+
+	bar := newProgress(res.Name, info.Size(), opts.quiet || opts.json)
+	stored, err := remote.Upload(ctx, res.Name, io.TeeReader(file, bar))
+	bar.Finish()
+	if err != nil {
+		return err
+	}
+	res.Size = info.Size()
+	if stored != nil {
+		res.Size = stored.Size
+	}
+	return nil
+}
+
+// matchRemote expands glob patterns against the stored file names. Plain
+// names are passed through so a missing file is reported by the server.
+func matchRemote(ctx context.Context, remote Remote, patterns []string) ([]string, error) {
+	var names []string
+	var stored []string
+	for _, pattern := range patterns {
+		if !hasMeta(pattern) {
+			names = append(names, pattern)
+			continue
+		}
+		if stored == nil {
+			infos, err := remote.List(ctx)
+			if err != nil {
+				return nil, err
+			}
+			stored = fileNames(infos)
+		}
+		matched := false
+		for _, name := range stored {
+			if ok, err := path.Match(pattern, name); err != nil {
+				return nil, fmt.Errorf("%s: %w", pattern, err)
+			} else if ok {
+				names = append(names, name)
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("%s: no stored files match", pattern)
+		}
+	}
+	return names, nil
+}
+
+func downloadCommand(args []string) int {
+	flags, opts := newClientFlags("download")
+	output := flags.String("o", ".", "output directory, or file name when downloading a single file")
+	if code, ok := parseClientFlags(flags, opts, args, 1); !ok {
+		return code
+	}
+
+	remote, err := opts.remote()
+	if err != nil {
+		return fail("download", err)
+	}
+	ctx, stop := cliContext()
+	defer stop()
+	defer remote.Close(context.Background())
+
+	names, err := matchRemote(ctx, remote, flags.Args())
+	if err != nil {
+		return fail("download", err)
+	}
+
+	// -o names a file only for a single download into a path that is not a directory
+	single := ""
+	if info, err := os.Stat(*output); len(names) == 1 && (err != nil || !info.IsDir()) {
+		single = *output
+	} else if err != nil {
+		if err := os.MkdirAll(*output, 0755); err != nil {
+			return fail("download", err)
+		}
+	}
+
+	var results []transferResult
+	for _, name := range names {
+		dest := single
+		if dest == "" {
+			dest = filepath.Join(*output, filepath.Base(name))
+		}
+		res := transferResult{Name: name, Path: dest}
+		if res.Size, err = downloadOne(ctx, remote, opts, name, dest); err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return report(opts, "downloaded", results)
+}
+
+func downloadOne(ctx context.Context, remote Remote, opts *clientOptions, name, dest string) (int64, error) {
+	// Write next to the destination and rename, so failures leave no partial file
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*.part")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	bar := newProgress(name, -1, opts.quiet || opts.json)
+	written, err := remote.Download(ctx, name, io.MultiWriter(tmp, bar), bar.SetTotal)
+	bar.Finish()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return written, os.Rename(tmp.Name(), dest)
+}
+
+func listCommand(args []string) int {
+	flags, opts := newClientFlags("list")
+	long := flags.Bool("l", false, "show size, upload time and checksum")
+	if code, ok := parseClientFlags(flags, opts, args, 0); !ok {
+		return code
+	}
+
+	remote, err := opts.remote()
+	if err != nil {
+		return fail("list", err)
+	}
+	ctx, stop := cliContext()
+	defer stop()
+	defer remote.Close(context.Background())
+
+	infos, err := remote.List(ctx)
+	if err != nil {
+		return fail("list", err)
+	}
+	if prefix := flags.Arg(0); prefix != "" {
+		filtered := infos[:0]
+		for _, info := range infos {
+			if strings.HasPrefix(info.Name, prefix) {
+				filtered = append(filtered, info)
+			}
+		}
+		infos = filtered
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	if opts.json {
+		if err := printJSON(infos); err != nil {
+			return 1
+		}
+		return 0
+	}
+	if !*long {
+		for _, info := range infos {
+			fmt.Println(info.Name)
+		}
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, info := range infos {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", formatBytes(info.Size), info.UploadedAt.Local().Format("2006-01-02 15:04"), info.SHA256, info.Name)
+	}
+	tw.Flush()
+	return 0
+}
+
+func deleteCommand(args []string) int {
+	flags, opts := newClientFlags("delete")
+	if code, ok := parseClientFlags(flags, opts, args, 1); !ok {
+		return code
+	}
+
+	remote, err := opts.remote()
+	if err != nil {
+		return fail("delete", err)
+	}
+	ctx, stop := cliContext()
+	defer stop()
+	defer remote.Close(context.Background())
+
+	names, err := matchRemote(ctx, remote, flags.Args())
+	if err != nil {
+		return fail("delete", err)
+	}
+
+	var results []transferResult
+	for _, name := range names {
+		res := transferResult{Name: name}
+		if err := remote.Delete(ctx, name); err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+
+	code := 0
+	for _, res := range results {
+		if res.Error != "" {
+			code = 1
+			if !opts.json {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", res.Name, res.Error)
+			}
+		} else if !opts.json && !opts.quiet {
+			fmt.Printf("deleted %s\n", res.Name)
+		}
+	}
+	if opts.json {
+		printJSON(results)
+	}
+	return code
+}
+
+func shareCommand(args []string) int {
+	flags, opts := newClientFlags("share")
+	ttl := flags.String("ttl", "", "how long the link stays valid, e.g. 2h (default: server setting)")
+	if code, ok := parseClientFlags(flags, opts, args, 1); !ok {
+		return code
+	}
+	if opts.direct {
+		return fail("share", errors.New("share links are kept by the server, -direct is not supported"))
+	}
+
+	ctx, stop := cliContext()
+	defer stop()
+	share, err := NewClient(opts.server, opts.password).Share(ctx, flags.Arg(0), *ttl)
+	if err != nil {
+		return fail("share", err)
+	}
+	if opts.json {
+		printJSON(share)
+		return 0
+	}
+	fmt.Println(share["url"])
+	if !opts.quiet {
+		fmt.Fprintf(os.Stderr, "expires at %v\n", share["expires_at"])
+	}
+	return 0
+}
+
+// adminActions maps admin subcommands to the server's admin routes.
+var adminActions = map[string]struct {
+	method string
+	route  string
+}{
+	"listserver":   {http.MethodGet, "listserver"},
+	"listdatabase": {http.MethodGet, "listdatabase"},
+	"ip":           {http.MethodGet, "ipserver"},
+	"addresses":    {http.MethodGet, "addresses"},
+	"scrub":        {http.MethodPost, "scrub"},
+	"scrub-report": {http.MethodGet, "scrub"},
+}
+
+func adminCommand(args []string) int {
+	flags, opts := newClientFlags("admin")
+	if code, ok := parseClientFlags(flags, opts, args, 1); !ok {
+		return code
+	}
+	action, ok := adminActions[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "tempo admin: unknown action %q\n", flags.Arg(0))
+		flags.Usage()
+		return 2
+	}
+	if opts.direct {
+		return fail("admin", errors.New("admin actions need a server, -direct is not supported"))
+	}
+
+	ctx, stop := cliContext()
+	defer stop()
+	body, err := NewClient(opts.server, opts.password).Admin(ctx, action.method, action.route)
+	if err != nil {
+		return fail("admin", err)
+	}
+
+	// Text answers become a JSON list in -json mode; JSON answers pass through
+	if opts.json && !json.Valid(body) {
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		if len(lines) == 1 && lines[0] == "" {
+			lines = []string{}
+		}
+		printJSON(lines)
+		return 0
+	}
+	os.Stdout.Write(body)
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		fmt.Println()
+	}
+	return 0
+}
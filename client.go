@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"tempo/crates"
+)
+
+// Remote is where the command-line client stores files: a running server
+// over HTTP, or the storage backend directly.
+type Remote interface {
+	List(ctx context.Context) ([]crates.FileInfo, error)
+	Upload(ctx context.Context, name string, r io.Reader) (*crates.FileInfo, error)
+	// Download writes name to w; size is called with the length once known.
+	Download(ctx context.Context, name string, w io.Writer, size func(int64)) (int64, error)
+	Delete(ctx context.Context, name string) error
+	Close(ctx context.Context) error
+}
+
+// Client talks to the server's /api/v1 JSON API.
+type Client struct {
+	server   string
+	password string
+	http     *http.Client
+}
+
+// NewClient returns a client for the server at base, e.g. http://localhost:8080.
+func NewClient(base, password string) *Client {
+	return &Client{
+		server:   strings.TrimRight(base, "/"),
+		password: password,
+		http:     &http.Client{},
+	}
+}
+
+// apiError is the {"error": "..."} body the server answers failures with.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server answered %d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("server answered %d: %s", e.Status, e.Message)
+}
+
+// do sends a request to path and returns the response when it succeeded.
+func (c *Client) do(ctx context.Context, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.password != "" {
+		req.Header.Set("Authorization", "Bearer "+c.password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+		err := &apiError{Status: resp.StatusCode, Message: body.Error}
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %v", crates.ErrNotFound, err)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// doJSON sends in as the JSON body (when not nil) and decodes the answer into out.
+func (c *Client) doJSON(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(data), "application/json"
+	}
+
+	resp, err := c.do(ctx, method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// List returns every stored file.
+func (c *Client) List(ctx context.Context) ([]crates.FileInfo, error) {
+	var out struct {
+		Files []crates.FileInfo `json:"files"`
+	}
+	err := c.doJSON(ctx, http.MethodGet, "/api/v1/files", nil, &out)
+	return out.Files, err
+}
+
+// Upload streams r to the server as name.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader) (*crates.FileInfo, error) {
+	info := &crates.FileInfo{}
+	resp, err := c.do(ctx, http.MethodPut, "/api/v1/files/"+url.PathEscape(name), "application/octet-stream", r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return info, json.NewDecoder(resp.Body).Decode(info)
+}
+
+// Download writes the content of name to w.
+func (c *Client) Download(ctx context.Context, name string, w io.Writer, size func(int64)) (int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/api/v1/files/"+url.PathEscape(name)+"/content", "", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if size != nil && resp.ContentLength >= 0 {
+		size(resp.ContentLength)
+	}
+	return io.Copy(w, resp.Body)
+}
+
+// Delete removes name from the server and database.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/api/v1/files/"+url.PathEscape(name), nil, nil)
+}
+
+// Share creates a share link for name; an empty ttl uses the server default.
+func (c *Client) Share(ctx context.Context, name, ttl string) (map[string]any, error) {
+	var out map[string]any
+	err := c.doJSON(ctx, http.MethodPost, "/api/v1/shares", map[string]string{"name": name, "ttl": ttl}, &out)
+	return out, err
+}
+
+// Admin calls one of the password-in-path admin routes and returns the body.
+func (c *Client) Admin(ctx context.Context, method, route string) ([]byte, error) {
+	resp, err := c.do(ctx, method, "/"+route+"/"+url.PathEscape(c.password), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (c *Client) Close(context.Context) error { return nil }
+
+// directRemote uses the storage backend in-process, without a server.
+type directRemote struct{}
+
+// newDirectRemote configures the storage backend from the server config.
+func newDirectRemote() (*directRemote, error) {
+	cfg, _, err := loadConfig(nil)
+	if err != nil {
+		return nil, err
+	}
+	crates.Configure(crates.Settings{
+		URI:        cfg.Mongo.URI,
+		Database:   cfg.Mongo.Database,
+		Collection: cfg.Mongo.Collection,
+		LocalDir:   cfg.Server.UploadDir,
+	})
+	return &directRemote{}, nil
+}
+
+func (directRemote) List(ctx context.Context) ([]crates.FileInfo, error) {
+	return crates.List(ctx)
+}
+
+func (directRemote) Upload(ctx context.Context, name string, r io.Reader) (*crates.FileInfo, error) {
+	return crates.Upload(ctx, name, r)
+}
+
+func (directRemote) Download(ctx context.Context, name string, w io.Writer, size func(int64)) (int64, error) {
+	if size != nil {
+		if info, err := crates.Stat(ctx, name); err == nil {
+			size(info.Size)
+		}
+	}
+	return crates.Download(ctx, name, w)
+}
+
+func (directRemote) Delete(ctx context.Context, name string) error {
+	return crates.Delete(ctx, name)
+}
+
+func (directRemote) Close(ctx context.Context) error {
+	return crates.Disconnect(ctx)
+}
@@ -0,0 +1,810 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every server setting. Values are layered, each overriding the
+// previous one: built-in defaults, the YAML config file, environment variables
+// (including .env) and finally command-line flags.
+type Config struct {
+	Server  ServerConfig  `yaml:"server"`
+	Mongo   MongoConfig   `yaml:"mongo"`
+	Log     LogConfig     `yaml:"log"`
+	Tracing TracingConfig `yaml:"tracing"`
+	Scrub   ScrubConfig   `yaml:"scrub"`
+	Ready   ReadyConfig   `yaml:"ready"`
+	Share   ShareConfig   `yaml:"share"`
+	Paste   PasteConfig   `yaml:"paste"`
+	Extract ExtractConfig `yaml:"extract"`
+	Images  ImagesConfig  `yaml:"images"`
+	Quota   QuotaConfig   `yaml:"quota"`
+	S3      S3Config      `yaml:"s3"`
+	SFTP    SFTPConfig    `yaml:"sftp"`
+	GRPC    GRPCConfig    `yaml:"grpc"`
+	Webhook WebhookConfig `yaml:"webhook"`
+	MDNS    MDNSConfig    `yaml:"mdns"`
+	Network NetworkConfig `yaml:"network"`
+	Hooks   []HookConfig  `yaml:"hooks"`
+	APIKeys []APIKey      `yaml:"api_keys"`
+	Users   []User        `yaml:"users"`
+}
+
+// ServerConfig covers the HTTP server and the local upload directory.
+type ServerConfig struct {
+	Port            int           `yaml:"port"`
+	AdminPassword   string        `yaml:"admin_password"`
+	UploadDir       string        `yaml:"upload_dir"`
+	WorkDir         string        `yaml:"work_dir"` // Spools and unfinished uploads, never served
+	CleanupInterval time.Duration `yaml:"cleanup_interval"`
+	TempFileDelay   time.Duration `yaml:"temp_file_delay"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	Storage         string        `yaml:"storage"` // gridfs, or memory for development
+}
+
+// MongoConfig locates the GridFS bucket.
+type MongoConfig struct {
+	URI        string `yaml:"uri"`
+	Database   string `yaml:"database"`
+	Collection string `yaml:"collection"`
+}
+
+// LogConfig controls the structured logger and log file rotation.
+type LogConfig struct {
+	Level      string `yaml:"level"`
+	Format     string `yaml:"format"`
+	File       string `yaml:"file"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxAgeDays int    `yaml:"max_age_days"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+// TracingConfig selects where OpenTelemetry spans are exported.
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter"` // none, otlp, stdout or file
+	Endpoint    string  `yaml:"endpoint"`
+	File        string  `yaml:"file"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// ScrubConfig schedules the GridFS integrity scrubber.
+type ScrubConfig struct {
+	Interval   time.Duration `yaml:"interval"`
+	Grace      time.Duration `yaml:"grace"`
+	ReportPath string        `yaml:"report_path"`
+}
+
+// ReadyConfig sets the readiness probe thresholds.
+type ReadyConfig struct {
+	MinFreeMB    int           `yaml:"min_free_mb"`
+	MongoTimeout time.Duration `yaml:"mongo_timeout"`
+}
+
+// ShareConfig controls share links handed out by the API.
+type ShareConfig struct {
+	StorePath  string        `yaml:"store_path"`
+	DefaultTTL time.Duration `yaml:"default_ttl"`
+	MaxTTL     time.Duration `yaml:"max_ttl"`
+}
+
+// PasteConfig controls text snippets posted to /api/v1/paste.
+type PasteConfig struct {
+	StorePath  string        `yaml:"store_path"`
+	MaxSizeKB  int           `yaml:"max_size_kb"`
+	DefaultTTL time.Duration `yaml:"default_ttl"`
+	MaxTTL     time.Duration `yaml:"max_ttl"`
+}
+
+// ExtractConfig limits what one archive uploaded with ?extract=true may
+// unpack to; zero means unlimited.
+type ExtractConfig struct {
+	MaxEntries int `yaml:"max_entries"`
+	MaxTotalMB int `yaml:"max_total_mb"`
+	MaxRatio   int `yaml:"max_ratio"` // Unpacked size over archive size
+}
+
+// ImagesConfig covers the thumbnails made for uploaded images and the
+// metadata removed from them.
+type ImagesConfig struct {
+	Widths        []int `yaml:"widths"`         // Thumbnail widths in pixels, none turns thumbnails off
+	Quality       int   `yaml:"quality"`        // JPEG quality of the thumbnails
+	StripMetadata bool  `yaml:"strip_metadata"` // Remove EXIF (GPS included), XMP and comments before storing
+	MaxMegapixels int   `yaml:"max_megapixels"` // Larger images get no thumbnails
+}
+
+// QuotaConfig limits what may be stored; zero means unlimited.
+type QuotaConfig struct {
+	MaxFileMB  int `yaml:"max_file_mb"`
+	MaxTotalMB int `yaml:"max_total_mb"`
+}
+
+// S3Config controls the S3-compatible listener.
+type S3Config struct {
+	Port   int    `yaml:"port"` // 0 disables it
+	Region string `yaml:"region"`
+
+	MultipartTTL time.Duration `yaml:"multipart_ttl"` // Unfinished multipart uploads are dropped after this
+}
+
+// SFTPConfig controls the embedded SFTP server.
+type SFTPConfig struct {
+	Port    int    `yaml:"port"`     // 0 disables it
+	HostKey string `yaml:"host_key"` // Generated on first start when missing
+}
+
+// GRPCConfig controls the gRPC API.
+type GRPCConfig struct {
+	Port      int  `yaml:"port"`      // Own listener, 0 disables it
+	Multiplex bool `yaml:"multiplex"` // Also serve gRPC on server.port over h2c
+}
+
+// WebhookConfig controls outgoing webhook deliveries.
+type WebhookConfig struct {
+	StorePath   string        `yaml:"store_path"` // Subscriptions, queue and delivery logs
+	MaxAttempts int           `yaml:"max_attempts"`
+	Timeout     time.Duration `yaml:"timeout"` // Per attempt
+}
+
+// MDNSConfig controls the LAN announcement.
+type MDNSConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Name    string `yaml:"name"` // "tempo on <host name>" when empty
+}
+
+// NetworkConfig decides which local addresses are reported to clients.
+// Interface rules are shell patterns matched against interface names.
+type NetworkConfig struct {
+	PublicURL string   `yaml:"public_url"` // Preferred URL, e.g. behind a proxy; picked from the addresses when empty
+	Ignore    []string `yaml:"ignore"`     // Virtual interfaces left out
+	Prefer    []string `yaml:"prefer"`     // Interfaces listed first, in this order
+}
+
+// HookConfig runs a local executable around uploads and deletes. It gets
+// the file metadata as JSON on stdin, see hooks.go.
+type HookConfig struct {
+	Name    string        `yaml:"name"`
+	Command []string      `yaml:"command"` // Program and arguments, run without a shell
+	Stages  []string      `yaml:"stages"`  // pre_upload, post_upload and/or pre_delete
+	Timeout time.Duration `yaml:"timeout"` // 10s when unset
+}
+
+// APIKey is an access key pair for programmatic clients. The secret signs S3
+// requests and also works as a bearer token for /api/v1.
+type APIKey struct {
+	Name      string `yaml:"name"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+// User is an account for the file-transfer frontends such as SFTP. Each user
+// sees only its namespace, a folder of the storage.
+type User struct {
+	Name           string   `yaml:"name"`
+	Password       string   `yaml:"password"`
+	AuthorizedKeys []string `yaml:"authorized_keys"` // Lines in OpenSSH authorized_keys format
+	Namespace      string   `yaml:"namespace"`       // The user name when empty, "/" for the whole storage
+}
+
+// defaultConfig returns the settings used when nothing overrides them.
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:            8080,
+			UploadDir:       "./uploads",
+			WorkDir:         "./work",
+			CleanupInterval: 30 * time.Minute,
+			TempFileDelay:   20 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+			Storage:         "gridfs",
+		},
+		Log: LogConfig{
+			Level:      "info",
+			Format:     "json",
+			File:       "server.log",
+			MaxSizeMB:  100,
+			MaxAgeDays: 28,
+			MaxBackups: 5,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			File:        "traces.json",
+			SampleRatio: 1,
+		},
+		Scrub: ScrubConfig{
+			Interval:   24 * time.Hour,
+			Grace:      time.Hour,
+			ReportPath: "scrub-report.json",
+		},
+		Ready: ReadyConfig{
+			MinFreeMB:    100,
+			MongoTimeout: 2 * time.Second,
+		},
+		S3: S3Config{
+			Region:       "us-east-1",
+			MultipartTTL: 24 * time.Hour,
+		},
+		SFTP: SFTPConfig{
+			HostKey: "sftp_host_key",
+		},
+		Share: ShareConfig{
+			StorePath:  "shares.json",
+			DefaultTTL: 24 * time.Hour,
+			MaxTTL:     7 * 24 * time.Hour,
+		},
+		Paste: PasteConfig{
+			StorePath:  "pastes.json",
+			MaxSizeKB:  1024,
+			DefaultTTL: 7 * 24 * time.Hour,
+			MaxTTL:     30 * 24 * time.Hour,
+		},
+		Extract: ExtractConfig{
+			MaxEntries: 10000,
+			MaxTotalMB: 4096,
+			MaxRatio:   100,
+		},
+		Images: ImagesConfig{
+			Widths:        []int{256, 1024},
+			Quality:       85,
+			MaxMegapixels: 50,
+		},
+		Webhook: WebhookConfig{
+			StorePath:   "webhooks.json",
+			MaxAttempts: 8,
+			Timeout:     10 * time.Second,
+		},
+		MDNS: MDNSConfig{
+			Enabled: true,
+		},
+		Network: NetworkConfig{
+			Ignore: []string{"docker*", "br-*", "veth*", "virbr*", "vboxnet*", "vmnet*", "cni*", "flannel*", "kube*"},
+		},
+	}
+}
+
+// defaultConfigFile is read when present and no other file is named.
+const defaultConfigFile = "tempo.yaml"
+
+// configOptions are the flags that are not settings themselves.
+type configOptions struct {
+	path        string
+	printConfig bool
+}
+
+// loadConfig builds the configuration from defaults, the config file, the
+// environment and args, then validates it.
+func loadConfig(args []string) (*Config, configOptions, error) {
+	cfg := defaultConfig()
+	var opts configOptions
+
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.StringVar(&opts.path, "config", os.Getenv("TEMPO_CONFIG"), "path to the YAML config file (default "+defaultConfigFile+" if present)")
+	flags.BoolVar(&opts.printConfig, "print-config", false, "print the effective configuration with secrets redacted and exit")
+	port := flags.Int("port", 0, "HTTP port")
+	uploadDir := flags.String("upload-dir", "", "directory for uploaded files")
+	database := flags.String("database", "", "MongoDB database name")
+	collection := flags.String("collection", "", "GridFS bucket name")
+	logLevel := flags.String("log-level", "", "log level: debug, info, warn or error")
+	logFormat := flags.String("log-format", "", "log format: json or text")
+	logFile := flags.String("log-file", "", "log file path")
+	tracingExporter := flags.String("tracing-exporter", "", "trace exporter: none, otlp, stdout or file")
+	cleanupInterval := flags.Duration("cleanup-interval", 0, "interval between auto-cleanup runs")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 0, "how long to drain requests and jobs on shutdown")
+	if err := flags.Parse(args); err != nil {
+		return nil, opts, err
+	}
+
+	// File layer
+	path := opts.path
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			path = defaultConfigFile
+		}
+	}
+	if path != "" {
+		if err := readConfigFile(path, cfg); err != nil {
+			return nil, opts, err
+		}
+		opts.path = path
+	}
+
+	// Environment layer, .env fills in whatever the real environment lacks
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, opts, fmt.Errorf("failed to load .env: %w", err)
+	}
+	if err := applyEnv(cfg); err != nil {
+		return nil, opts, err
+	}
+
+	// Flag layer, only for flags given explicitly
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Server.Port = *port
+		case "upload-dir":
+			cfg.Server.UploadDir = *uploadDir
+		case "database":
+			cfg.Mongo.Database = *database
+		case "collection":
+			cfg.Mongo.Collection = *collection
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "log-format":
+			cfg.Log.Format = *logFormat
+		case "log-file":
+			cfg.Log.File = *logFile
+		case "tracing-exporter":
+			cfg.Tracing.Exporter = *tracingExporter
+		case "cleanup-interval":
+			cfg.Server.CleanupInterval = *cleanupInterval
+		case "shutdown-timeout":
+			cfg.Server.ShutdownTimeout = *shutdownTimeout
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, opts, err
+	}
+	return cfg, opts, nil
+}
+
+func readConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true) // Typos in key names are errors, not silently ignored
+	if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides cfg with the environment variables that are set.
+func applyEnv(cfg *Config) error {
+	var errs []error
+	str := func(target *string, key string) {
+		if value, ok := os.LookupEnv(key); ok && value != "" {
+			*target = value
+		}
+	}
+	num := func(target *int, key string) {
+		if value, ok := os.LookupEnv(key); ok && value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", key, value))
+				return
+			}
+			*target = n
+		}
+	}
+	boolean := func(target *bool, key string) {
+		if value, ok := os.LookupEnv(key); ok && value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a boolean", key, value))
+				return
+			}
+			*target = b
+		}
+	}
+	list := func(target *[]string, key string) {
+		if value, ok := os.LookupEnv(key); ok {
+			*target = nil
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*target = append(*target, item)
+				}
+			}
+		}
+	}
+	dur := func(target *time.Duration, key string) {
+		if value, ok := os.LookupEnv(key); ok && value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a duration", key, value))
+				return
+			}
+			*target = d
+		}
+	}
+
+	num(&cfg.Server.Port, "PORT")
+	str(&cfg.Server.AdminPassword, "ADMPASSWORD")
+	str(&cfg.Server.UploadDir, "UPLOAD_DIR")
+	str(&cfg.Server.WorkDir, "WORK_DIR")
+	str(&cfg.Server.Storage, "STORAGE")
+	dur(&cfg.Server.CleanupInterval, "CLEANUP_INTERVAL")
+	dur(&cfg.Server.TempFileDelay, "TEMP_FILE_DELAY")
+	dur(&cfg.Server.ShutdownTimeout, "SHUTDOWN_TIMEOUT")
+
+	str(&cfg.Mongo.URI, "MONGO_URI")
+	str(&cfg.Mongo.Database, "DATABASE_NAME")
+	str(&cfg.Mongo.Collection, "COLLECTION_NAME")
+
+	str(&cfg.Log.Level, "LOG_LEVEL")
+	str(&cfg.Log.Format, "LOG_FORMAT")
+	str(&cfg.Log.File, "LOG_FILE")
+	num(&cfg.Log.MaxSizeMB, "LOG_MAX_SIZE_MB")
+	num(&cfg.Log.MaxAgeDays, "LOG_MAX_AGE_DAYS")
+	num(&cfg.Log.MaxBackups, "LOG_MAX_BACKUPS")
+
+	str(&cfg.Tracing.Exporter, "TRACING_EXPORTER")
+	str(&cfg.Tracing.Endpoint, "TRACING_ENDPOINT")
+	str(&cfg.Tracing.File, "TRACING_FILE")
+	if value := os.Getenv("TRACING_SAMPLE_RATIO"); value != "" {
+		ratio, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("TRACING_SAMPLE_RATIO: %q is not a number", value))
+		} else {
+			cfg.Tracing.SampleRatio = ratio
+		}
+	}
+
+	dur(&cfg.Scrub.Interval, "SCRUB_INTERVAL")
+	dur(&cfg.Scrub.Grace, "SCRUB_GRACE")
+	str(&cfg.Scrub.ReportPath, "SCRUB_REPORT")
+
+	num(&cfg.Ready.MinFreeMB, "READY_MIN_FREE_MB")
+	dur(&cfg.Ready.MongoTimeout, "READY_MONGO_TIMEOUT")
+
+	str(&cfg.Share.StorePath, "SHARE_STORE")
+	dur(&cfg.Share.DefaultTTL, "SHARE_DEFAULT_TTL")
+	dur(&cfg.Share.MaxTTL, "SHARE_MAX_TTL")
+
+	str(&cfg.Paste.StorePath, "PASTE_STORE")
+	num(&cfg.Paste.MaxSizeKB, "PASTE_MAX_SIZE_KB")
+	dur(&cfg.Paste.DefaultTTL, "PASTE_DEFAULT_TTL")
+	dur(&cfg.Paste.MaxTTL, "PASTE_MAX_TTL")
+
+	num(&cfg.Extract.MaxEntries, "EXTRACT_MAX_ENTRIES")
+	num(&cfg.Extract.MaxTotalMB, "EXTRACT_MAX_TOTAL_MB")
+	num(&cfg.Extract.MaxRatio, "EXTRACT_MAX_RATIO")
+
+	if value, ok := os.LookupEnv("IMAGE_WIDTHS"); ok {
+		cfg.Images.Widths = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			width, err := strconv.Atoi(item)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("IMAGE_WIDTHS: %q is not a number", item))
+				continue
+			}
+			cfg.Images.Widths = append(cfg.Images.Widths, width)
+		}
+	}
+	num(&cfg.Images.Quality, "IMAGE_QUALITY")
+	boolean(&cfg.Images.StripMetadata, "IMAGE_STRIP_METADATA")
+	num(&cfg.Images.MaxMegapixels, "IMAGE_MAX_MEGAPIXELS")
+
+	str(&cfg.Webhook.StorePath, "WEBHOOK_STORE")
+	num(&cfg.Webhook.MaxAttempts, "WEBHOOK_MAX_ATTEMPTS")
+	dur(&cfg.Webhook.Timeout, "WEBHOOK_TIMEOUT")
+
+	boolean(&cfg.MDNS.Enabled, "MDNS_ENABLED")
+	str(&cfg.MDNS.Name, "MDNS_NAME")
+
+	str(&cfg.Network.PublicURL, "PUBLIC_URL")
+	list(&cfg.Network.Ignore, "NETWORK_IGNORE")
+	list(&cfg.Network.Prefer, "NETWORK_PREFER")
+
+	num(&cfg.Quota.MaxFileMB, "QUOTA_MAX_FILE_MB")
+	num(&cfg.Quota.MaxTotalMB, "QUOTA_MAX_TOTAL_MB")
+
+	num(&cfg.SFTP.Port, "SFTP_PORT")
+	str(&cfg.SFTP.HostKey, "SFTP_HOST_KEY")
+	num(&cfg.GRPC.Port, "GRPC_PORT")
+	boolean(&cfg.GRPC.Multiplex, "GRPC_MULTIPLEX")
+	num(&cfg.S3.Port, "S3_PORT")
+	str(&cfg.S3.Region, "S3_REGION")
+	dur(&cfg.S3.MultipartTTL, "S3_MULTIPART_TTL")
+	// API_KEYS=access:secret[,access:secret...] replaces the keys from the file
+	if value := os.Getenv("API_KEYS"); value != "" {
+		cfg.APIKeys = nil
+		for _, pair := range strings.Split(value, ",") {
+			access, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok {
+				errs = append(errs, errors.New("API_KEYS: expected access:secret pairs separated by commas"))
+				break
+			}
+			cfg.APIKeys = append(cfg.APIKeys, APIKey{Name: access, AccessKey: access, SecretKey: secret})
+		}
+	}
+	// USERS=name:password[,name:password...] replaces the users from the file
+	if value := os.Getenv("USERS"); value != "" {
+		cfg.Users = nil
+		for _, pair := range strings.Split(value, ",") {
+			name, password, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok {
+				errs = append(errs, errors.New("USERS: expected name:password pairs separated by commas"))
+				break
+			}
+			cfg.Users = append(cfg.Users, User{Name: name, Password: password})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port: %d is not a valid port", c.Server.Port)
+	check(c.Server.UploadDir != "", "server.upload_dir must be set")
+	check(c.Server.WorkDir != "", "server.work_dir must be set")
+	if rel, err := filepath.Rel(c.Server.UploadDir, c.Server.WorkDir); err == nil {
+		check(rel != "." && !filepath.IsLocal(rel), "server.work_dir must not be inside server.upload_dir, which is served")
+	}
+	check(c.Server.CleanupInterval > 0, "server.cleanup_interval must be positive")
+	check(c.Server.TempFileDelay > 0, "server.temp_file_delay must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+
+	check(c.Server.Storage == "gridfs" || c.Server.Storage == "memory", "server.storage: %q must be gridfs or memory", c.Server.Storage)
+
+	if c.Server.Storage == "gridfs" {
+		check(c.Mongo.URI != "", "mongo.uri (MONGO_URI) must be set")
+		check(c.Mongo.Database != "", "mongo.database (DATABASE_NAME) must be set")
+	}
+
+	_, levelErr := parseLevel(c.Log.Level)
+	check(levelErr == nil, "log.level: %v", levelErr)
+	check(c.Log.Format == "json" || c.Log.Format == "text", "log.format: %q must be json or text", c.Log.Format)
+	check(c.Log.File != "", "log.file must be set")
+	check(c.Log.MaxSizeMB >= 0 && c.Log.MaxAgeDays >= 0 && c.Log.MaxBackups >= 0, "log rotation limits must not be negative")
+
+	switch c.Tracing.Exporter {
+	case "none", "otlp", "stdout", "file":
+	default:
+		check(false, "tracing.exporter: %q must be none, otlp, stdout or file", c.Tracing.Exporter)
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+	check(c.Scrub.Interval > 0, "scrub.interval must be positive")
+	check(c.Scrub.Grace >= 0, "scrub.grace must not be negative")
+	check(c.Scrub.ReportPath != "", "scrub.report_path must be set")
+
+	check(c.Ready.MinFreeMB >= 0, "ready.min_free_mb must not be negative")
+	check(c.Ready.MongoTimeout > 0, "ready.mongo_timeout must be positive")
+
+	check(c.Share.StorePath != "", "share.store_path must be set")
+	check(c.Share.DefaultTTL > 0, "share.default_ttl must be positive")
+	check(c.Share.MaxTTL >= c.Share.DefaultTTL, "share.max_ttl must not be shorter than share.default_ttl")
+
+	check(c.Paste.StorePath != "", "paste.store_path must be set")
+	check(c.Paste.MaxSizeKB > 0, "paste.max_size_kb must be positive")
+	check(c.Paste.DefaultTTL > 0, "paste.default_ttl must be positive")
+	check(c.Paste.MaxTTL >= c.Paste.DefaultTTL, "paste.max_ttl must not be shorter than paste.default_ttl")
+
+	check(c.Webhook.StorePath != "", "webhook.store_path must be set")
+	check(c.Webhook.MaxAttempts > 0, "webhook.max_attempts must be positive")
+	check(c.Webhook.Timeout > 0, "webhook.timeout must be positive")
+
+	if c.Network.PublicURL != "" {
+		u, err := url.Parse(c.Network.PublicURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"network.public_url: %q must be an http or https URL", c.Network.PublicURL)
+	}
+	for _, pattern := range slices.Concat(c.Network.Ignore, c.Network.Prefer) {
+		_, err := path.Match(pattern, "")
+		check(err == nil, "network: %q is not a valid interface pattern", pattern)
+	}
+
+	check(c.Extract.MaxEntries >= 0 && c.Extract.MaxTotalMB >= 0 && c.Extract.MaxRatio >= 0, "extract limits must not be negative")
+
+	for _, width := range c.Images.Widths {
+		check(width > 0 && width <= 8192, "images.widths: %d must be between 1 and 8192", width)
+	}
+	check(c.Images.Quality >= 1 && c.Images.Quality <= 100, "images.quality: %d must be between 1 and 100", c.Images.Quality)
+	check(c.Images.MaxMegapixels >= 0, "images.max_megapixels must not be negative")
+
+	check(c.Quota.MaxFileMB >= 0 && c.Quota.MaxTotalMB >= 0, "quota limits must not be negative")
+
+	check(c.S3.Port >= 0 && c.S3.Port < 65536, "s3.port: %d is not a valid port", c.S3.Port)
+	check(c.S3.Port == 0 || c.S3.Port != c.Server.Port, "s3.port must differ from server.port")
+	check(c.S3.MultipartTTL > 0, "s3.multipart_ttl must be positive")
+	check(c.S3.Region != "", "s3.region must be set")
+	check(c.GRPC.Port >= 0 && c.GRPC.Port < 65536, "grpc.port: %d is not a valid port", c.GRPC.Port)
+	check(c.GRPC.Port == 0 || (c.GRPC.Port != c.Server.Port && c.GRPC.Port != c.S3.Port && c.GRPC.Port != c.SFTP.Port),
+		"grpc.port must differ from the other ports")
+	check(c.SFTP.Port >= 0 && c.SFTP.Port < 65536, "sftp.port: %d is not a valid port", c.SFTP.Port)
+	check(c.SFTP.Port == 0 || (c.SFTP.Port != c.Server.Port && c.SFTP.Port != c.S3.Port), "sftp.port must differ from server.port and s3.port")
+	check(c.SFTP.Port == 0 || c.SFTP.HostKey != "", "sftp.host_key must be set")
+	hookNames := make(map[string]bool)
+	for i, hook := range c.Hooks {
+		check(hook.Name != "", "hooks[%d]: name must be set", i)
+		check(!hookNames[hook.Name], "hooks[%d]: name %q is used twice", i, hook.Name)
+		hookNames[hook.Name] = true
+		check(len(hook.Command) > 0 && hook.Command[0] != "", "hooks[%d]: command must be set", i)
+		check(len(hook.Stages) > 0, "hooks[%d]: stages must be set", i)
+		for _, stage := range hook.Stages {
+			check(slices.Contains(hookStages, stage), "hooks[%d]: stage %q must be pre_upload, post_upload or pre_delete", i, stage)
+		}
+		check(hook.Timeout >= 0, "hooks[%d]: timeout must not be negative", i)
+	}
+	accessKeys := make(map[string]bool)
+	for i, key := range c.APIKeys {
+		check(key.AccessKey != "" && key.SecretKey != "", "api_keys[%d]: access_key and secret_key must be set", i)
+		check(!accessKeys[key.AccessKey], "api_keys[%d]: access_key %q is used twice", i, key.AccessKey)
+		accessKeys[key.AccessKey] = true
+	}
+	userNames := make(map[string]bool)
+	for i, user := range c.Users {
+		check(user.Name != "", "users[%d]: name must be set", i)
+		check(!userNames[user.Name], "users[%d]: name %q is used twice", i, user.Name)
+		userNames[user.Name] = true
+		check(user.Password != "" || len(user.AuthorizedKeys) > 0, "users[%d]: password or authorized_keys must be set", i)
+		for _, line := range user.AuthorizedKeys {
+			_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			check(err == nil, "users[%d]: invalid authorized key: %v", i, err)
+		}
+		if user.Namespace != "/" {
+			_, err := cleanName(user.namespace())
+			check(err == nil, "users[%d]: namespace %q is not a valid folder name", i, user.Namespace)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config that is safe to print or log.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.Server.AdminPassword != "" {
+		redacted.Server.AdminPassword = "REDACTED"
+	}
+	redacted.Users = make([]User, len(c.Users))
+	for i, user := range c.Users {
+		if user.Password != "" {
+			user.Password = "REDACTED"
+		}
+		redacted.Users[i] = user
+	}
+	redacted.APIKeys = make([]APIKey, len(c.APIKeys))
+	for i, key := range c.APIKeys {
+		key.SecretKey = "REDACTED"
+		redacted.APIKeys[i] = key
+	}
+	if u, err := url.Parse(redacted.Mongo.URI); err != nil {
+		redacted.Mongo.URI = "REDACTED"
+	} else if u.User != nil {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+		redacted.Mongo.URI = u.String()
+	}
+	return &redacted
+}
+
+// printConfig writes the redacted configuration as YAML.
+func printConfig(w io.Writer, cfg *Config) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+	return encoder.Encode(cfg.Redacted())
+}
+
+// liveConfig is the configuration currently in effect; SIGHUP swaps it.
+var liveConfig atomic.Pointer[Config]
+
+// currentConfig returns the configuration currently in effect.
+func currentConfig() *Config {
+	return liveConfig.Load()
+}
+
+// reloads is closed and replaced every time the configuration is reloaded,
+// so loops can select on it to pick up new intervals immediately.
+var reloads = struct {
+	mutex sync.Mutex
+	ch    chan struct{}
+}{ch: make(chan struct{})}
+
+// configReloaded returns a channel that is closed on the next reload.
+func configReloaded() <-chan struct{} {
+	reloads.mutex.Lock()
+	defer reloads.mutex.Unlock()
+	return reloads.ch
+}
+
+// reloadConfig re-reads the configuration with the original args and swaps in
+// the settings that are safe to change at runtime. Settings that are wired
+// into listeners, files or connections at startup keep their old value and
+// are returned so the caller can report that they need a restart.
+func reloadConfig(args []string) ([]string, error) {
+	next, _, err := loadConfig(args)
+	if err != nil {
+		return nil, err
+	}
+	old := currentConfig()
+
+	var restart []string
+	keep := func(name string, changed bool) {
+		if changed {
+			restart = append(restart, name)
+		}
+	}
+	keep("server.port", next.Server.Port != old.Server.Port)
+	keep("server.upload_dir", next.Server.UploadDir != old.Server.UploadDir)
+	keep("server.work_dir", next.Server.WorkDir != old.Server.WorkDir)
+	keep("server.storage", next.Server.Storage != old.Server.Storage)
+	keep("mongo", next.Mongo != old.Mongo)
+	keep("log.format", next.Log.Format != old.Log.Format)
+	keep("log.file", next.Log.File != old.Log.File ||
+		next.Log.MaxSizeMB != old.Log.MaxSizeMB ||
+		next.Log.MaxAgeDays != old.Log.MaxAgeDays ||
+		next.Log.MaxBackups != old.Log.MaxBackups)
+	keep("tracing", next.Tracing != old.Tracing)
+	keep("scrub.report_path", next.Scrub.ReportPath != old.Scrub.ReportPath)
+	keep("share.store_path", next.Share.StorePath != old.Share.StorePath)
+	keep("paste.store_path", next.Paste.StorePath != old.Paste.StorePath)
+	keep("webhook.store_path", next.Webhook.StorePath != old.Webhook.StorePath)
+	keep("s3.port", next.S3.Port != old.S3.Port)
+	keep("sftp", next.SFTP != old.SFTP)
+	keep("grpc", next.GRPC != old.GRPC)
+	keep("mdns", next.MDNS != old.MDNS)
+
+	next.Server.Port = old.Server.Port
+	next.Server.Storage = old.Server.Storage
+	next.Server.UploadDir = old.Server.UploadDir
+	next.Server.WorkDir = old.Server.WorkDir
+	next.Mongo = old.Mongo
+	level := next.Log.Level
+	next.Log = old.Log
+	next.Log.Level = level
+	next.Tracing = old.Tracing
+	next.Scrub.ReportPath = old.Scrub.ReportPath
+	next.Share.StorePath = old.Share.StorePath
+	next.Paste.StorePath = old.Paste.StorePath
+	next.Webhook.StorePath = old.Webhook.StorePath
+	next.S3.Port = old.S3.Port
+	next.SFTP = old.SFTP
+	next.GRPC = old.GRPC
+	next.MDNS = old.MDNS
+
+	liveConfig.Store(next)
+	applyLogLevel(next.Log.Level)
+
+	reloads.mutex.Lock()
+	close(reloads.ch)
+	reloads.ch = make(chan struct{})
+	reloads.mutex.Unlock()
+
+	return restart, nil
+}
+
+// selfURL is the base URL the server uses to call its own routes.
+func (c *Config) selfURL() string {
+	return "http://localhost:" + strconv.Itoa(c.Server.Port)
+}
+
+// mb converts a megabyte setting into bytes.
+func mb(n int) uint64 {
+	return uint64(n) << 20
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/gin-gonic/gin"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// printBanner tells whoever started the server where to reach it.
+func printBanner(w io.Writer, cfg *Config, logger *slog.Logger) {
+	addresses, err := LocalAddresses(cfg)
+	if err != nil {
+		logger.Warn("Failed to list network addresses", "error", err)
+	}
+	preferred := preferredURL(cfg, addresses)
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "  Tempo is running. Open it at:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "    %s\tlocal\n", fmt.Sprintf("http://localhost:%d/", cfg.Server.Port))
+	var urls []string
+	for _, address := range addresses {
+		if !address.Ignored {
+			fmt.Fprintf(tw, "    %s\t%s\n", address.URL, address.Interface)
+			urls = append(urls, address.URL)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "  Scan the code at %sconnect to open it on a phone.\n\n", preferred)
+	logger.Info("Reachable at", "preferred", preferred, "urls", urls)
+}
+
+// listAddresses answers GET /addresses/:admin with every local address,
+// ignored ones included so the interface rules can be checked.
+func listAddresses(ctx *gin.Context) {
+	cfg := currentConfig()
+	addresses, err := LocalAddresses(cfg)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list network addresses"})
+		return
+	}
+	if addresses == nil {
+		addresses = []LocalAddress{}
+	}
+	ctx.JSON(http.StatusOK, gin.H{"preferred": preferredURL(cfg, addresses), "addresses": addresses})
+}
+
+// registerConnect serves /connect, a page with a QR code of the preferred
+// URL so phones on the LAN can open the upload UI.
+func registerConnect(r *gin.Engine) {
+	r.GET("/connect", func(ctx *gin.Context) {
+		ctx.Redirect(http.StatusFound, "/ui/connect.html")
+	})
+	r.GET("/connect/info", func(ctx *gin.Context) {
+		cfg := currentConfig()
+		addresses, _ := LocalAddresses(cfg)
+		urls := []string{}
+		for _, address := range addresses {
+			if !address.Ignored {
+				urls = append(urls, address.URL)
+			}
+		}
+		ctx.JSON(http.StatusOK, gin.H{"url": preferredURL(cfg, addresses), "urls": urls})
+	})
+	r.GET("/connect/qr.png", func(ctx *gin.Context) {
+		cfg := currentConfig()
+		addresses, _ := LocalAddresses(cfg)
+		target := preferredURL(cfg, addresses)
+		// Only the server's own URLs, so the route cannot be used to make
+		// arbitrary codes
+		if asked := ctx.Query("url"); asked != "" {
+			if !slices.ContainsFunc(addresses, func(a LocalAddress) bool { return a.URL == asked && !a.Ignored }) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "Unknown URL"})
+				return
+			}
+			target = asked
+		}
+		png, err := qrcode.Encode(target, qrcode.Medium, 320)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render QR code"})
+			return
+		}
+		ctx.Header("Cache-Control", "no-store")
+		ctx.Data(http.StatusOK, "image/png", png)
+	})
+}
@@ -0,0 +1,114 @@
+package crates
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Backend is the storage files are kept in. GridFS is the real one; Memory
+// keeps everything in process for tests and experiments.
+type Backend interface {
+	List(ctx context.Context) ([]FileInfo, error)
+	Stat(ctx context.Context, name string) (*FileInfo, error)
+	Upload(ctx context.Context, name string, r io.Reader) (*FileInfo, error)
+	Download(ctx context.Context, name string, w io.Writer) (int64, error)
+	// DownloadRange copies length bytes from offset on; GridFS only fetches
+	// the chunks holding them
+	DownloadRange(ctx context.Context, name string, offset, length int64, w io.Writer) (int64, error)
+	Rename(ctx context.Context, oldName, newName string) error
+	Delete(ctx context.Context, name string) error
+}
+
+// Buckets gives access to several named backends, like the GridFS buckets
+// of one database.
+type Buckets interface {
+	Bucket(name string) Backend
+	Names(ctx context.Context) ([]string, error)
+	Create(ctx context.Context, name string) error
+}
+
+// GridFS is the Backend for one GridFS bucket; an empty Bucket means the
+// one set up with Configure.
+type GridFS struct {
+	Bucket string
+}
+
+func (g GridFS) context(ctx context.Context) context.Context {
+	if g.Bucket == "" {
+		return ctx
+	}
+	return WithBucket(ctx, g.Bucket)
+}
+
+func (g GridFS) List(ctx context.Context) ([]FileInfo, error) { return List(g.context(ctx)) }
+
+func (g GridFS) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	return Stat(g.context(ctx), name)
+}
+
+func (g GridFS) Upload(ctx context.Context, name string, r io.Reader) (*FileInfo, error) {
+	return Upload(g.context(ctx), name, r)
+}
+
+func (g GridFS) Download(ctx context.Context, name string, w io.Writer) (int64, error) {
+	return Download(g.context(ctx), name, w)
+}
+
+func (g GridFS) DownloadRange(ctx context.Context, name string, offset, length int64, w io.Writer) (int64, error) {
+	return DownloadRange(g.context(ctx), name, offset, length, w)
+}
+
+func (g GridFS) Rename(ctx context.Context, oldName, newName string) error {
+	return Rename(g.context(ctx), oldName, newName)
+}
+
+func (g GridFS) Delete(ctx context.Context, name string) error { return Delete(g.context(ctx), name) }
+
+// GridFSBuckets opens the GridFS buckets of the configured database.
+type GridFSBuckets struct{}
+
+func (GridFSBuckets) Bucket(name string) Backend { return GridFS{Bucket: name} }
+
+func (GridFSBuckets) Names(ctx context.Context) ([]string, error) { return ListBuckets(ctx) }
+
+func (GridFSBuckets) Create(ctx context.Context, name string) error { return CreateBucket(ctx, name) }
+
+// MemoryBuckets keeps one Memory backend per bucket name, created on first use.
+type MemoryBuckets struct {
+	mutex   sync.Mutex
+	buckets map[string]*Memory
+}
+
+// NewMemoryBuckets returns an empty set of in-memory buckets.
+func NewMemoryBuckets() *MemoryBuckets {
+	return &MemoryBuckets{buckets: make(map[string]*Memory)}
+}
+
+func (m *MemoryBuckets) Bucket(name string) Backend {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	bucket, ok := m.buckets[name]
+	if !ok {
+		bucket = NewMemory()
+		m.buckets[name] = bucket
+	}
+	return bucket
+}
+
+func (m *MemoryBuckets) Names(ctx context.Context) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	names := make([]string, 0, len(m.buckets))
+	for name := range m.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemoryBuckets) Create(ctx context.Context, name string) error {
+	m.Bucket(name)
+	return nil
+}
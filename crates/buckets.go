@@ -0,0 +1,91 @@
+package crates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type bucketKey struct{}
+
+// WithBucket returns a context whose storage calls use the GridFS bucket
+// name instead of the configured one.
+func WithBucket(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, bucketKey{}, name)
+}
+
+// bucketName returns the bucket chosen with WithBucket, or "" for the
+// configured one.
+func bucketName(ctx context.Context) string {
+	name, _ := ctx.Value(bucketKey{}).(string)
+	return name
+}
+
+// defaultBucket is the bucket used when none is chosen.
+func defaultBucket(settings Settings) string {
+	if settings.Collection != "" {
+		return settings.Collection
+	}
+	return options.DefaultName
+}
+
+// DefaultBucket returns the name of the configured GridFS bucket.
+func DefaultBucket() string {
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+	return defaultBucket(shared.settings)
+}
+
+// ListBuckets returns the names of the GridFS buckets in the database. The
+// configured bucket is always included, even before anything is stored.
+func ListBuckets(ctx context.Context) ([]string, error) {
+	if _, err := openBucket(ctx); err != nil {
+		return nil, err
+	}
+	shared.mutex.Lock()
+	db := shared.client.Database(shared.settings.Database)
+	names := map[string]struct{}{defaultBucket(shared.settings): {}}
+	shared.mutex.Unlock()
+
+	collections, err := db.ListCollectionNames(ctx, bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: `\.files$`}}}})
+	if err != nil {
+		return nil, fmt.Errorf("erro ao listar buckets: %w", err)
+	}
+	for _, collection := range collections {
+		names[strings.TrimSuffix(collection, ".files")] = struct{}{}
+	}
+
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// CreateBucket creates the files collection of the GridFS bucket name, so it
+// is listed before anything is stored in it. Existing buckets are left alone.
+func CreateBucket(ctx context.Context, name string) error {
+	if _, err := openBucket(ctx); err != nil {
+		return err
+	}
+	shared.mutex.Lock()
+	db := shared.client.Database(shared.settings.Database)
+	shared.mutex.Unlock()
+
+	err := db.CreateCollection(ctx, name+".files")
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceExists" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("erro ao criar bucket: %w", err)
+	}
+	return nil
+}
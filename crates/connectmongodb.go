@@ -2,14 +2,24 @@ package crates
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"time"
 )
 
 // connectMongoDB establishes a connection to MongoDB Atlas.
-func connectMongoDB(uri string) (*mongo.Client, context.Context, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func connectMongoDB(ctx context.Context, uri string) (_ *mongo.Client, _ context.Context, err error) {
+	_, span := startSpan(ctx, "storage.connect")
+	defer func(start time.Time) { observe("connect", start, err); endSpan(span, err) }(time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
 	if err != nil {
@@ -17,3 +27,138 @@ func connectMongoDB(uri string) (*mongo.Client, context.Context, error) {
 	}
 	return client, context.Background(), nil // Fresh context for long-lived operations
 }
+
+// Settings locates the GridFS bucket used by every storage call.
+type Settings struct {
+	URI        string
+	Database   string
+	Collection string // Bucket name, GridFS defaults to "fs" when empty
+	LocalDir   string // Where uploads are read from and downloads written to
+}
+
+// shared holds the process-wide MongoDB client and the GridFS buckets opened
+// on it, created on first use and reused by every storage call until
+// Disconnect.
+var shared struct {
+	mutex    sync.Mutex
+	settings Settings
+	client   *mongo.Client
+	buckets  map[string]*gridfs.Bucket
+}
+
+// Configure sets the connection settings used from the next connection on.
+// Without it the settings are read from .env and the environment.
+func Configure(settings Settings) {
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+	shared.settings = settings
+}
+
+// openBucket returns the GridFS bucket selected by ctx (see WithBucket), or
+// the configured one, connecting to MongoDB on first use.
+func openBucket(ctx context.Context) (*gridfs.Bucket, error) {
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	if shared.client == nil {
+		if err := connectShared(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	name := bucketName(ctx)
+	if name == "" {
+		name = defaultBucket(shared.settings)
+	}
+	if bucket, ok := shared.buckets[name]; ok {
+		return bucket, nil
+	}
+
+	bucket, err := gridfs.NewBucket(shared.client.Database(shared.settings.Database),
+		options.GridFSBucket().SetName(name))
+	if err != nil {
+		return nil, fmt.Errorf("erro ao criar bucket do GridFS: %w", err)
+	}
+	shared.buckets[name] = bucket
+	return bucket, nil
+}
+
+// connectShared opens the shared client; the caller holds the mutex.
+func connectShared(ctx context.Context) error {
+	settings := shared.settings
+	if settings.URI == "" {
+		// Not configured by the caller, fall back to .env and the environment
+		godotenv.Load()
+		settings.URI = os.Getenv("MONGO_URI")
+		settings.Database = os.Getenv("DATABASE_NAME")
+		settings.Collection = os.Getenv("COLLECTION_NAME")
+	}
+	if settings.URI == "" {
+		return fmt.Errorf("MONGO_URI não está definida")
+	}
+	if settings.Database == "" {
+		return fmt.Errorf("DATABASE_NAME não está definida")
+	}
+
+	client, _, err := connectMongoDB(ctx, settings.URI)
+	if err != nil {
+		return fmt.Errorf("erro ao conectar ao MongoDB Atlas: %w", err)
+	}
+
+	shared.settings = settings
+	shared.client = client
+	shared.buckets = make(map[string]*gridfs.Bucket)
+	return nil
+}
+
+// Disconnect closes the shared MongoDB client, if one was opened. Storage
+// calls made afterwards reconnect.
+func Disconnect(ctx context.Context) error {
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	if shared.client == nil {
+		return nil
+	}
+	err := shared.client.Disconnect(ctx)
+	shared.client, shared.buckets = nil, nil
+	if err != nil {
+		return fmt.Errorf("erro ao desconectar do MongoDB: %w", err)
+	}
+	logger(ctx).Info("disconnected from MongoDB")
+	return nil
+}
+
+// Ping checks that MongoDB answers within the deadline of ctx.
+func Ping(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "storage.ping")
+	defer func(start time.Time) { observe("ping", start, err); endSpan(span, err) }(time.Now())
+
+	if _, err := openBucket(ctx); err != nil {
+		return err
+	}
+
+	shared.mutex.Lock()
+	client := shared.client
+	shared.mutex.Unlock()
+	if client == nil {
+		return fmt.Errorf("cliente do MongoDB desconectado")
+	}
+
+	if err := client.Ping(ctx, nil); err != nil {
+		return fmt.Errorf("erro ao contatar o MongoDB: %w", err)
+	}
+	return nil
+}
+
+// localPath returns where filename lives on the local disk.
+func localPath(filename string) string {
+	shared.mutex.Lock()
+	dir := shared.settings.LocalDir
+	shared.mutex.Unlock()
+
+	if dir == "" {
+		dir = "./uploads"
+	}
+	return filepath.Join(dir, filename)
+}
@@ -1,23 +1,50 @@
 package crates
 
 import (
+	"context"
 	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// deleteFile deletes a file from GridFS by name.
-func deleteFile(bucket *gridfs.Bucket, filename string) error {
-	fileStream, err := bucket.OpenDownloadStreamByName(filename)
+// Delete removes every revision of name from GridFS.
+func Delete(ctx context.Context, name string) (err error) {
+	ctx, span := startSpan(ctx, "storage.delete", attribute.String("file.name", name))
+	defer func(start time.Time) { observe("delete", start, err); endSpan(span, err) }(time.Now())
+
+	bucket, err := openBucket(ctx)
 	if err != nil {
-		return fmt.Errorf("erro ao abrir o arquivo no GridFS: %w", err)
+		return err
 	}
-	defer fileStream.Close()
 
-	fileID := fileStream.GetFile().ID
-	if err := bucket.Delete(fileID); err != nil {
+	_, findSpan := startSpan(ctx, "storage.find")
+	var files []gridfs.File
+	cursor, err := bucket.FindContext(ctx, bson.D{{Key: "filename", Value: name}})
+	if err == nil {
+		err = cursor.All(ctx, &files)
+	}
+	endSpan(findSpan, err)
+	if err != nil {
+		return fmt.Errorf("erro ao buscar o arquivo no GridFS: %w", err)
+	}
+	if len(files) == 0 {
+		return ErrNotFound
+	}
+
+	_, removeSpan := startSpan(ctx, "storage.remove")
+	for _, file := range files {
+		if err = bucket.DeleteContext(ctx, file.ID); err != nil {
+			break
+		}
+	}
+	endSpan(removeSpan, err)
+	if err != nil {
 		return fmt.Errorf("erro ao excluir arquivo no GridFS: %w", err)
 	}
 
-	fmt.Printf("Arquivo '%s' excluído com sucesso!\n", filename)
+	logger(ctx).Info("file deleted from GridFS", "filename", name)
 	return nil
 }
@@ -1,32 +1,141 @@
 package crates
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // downloadFile downloads a file from GridFS and saves it locally.
-func downloadFile(bucket *gridfs.Bucket, filename, outputPath string) error {
+func downloadFile(ctx context.Context, filename, outputPath string) error {
 	outFile, err := os.Create(outputPath)
 	if err != nil {
 		return fmt.Errorf("erro ao criar arquivo local: %w", err)
 	}
 	defer outFile.Close()
 
-	downloadStream, err := bucket.OpenDownloadStreamByName(filename)
+	written, err := Download(ctx, filename, outFile)
 	if err != nil {
-		return fmt.Errorf("erro ao abrir arquivo no GridFS: %w", err)
+		return err
 	}
-	defer downloadStream.Close()
 
-	if _, err := io.Copy(outFile, downloadStream); err != nil {
-		return fmt.Errorf("erro ao copiar arquivo do GridFS: %w", err)
+	logger(ctx).Info("file downloaded from GridFS", "filename", filename, "path", outputPath, "bytes", written)
+	return nil
+}
+
+// Download copies the latest revision of name from GridFS into w.
+func Download(ctx context.Context, name string, w io.Writer) (written int64, err error) {
+	ctx, span := startSpan(ctx, "storage.download", attribute.String("file.name", name))
+	defer func(start time.Time) { observe("download", start, err); endSpan(span, err) }(time.Now())
+
+	bucket, err := openBucket(ctx)
+	if err != nil {
+		return 0, err
 	}
 
-	fmt.Printf("Arquivo '%s' baixado com sucesso para '%s'!\n", filename, outputPath)
-	return nil
+	// Opening by name runs the files lookup and fetches the first chunk
+	_, openSpan := startSpan(ctx, "storage.open_download_stream")
+	downloadStream, err := bucket.OpenDownloadStreamByName(name)
+	endSpan(openSpan, err)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("erro ao abrir arquivo no GridFS: %w", err)
+	}
+	defer downloadStream.Close()
+
+	_, copySpan := startSpan(ctx, "storage.copy")
+	written, err = io.Copy(w, downloadStream)
+	copySpan.SetAttributes(attribute.Int64("bytes", written))
+	endSpan(copySpan, err)
+	if err != nil {
+		return written, fmt.Errorf("erro ao copiar arquivo do GridFS: %w", err)
+	}
+	return written, nil
 }
 
+// errInvalidRange is returned for ranges starting before the file or with a
+// negative length.
+var errInvalidRange = errors.New("intervalo inválido")
+
+// DownloadRange copies length bytes of the latest revision of name from
+// offset on into w. Only the chunks holding the range are fetched, looked up
+// by their index.
+func DownloadRange(ctx context.Context, name string, offset, length int64, w io.Writer) (written int64, err error) {
+	ctx, span := startSpan(ctx, "storage.download_range", attribute.String("file.name", name),
+		attribute.Int64("range.offset", offset), attribute.Int64("range.length", length))
+	defer func(start time.Time) { observe("download", start, err); endSpan(span, err) }(time.Now())
+
+	if offset < 0 || length < 0 {
+		return 0, fmt.Errorf("%w: %d bytes a partir de %d", errInvalidRange, length, offset)
+	}
+	bucket, err := openBucket(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var file gridfs.File
+	err = bucket.GetFilesCollection().FindOne(ctx, bson.D{{Key: "filename", Value: name}},
+		options.FindOne().SetSort(bson.D{{Key: "uploadDate", Value: -1}})).Decode(&file)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("erro ao buscar arquivo: %w", err)
+	}
+	if offset >= file.Length || length == 0 || file.ChunkSize <= 0 {
+		return 0, nil
+	}
+	length = min(length, file.Length-offset)
+
+	chunkSize := int64(file.ChunkSize)
+	first, last := offset/chunkSize, (offset+length-1)/chunkSize
+	cursor, err := bucket.GetChunksCollection().Find(ctx,
+		bson.D{
+			{Key: "files_id", Value: file.ID},
+			{Key: "n", Value: bson.D{{Key: "$gte", Value: first}, {Key: "$lte", Value: last}}},
+		},
+		options.Find().SetSort(bson.D{{Key: "n", Value: 1}}))
+	if err != nil {
+		return 0, fmt.Errorf("erro ao buscar chunks de '%s': %w", name, err)
+	}
+	defer cursor.Close(ctx)
+
+	skip, next := offset-first*chunkSize, first
+	for cursor.Next(ctx) {
+		var chunk struct {
+			N    int64  `bson:"n"`
+			Data []byte `bson:"data"`
+		}
+		if err := cursor.Decode(&chunk); err != nil {
+			return written, fmt.Errorf("erro ao decodificar chunk: %w", err)
+		}
+		if chunk.N != next {
+			return written, fmt.Errorf("chunk %d de '%s' ausente", next, name)
+		}
+		next++
+		data := chunk.Data[min(skip, int64(len(chunk.Data))):]
+		data = data[:min(int64(len(data)), length-written)]
+		skip = 0
+		n, err := w.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, fmt.Errorf("erro ao copiar arquivo do GridFS: %w", err)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return written, fmt.Errorf("erro ao buscar chunks de '%s': %w", name, err)
+	}
+	if written < length {
+		return written, fmt.Errorf("arquivo '%s' truncado: %d de %d bytes", name, written, length)
+	}
+	return written, nil
+}
@@ -0,0 +1,35 @@
+package crates
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+)
+
+// ErrNotFound is returned when no file with the requested name exists.
+var ErrNotFound = errors.New("arquivo não encontrado no GridFS")
+
+// FileInfo describes a file stored in GridFS.
+type FileInfo struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	SHA256     string    `json:"sha256,omitempty"`
+	MD5        string    `json:"md5,omitempty"`
+	// OriginalSHA256 is set on upload when the server changed the content,
+	// e.g. by stripping image metadata: the SHA-256 of the bytes it received.
+	OriginalSHA256 string `json:"original_sha256,omitempty"`
+}
+
+func fileInfo(file *gridfs.File) FileInfo {
+	return FileInfo{
+		ID:         idString(file.ID),
+		Name:       file.Name,
+		Size:       file.Length,
+		UploadedAt: file.UploadDate,
+		SHA256:     storedSHA256(file.Metadata),
+		MD5:        metadataString(file.Metadata, "md5"),
+	}
+}
@@ -2,40 +2,94 @@ package crates
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/gridfs"
-	"log"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// listFiles lists all files stored in GridFS.
-func listFiles(bucket *gridfs.Bucket) ([]string,error) {
-	cursor, err := bucket.Find(bson.D{})
+// listFiles lists the names of all files stored in GridFS.
+func listFiles(ctx context.Context) ([]string, error) {
+	infos, err := List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(infos))
+	for _, info := range infos {
+		files = append(files, info.Name)
+	}
+	return files, nil
+}
+
+// List returns every file stored in GridFS, sorted by name.
+func List(ctx context.Context) (files []FileInfo, err error) {
+	ctx, span := startSpan(ctx, "storage.find")
+	defer func(start time.Time) {
+		span.SetAttributes(attribute.Int("files", len(files)))
+		observe("list", start, err)
+		endSpan(span, err)
+	}(time.Now())
+
+	bucket, err := openBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	findOptions := options.GridFSFind().SetSort(bson.D{{Key: "filename", Value: 1}, {Key: "uploadDate", Value: 1}})
+	cursor, err := bucket.FindContext(ctx, bson.D{}, findOptions)
 	if err != nil {
-		return nil,fmt.Errorf("erro ao buscar arquivos: %w", err)
+		return nil, fmt.Errorf("erro ao buscar arquivos: %w", err)
 	}
-	defer cursor.Close(context.Background())
+	defer cursor.Close(ctx)
 
-	var files []string // Slice para armazenar os nomes dos arquivos
-	found := false
-	for cursor.Next(context.Background()) {
-		found = true
+	files = []FileInfo{}
+	for cursor.Next(ctx) {
 		var file gridfs.File
 		if err := cursor.Decode(&file); err != nil {
-			return nil,fmt.Errorf("erro ao decodificar arquivo: %w", err)
+			return nil, fmt.Errorf("erro ao decodificar arquivo: %w", err)
 		}
-		files = append(files, file.Name) // Adiciona o nome do arquivo ao slice
-	}
-
-	if !found {
-		fmt.Println("Nenhum arquivo encontrado no GridFS.")
+		// Sorted by upload date, so a newer revision replaces the older one
+		if n := len(files); n > 0 && files[n-1].Name == file.Name {
+			files[n-1] = fileInfo(&file)
+			continue
+		}
+		files = append(files, fileInfo(&file))
 	}
 
 	if err := cursor.Err(); err != nil {
-		log.Printf("Tipo do erro: %T, Mensagem: %v", err, err)
-		return nil,fmt.Errorf("erro ao buscar arquivos: %w", err)
+		logger(ctx).Error("cursor error while listing files", "error", err, "type", fmt.Sprintf("%T", err))
+		return nil, fmt.Errorf("erro ao buscar arquivos: %w", err)
 	}
 
-	return files,nil // Retorna o slice com os nomes dos arquivos
+	logger(ctx).Debug("listed GridFS files", "count", len(files))
+	return files, nil
 }
 
+// Stat returns the latest revision of name.
+func Stat(ctx context.Context, name string) (info *FileInfo, err error) {
+	ctx, span := startSpan(ctx, "storage.find", attribute.String("file.name", name))
+	defer func(start time.Time) { observe("stat", start, err); endSpan(span, err) }(time.Now())
+
+	bucket, err := openBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var file gridfs.File
+	err = bucket.GetFilesCollection().FindOne(ctx, bson.D{{Key: "filename", Value: name}},
+		options.FindOne().SetSort(bson.D{{Key: "uploadDate", Value: -1}})).Decode(&file)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("erro ao buscar arquivo: %w", err)
+	}
+
+	found := fileInfo(&file)
+	return &found, nil
+}
@@ -0,0 +1,29 @@
+package crates
+
+import (
+	"context"
+	"log/slog"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the request ID so storage calls
+// made on behalf of an HTTP request can be correlated with it in the logs.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID stored in ctx, or "" if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logger returns the default logger annotated with the request ID from ctx.
+func logger(ctx context.Context) *slog.Logger {
+	l := slog.Default().With("component", "storage")
+	if id := RequestID(ctx); id != "" {
+		l = l.With("request_id", id)
+	}
+	return l
+}
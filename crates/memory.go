@@ -0,0 +1,131 @@
+package crates
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Memory is a Backend that keeps files in memory.
+type Memory struct {
+	mutex  sync.RWMutex
+	files  map[string]*memoryFile
+	nextID int
+}
+
+type memoryFile struct {
+	info FileInfo
+	data []byte
+}
+
+// NewMemory returns an empty in-memory backend.
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string]*memoryFile)}
+}
+
+func (m *Memory) List(ctx context.Context) ([]FileInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	files := make([]FileInfo, 0, len(m.files))
+	for _, file := range m.files {
+		files = append(files, file.info)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (m *Memory) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	file, ok := m.files[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	info := file.info
+	return &info, nil
+}
+
+func (m *Memory) Upload(ctx context.Context, name string, r io.Reader) (*FileInfo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sum, md5Sum := sha256.Sum256(data), md5.Sum(data)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.nextID++
+	file := &memoryFile{
+		info: FileInfo{
+			ID:         strconv.Itoa(m.nextID),
+			Name:       name,
+			Size:       int64(len(data)),
+			UploadedAt: time.Now().UTC(),
+			SHA256:     hex.EncodeToString(sum[:]),
+			MD5:        hex.EncodeToString(md5Sum[:]),
+		},
+		data: data,
+	}
+	m.files[name] = file
+	info := file.info
+	return &info, nil
+}
+
+func (m *Memory) Download(ctx context.Context, name string, w io.Writer) (int64, error) {
+	m.mutex.RLock()
+	file, ok := m.files[name]
+	m.mutex.RUnlock()
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return io.Copy(w, bytes.NewReader(file.data)) // data is never modified in place
+}
+
+func (m *Memory) DownloadRange(ctx context.Context, name string, offset, length int64, w io.Writer) (int64, error) {
+	if offset < 0 || length < 0 {
+		return 0, fmt.Errorf("%w: %d bytes a partir de %d", errInvalidRange, length, offset)
+	}
+	m.mutex.RLock()
+	file, ok := m.files[name]
+	m.mutex.RUnlock()
+	if !ok {
+		return 0, ErrNotFound
+	}
+	data := file.data[min(offset, int64(len(file.data))):]
+	return io.Copy(w, bytes.NewReader(data[:min(length, int64(len(data)))]))
+}
+
+func (m *Memory) Rename(ctx context.Context, oldName, newName string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	file, ok := m.files[oldName]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(m.files, oldName)
+	file.info.Name = newName
+	m.files[newName] = file
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.files[name]; !ok {
+		return ErrNotFound
+	}
+	delete(m.files, name)
+	return nil
+}
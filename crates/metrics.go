@@ -0,0 +1,29 @@
+package crates
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tempo_storage_operation_duration_seconds",
+		Help:    "Latency of GridFS operations, including connection setup.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12), // 10ms .. ~20s
+	}, []string{"operation"})
+
+	storageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tempo_storage_operation_errors_total",
+		Help: "GridFS operations that returned an error.",
+	}, []string{"operation"})
+)
+
+// observe records the latency and outcome of a storage operation started at start.
+func observe(operation string, start time.Time, err error) {
+	storageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		storageErrors.WithLabelValues(operation).Inc()
+	}
+}
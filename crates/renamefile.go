@@ -0,0 +1,50 @@
+package crates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Rename gives the latest revision of oldName the name newName, replacing
+// any file already stored as newName.
+func Rename(ctx context.Context, oldName, newName string) (err error) {
+	ctx, span := startSpan(ctx, "storage.rename",
+		attribute.String("file.name", oldName), attribute.String("file.new_name", newName))
+	defer func(start time.Time) { observe("rename", start, err); endSpan(span, err) }(time.Now())
+
+	bucket, err := openBucket(ctx)
+	if err != nil {
+		return err
+	}
+
+	var file gridfs.File
+	err = bucket.GetFilesCollection().FindOne(ctx, bson.D{{Key: "filename", Value: oldName}},
+		options.FindOne().SetSort(bson.D{{Key: "uploadDate", Value: -1}})).Decode(&file)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("erro ao buscar arquivo: %w", err)
+	}
+
+	if err := bucket.RenameContext(ctx, file.ID, newName); err != nil {
+		return fmt.Errorf("erro ao renomear arquivo no GridFS: %w", err)
+	}
+	// Whatever was stored under the new name is replaced, like a file system rename
+	if err := removeRevisions(ctx, bucket, newName, file.ID); err != nil {
+		return err
+	}
+	if err := removeRevisions(ctx, bucket, oldName, file.ID); err != nil {
+		return err
+	}
+
+	logger(ctx).Info("file renamed in GridFS", "filename", oldName, "new_name", newName)
+	return nil
+}
@@ -0,0 +1,218 @@
+package crates
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+)
+
+// ScrubIssue describes a problem found with a single GridFS file.
+type ScrubIssue struct {
+	Bucket   string `json:"bucket"`
+	FileID   string `json:"file_id"`
+	Filename string `json:"filename"`
+	Problem  string `json:"problem"`
+}
+
+// ScrubReport is the result of a full pass over every GridFS bucket.
+type ScrubReport struct {
+	StartedAt      time.Time    `json:"started_at"`
+	FinishedAt     time.Time    `json:"finished_at"`
+	Buckets        []string     `json:"buckets"`
+	FilesChecked   int          `json:"files_checked"`
+	FilesVerified  int          `json:"files_verified"` // Files whose SHA-256 was recomputed
+	FilesUnhashed  int          `json:"files_unhashed"` // Files uploaded before hashes were stored
+	Issues         []ScrubIssue `json:"issues"`
+	OrphanFileIDs  []string     `json:"orphan_file_ids"` // As bucket/id
+	OrphanChunks   int64        `json:"orphan_chunks_removed"`
+	OrphansSkipped int          `json:"orphans_skipped"` // Too recent, may still be uploading
+	Error          string       `json:"error,omitempty"`
+}
+
+// Scrub walks every GridFS bucket, checks every file's chunk count and
+// stored SHA-256 against the chunks on disk, and removes chunks that have no
+// files document. Orphans younger than grace are left alone because they may
+// belong to an upload that is still in progress.
+func Scrub(ctx context.Context, grace time.Duration) (_ *ScrubReport, err error) {
+	report := &ScrubReport{StartedAt: time.Now(), Buckets: []string{}, Issues: []ScrubIssue{}, OrphanFileIDs: []string{}}
+
+	ctx, span := startSpan(ctx, "storage.scrub")
+	defer func() { endSpan(span, err) }()
+
+	names, err := ListBuckets(ctx)
+	if err != nil {
+		return finishScrub(report, err)
+	}
+	for _, name := range names {
+		bucketCtx := WithBucket(ctx, name)
+		bucket, err := openBucket(bucketCtx)
+		if err != nil {
+			return finishScrub(report, err)
+		}
+
+		known, err := verifyFiles(bucketCtx, bucket, name, report)
+		if err != nil {
+			return finishScrub(report, err)
+		}
+
+		if err := removeOrphans(bucketCtx, bucket, name, known, grace, report); err != nil {
+			return finishScrub(report, err)
+		}
+		report.Buckets = append(report.Buckets, name)
+	}
+
+	return finishScrub(report, nil)
+}
+
+func finishScrub(report *ScrubReport, err error) (*ScrubReport, error) {
+	report.FinishedAt = time.Now()
+	observe("scrub", report.StartedAt, err)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report, err
+}
+
+// verifyFiles checks every files document and returns the set of known file IDs.
+func verifyFiles(ctx context.Context, bucket *gridfs.Bucket, name string, report *ScrubReport) (map[interface{}]struct{}, error) {
+	cursor, err := bucket.FindContext(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("erro ao buscar arquivos: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	known := make(map[interface{}]struct{})
+	chunks := bucket.GetChunksCollection()
+
+	for cursor.Next(ctx) {
+		var file gridfs.File
+		if err := cursor.Decode(&file); err != nil {
+			return nil, fmt.Errorf("erro ao decodificar arquivo: %w", err)
+		}
+		known[file.ID] = struct{}{}
+		report.FilesChecked++
+
+		issue := func(problem string) {
+			logger(ctx).Warn("scrub found a damaged file", "bucket", name, "filename", file.Name, "file_id", idString(file.ID), "problem", problem)
+			report.Issues = append(report.Issues, ScrubIssue{
+				Bucket:   name,
+				FileID:   idString(file.ID),
+				Filename: file.Name,
+				Problem:  problem,
+			})
+		}
+
+		// Every file of length L split in chunks of size C must have ceil(L/C) chunks
+		var expected int64
+		if file.ChunkSize > 0 {
+			expected = (file.Length + int64(file.ChunkSize) - 1) / int64(file.ChunkSize)
+		}
+		count, err := chunks.CountDocuments(ctx, bson.D{{Key: "files_id", Value: file.ID}})
+		if err != nil {
+			return nil, fmt.Errorf("erro ao contar chunks de '%s': %w", file.Name, err)
+		}
+		if count != expected {
+			issue(fmt.Sprintf("expected %d chunks, found %d", expected, count))
+			continue
+		}
+
+		stored := storedSHA256(file.Metadata)
+		if stored == "" {
+			report.FilesUnhashed++
+			continue
+		}
+
+		actual, err := hashFile(bucket, file.ID)
+		if err != nil {
+			issue(fmt.Sprintf("failed to read chunks: %v", err))
+			continue
+		}
+		report.FilesVerified++
+		if actual != stored {
+			issue(fmt.Sprintf("sha256 mismatch: stored %s, computed %s", stored, actual))
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao buscar arquivos: %w", err)
+	}
+	return known, nil
+}
+
+// removeOrphans deletes chunks whose files_id has no matching files document.
+func removeOrphans(ctx context.Context, bucket *gridfs.Bucket, name string, known map[interface{}]struct{}, grace time.Duration, report *ScrubReport) error {
+	chunks := bucket.GetChunksCollection()
+
+	ids, err := chunks.Distinct(ctx, "files_id", bson.D{})
+	if err != nil {
+		return fmt.Errorf("erro ao listar chunks: %w", err)
+	}
+
+	cutoff := time.Now().Add(-grace)
+	for _, id := range ids {
+		if _, ok := known[id]; ok {
+			continue
+		}
+		// Driver generated IDs carry their creation time; anything newer than
+		// the grace period could be an upload whose files document is not
+		// written yet
+		if oid, ok := id.(primitive.ObjectID); ok && oid.Timestamp().After(cutoff) {
+			report.OrphansSkipped++
+			continue
+		}
+
+		res, err := chunks.DeleteMany(ctx, bson.D{{Key: "files_id", Value: id}})
+		if err != nil {
+			return fmt.Errorf("erro ao remover chunks órfãos de %s: %w", idString(id), err)
+		}
+		logger(ctx).Info("removed orphan chunks", "bucket", name, "file_id", idString(id), "chunks", res.DeletedCount)
+		report.OrphanFileIDs = append(report.OrphanFileIDs, name+"/"+idString(id))
+		report.OrphanChunks += res.DeletedCount
+	}
+	return nil
+}
+
+func hashFile(bucket *gridfs.Bucket, id interface{}) (string, error) {
+	stream, err := bucket.OpenDownloadStream(id)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, stream); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func storedSHA256(metadata bson.Raw) string {
+	return metadataString(metadata, "sha256")
+}
+
+// metadataString returns a string field of a GridFS files document's
+// metadata, or "" when it is missing.
+func metadataString(metadata bson.Raw, key string) string {
+	if len(metadata) == 0 {
+		return ""
+	}
+	value, err := metadata.LookupErr(key)
+	if err != nil {
+		return ""
+	}
+	hash, _ := value.StringValueOK()
+	return hash
+}
+
+func idString(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprint(id)
+}
@@ -1,17 +1,18 @@
 package crates
 
 import (
+	"context"
 	"log"
-	"os"
-
-	"github.com/joho/godotenv"
-
-	"go.mongodb.org/mongo-driver/mongo/gridfs"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // Grider handles the command-line interface for GridFS operations.
 func Grider(args ...string) []string {
+	return GriderContext(context.Background(), args...)
+}
+
+// GriderContext is like Grider but carries ctx (and its request ID) into the
+// storage calls.
+func GriderContext(ctx context.Context, args ...string) []string {
 	if len(args) == 0 {
 		log.Fatalf("Uso: go run . <comando> [filename]\nComandos: up, down, list, delete")
 	}
@@ -29,49 +30,25 @@ func Grider(args ...string) []string {
 		}
 	}
 
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Erro ao carregar o arquivo .env")
-	}
-
-	mongoURI := os.Getenv("MONGO_URI")
-	if mongoURI == "" {
-		log.Fatal("MONGO_URI não está definida no arquivo .env")
-	}
-	databaseName := os.Getenv("DATABASE_NAME")
-	if databaseName == "" {
-		log.Fatal("DATABASE_NAME não está definida no arquivo .env")
-	}
-	collection := os.Getenv("COLLECTION_NAME")
-
-	client, ctx, err := connectMongoDB(mongoURI)
-	if err != nil {
-		log.Fatalf("Erro ao conectar ao MongoDB Atlas: %v", err)
-	}
-	defer client.Disconnect(ctx)
-
-	bucketOptions := options.GridFSBucket().SetName(collection)
-	bucket, err := gridfs.NewBucket(client.Database(databaseName), bucketOptions)
-	if err != nil {
-		log.Fatalf("Erro ao criar bucket do GridFS: %v", err)
-	}
-
 	switch command {
 	case "up":
-		if err := uploadFile(bucket, fileName); err != nil {
+		if err := uploadFile(ctx, fileName); err != nil {
 			log.Fatalf("Erro ao enviar arquivo: %v", err)
 		}
 	case "down":
-		outputPath := "./uploads/"+fileName 
-		if err := downloadFile(bucket, fileName, outputPath); err != nil {
+		outputPath := localPath(fileName)
+		if err := downloadFile(ctx, fileName, outputPath); err != nil {
 			log.Fatalf("Erro ao baixar arquivo: %v", err)
 		}
 	case "list":
-		if w,err := listFiles(bucket); err != nil {
+		if w, err := listFiles(ctx); err != nil {
 			log.Fatalf("Erro ao listar arquivos: %v", err)
-		}else{return w}
+		} else {
+			return w
+		}
 
 	case "delete":
-		if err := deleteFile(bucket, fileName); err != nil {
+		if err := Delete(ctx, fileName); err != nil {
 			log.Fatalf("Erro ao deletar arquivo: %v", err)
 		}
 	default:
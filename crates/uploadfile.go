@@ -1,18 +1,25 @@
 package crates
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// uploadFile uploads a file to GridFS.
-func uploadFile(bucket *gridfs.Bucket, filename string) error {
+// uploadFile uploads a file from the local upload directory to GridFS.
+func uploadFile(ctx context.Context, filename string) error {
 	// Check if the file exists
 
-	filepath := "./uploads/" + filename
+	filepath := localPath(filename)
 
 	if _, err := os.Stat(filepath); os.IsNotExist(err) {
 		return fmt.Errorf("arquivo '%s' não existe", filename)
@@ -24,17 +31,88 @@ func uploadFile(bucket *gridfs.Bucket, filename string) error {
 	}
 	defer file.Close()
 
-	uploadStream, err := bucket.OpenUploadStream(filename)
+	_, err = Upload(ctx, filename, file)
+	return err
+}
+
+// Upload streams r into GridFS as name. The SHA-256 of the content is stored
+// in the file's metadata so the scrubber can verify it later, next to the MD5
+// that S3 clients expect as ETag. Older revisions
+// of name are removed once the new one is complete.
+func Upload(ctx context.Context, name string, r io.Reader) (_ *FileInfo, err error) {
+	ctx, span := startSpan(ctx, "storage.upload", attribute.String("file.name", name))
+	defer func(start time.Time) { observe("upload", start, err); endSpan(span, err) }(time.Now())
+
+	bucket, err := openBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, openSpan := startSpan(ctx, "storage.open_upload_stream")
+	uploadStream, err := bucket.OpenUploadStream(name)
+	endSpan(openSpan, err)
 	if err != nil {
-		return fmt.Errorf("erro ao abrir stream de upload: %w", err)
+		return nil, fmt.Errorf("erro ao abrir stream de upload: %w", err)
+	}
+
+	hasher, md5Hasher := sha256.New(), md5.New()
+	_, copySpan := startSpan(ctx, "storage.copy")
+	written, err := io.Copy(uploadStream, io.TeeReader(r, io.MultiWriter(hasher, md5Hasher)))
+	copySpan.SetAttributes(attribute.Int64("bytes", written))
+	endSpan(copySpan, err)
+	if err != nil {
+		uploadStream.Abort() // Drop the chunks written so far instead of leaving orphans
+		return nil, fmt.Errorf("erro ao copiar arquivo para o GridFS: %w", err)
+	}
+	if err := uploadStream.Close(); err != nil {
+		return nil, fmt.Errorf("erro ao finalizar upload: %w", err)
 	}
-	defer uploadStream.Close()
 
-	_, err = io.Copy(uploadStream, file)
+	// The digest is only known once the stream is consumed, so it is added to
+	// the files document after the fact
+	sum, md5Sum := hex.EncodeToString(hasher.Sum(nil)), hex.EncodeToString(md5Hasher.Sum(nil))
+	_, err = bucket.GetFilesCollection().UpdateByID(ctx, uploadStream.FileID,
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "metadata.sha256", Value: sum},
+			{Key: "metadata.md5", Value: md5Sum},
+		}}})
 	if err != nil {
-		return fmt.Errorf("erro ao copiar arquivo para o GridFS: %w", err)
+		return nil, fmt.Errorf("erro ao gravar o SHA-256: %w", err)
 	}
 
-	fmt.Printf("Arquivo '%s' enviado com sucesso para o GridFS!\n", filename)
+	if err := removeRevisions(ctx, bucket, name, uploadStream.FileID); err != nil {
+		return nil, err
+	}
+
+	logger(ctx).Info("file uploaded to GridFS", "filename", name, "bytes", written)
+	return &FileInfo{
+		ID:         idString(uploadStream.FileID),
+		Name:       name,
+		Size:       written,
+		UploadedAt: time.Now().UTC(),
+		SHA256:     sum,
+		MD5:        md5Sum,
+	}, nil
+}
+
+// removeRevisions deletes every revision of name except keep.
+func removeRevisions(ctx context.Context, bucket *gridfs.Bucket, name string, keep interface{}) error {
+	cursor, err := bucket.FindContext(ctx, bson.D{
+		{Key: "filename", Value: name},
+		{Key: "_id", Value: bson.D{{Key: "$ne", Value: keep}}},
+	})
+	if err != nil {
+		return fmt.Errorf("erro ao buscar revisões antigas: %w", err)
+	}
+
+	var old []gridfs.File
+	if err := cursor.All(ctx, &old); err != nil {
+		return fmt.Errorf("erro ao buscar revisões antigas: %w", err)
+	}
+	for _, file := range old {
+		if err := bucket.DeleteContext(ctx, file.ID); err != nil {
+			return fmt.Errorf("erro ao remover revisão antiga: %w", err)
+		}
+	}
 	return nil
 }
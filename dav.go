@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/webdav"
+)
+
+// davMethods are the methods routed to the WebDAV handler.
+var davMethods = []string{
+	http.MethodOptions, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete,
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// newDavHandler serves files over WebDAV below prefix. It only depends on
+// the backend, so it can be exercised against crates.NewMemory().
+func newDavHandler(prefix string, files *davFS, logger *slog.Logger) *webdav.Handler {
+	return &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: files,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				logger.Debug("WebDAV request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+			}
+		},
+	}
+}
+
+// davAuth accepts the admin password with HTTP Basic auth, which is what
+// file managers and office tools send, or as a Bearer token.
+func davAuth(ctx *gin.Context) {
+	_, password, ok := ctx.Request.BasicAuth()
+	if !ok {
+		password, ok = strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	}
+	if !ok || !checkAdminPassword(password) {
+		ctx.Header("WWW-Authenticate", `Basic realm="tempo"`)
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	ctx.Request = ctx.Request.WithContext(withUploader(ctx.Request.Context(), "admin"))
+	ctx.Next()
+}
+
+// registerDAV mounts the WebDAV endpoint at /dav/.
+func (a *App) registerDAV(r *gin.Engine) {
+	files := newDavFS(a.store)
+	files.app = a
+	handler := newDavHandler("/dav", files, a.logger)
+
+	// Refuse uploads over quota before the body is read; the handler itself
+	// could only answer 405 once the upload is done
+	checkPut := func(ctx *gin.Context) {
+		if ctx.Request.Method == http.MethodPut && ctx.Request.ContentLength > 0 {
+			name := davName(strings.TrimPrefix(ctx.Request.URL.Path, "/dav"))
+			err := checkQuota(ctx.Request.Context(), a.store, name, ctx.Request.ContentLength)
+			if errors.Is(err, errQuotaExceeded) {
+				ctx.AbortWithStatusJSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		ctx.Next()
+	}
+
+	dav := r.Group("/dav", davAuth, checkPut)
+	for _, method := range davMethods {
+		dav.Handle(method, "/*path", gin.WrapH(handler))
+	}
+}
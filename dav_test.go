@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"tempo/crates"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useConfig makes the defaults, changed by change, the live configuration
+// for the rest of the test.
+func useConfig(t *testing.T, change func(cfg *Config)) {
+	t.Helper()
+	previous := currentConfig()
+	cfg := defaultConfig()
+	if change != nil {
+		change(cfg)
+	}
+	liveConfig.Store(cfg)
+	t.Cleanup(func() { liveConfig.Store(previous) })
+}
+
+// newTestApp returns an App over a fresh in-memory backend, with its upload
+// directory in a temporary one.
+func newTestApp(t *testing.T) (*App, *crates.Memory) {
+	t.Helper()
+	dir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	shares, err := NewShareStore(filepath.Join(dir, "shares.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := crates.NewMemory()
+	app := &App{
+		logger:    logger,
+		uploadDir: filepath.Join(dir, "uploads"),
+		queue:     NewQueue(),
+		shares:    shares,
+		hooks:     NewHooks(dir, logger),
+		store:     store,
+		events:    NewEvents(),
+		ctx:       context.Background(),
+	}
+	return app, store
+}
+
+// newDavServer serves /dav/ over a fresh in-memory backend, next to the
+// /up and /down/ routes sharing its upload directory.
+func newDavServer(t *testing.T) (*httptest.Server, *crates.Memory) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	app, store := newTestApp(t)
+	r := gin.New()
+	app.registerDAV(r)
+	r.POST("/up", app.uploadToDatabase)
+	r.GET("/down/:filename", func(ctx *gin.Context) { app.ServeFile(ctx, ctx.Param("filename")) })
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server, store
+}
+
+// davDo sends a WebDAV request with the admin password and returns the
+// status and body.
+func davDo(t *testing.T, server *httptest.Server, method, path string, body io.Reader, header map[string]string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("me", "secret")
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestDAVAuth(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.Server.AdminPassword = "secret" })
+	server, _ := newDavServer(t)
+
+	for _, tc := range []struct {
+		name   string
+		auth   func(req *http.Request)
+		status int
+	}{
+		{"none", func(req *http.Request) {}, http.StatusUnauthorized},
+		{"wrong password", func(req *http.Request) { req.SetBasicAuth("me", "guess") }, http.StatusUnauthorized},
+		{"wrong bearer", func(req *http.Request) { req.Header.Set("Authorization", "Bearer guess") }, http.StatusUnauthorized},
+		{"basic", func(req *http.Request) { req.SetBasicAuth("anyone", "secret") }, http.StatusMultiStatus},
+		{"bearer", func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret") }, http.StatusMultiStatus},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("PROPFIND", server.URL+"/dav/", nil)
+			req.Header.Set("Depth", "1")
+			tc.auth(req)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tc.status)
+			}
+			if tc.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestDAVAuthWithoutAdminPassword(t *testing.T) {
+	useConfig(t, nil)
+	server, _ := newDavServer(t)
+
+	if status, _ := davDo(t, server, "PROPFIND", "/dav/", nil, map[string]string{"Depth": "1"}); status != http.StatusUnauthorized {
+		t.Fatalf("status %d without a configured password, want 401", status)
+	}
+}
+
+func TestDAVFiles(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.Server.AdminPassword = "secret" })
+	server, store := newDavServer(t)
+
+	// Like file managers, make the folder before putting a file in it
+	if status, _ := davDo(t, server, "MKCOL", "/dav/docs", nil, nil); status != http.StatusCreated {
+		t.Fatalf("MKCOL: status %d, want 201", status)
+	}
+	if status, _ := davDo(t, server, http.MethodPut, "/dav/docs/a.txt", strings.NewReader("hello"), nil); status != http.StatusCreated {
+		t.Fatalf("PUT: status %d, want 201", status)
+	}
+	if status, body := davDo(t, server, http.MethodGet, "/dav/docs/a.txt", nil, nil); status != http.StatusOK || body != "hello" {
+		t.Fatalf("GET: status %d body %q", status, body)
+	}
+	if _, err := store.Stat(context.Background(), "docs/a.txt"); err != nil {
+		t.Fatalf("PUT did not store docs/a.txt: %v", err)
+	}
+
+	status, body := davDo(t, server, "PROPFIND", "/dav/docs/", nil, map[string]string{"Depth": "1"})
+	if status != http.StatusMultiStatus || !strings.Contains(body, "/dav/docs/a.txt") {
+		t.Fatalf("PROPFIND: status %d, body %s", status, body)
+	}
+
+	if status, _ := davDo(t, server, "MKCOL", "/dav/empty", nil, nil); status != http.StatusCreated {
+		t.Fatalf("MKCOL: status %d, want 201", status)
+	}
+	if status, body := davDo(t, server, "PROPFIND", "/dav/", nil, map[string]string{"Depth": "1"}); !strings.Contains(body, "/dav/empty/") {
+		t.Fatalf("PROPFIND after MKCOL: status %d, body %s", status, body)
+	}
+
+	status, _ = davDo(t, server, "MOVE", "/dav/docs/a.txt", nil, map[string]string{"Destination": server.URL + "/dav/docs/b.txt"})
+	if status != http.StatusCreated {
+		t.Fatalf("MOVE: status %d, want 201", status)
+	}
+	if status, _ := davDo(t, server, http.MethodGet, "/dav/docs/a.txt", nil, nil); status != http.StatusNotFound {
+		t.Fatalf("GET after MOVE: status %d for the old name, want 404", status)
+	}
+	if status, body := davDo(t, server, http.MethodGet, "/dav/docs/b.txt", nil, nil); status != http.StatusOK || body != "hello" {
+		t.Fatalf("GET after MOVE: status %d body %q", status, body)
+	}
+
+	if status, _ := davDo(t, server, http.MethodDelete, "/dav/docs/b.txt", nil, nil); status != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d, want 204", status)
+	}
+	if _, err := store.Stat(context.Background(), "docs/b.txt"); err == nil {
+		t.Fatal("DELETE left docs/b.txt stored")
+	}
+}
+
+func TestDAVQuota(t *testing.T) {
+	useConfig(t, func(cfg *Config) {
+		cfg.Server.AdminPassword = "secret"
+		cfg.Quota.MaxTotalMB = 1
+	})
+	server, store := newDavServer(t)
+	large := bytes.Repeat([]byte("x"), 2<<20)
+
+	// With a Content-Length the upload is refused before the body is read
+	if status, _ := davDo(t, server, http.MethodPut, "/dav/big.bin", bytes.NewReader(large), nil); status != http.StatusInsufficientStorage {
+		t.Fatalf("PUT with length: status %d, want 507", status)
+	}
+
+	// Chunked uploads are only measured once written, in davWriter.Close
+	status, _ := davDo(t, server, http.MethodPut, "/dav/big.bin", io.MultiReader(bytes.NewReader(large)), nil)
+	if status < 400 {
+		t.Fatalf("chunked PUT over quota: status %d, want an error", status)
+	}
+	if _, err := store.Stat(context.Background(), "big.bin"); err == nil {
+		t.Fatal("upload over quota was stored")
+	}
+
+	if status, _ := davDo(t, server, http.MethodPut, "/dav/small.txt", strings.NewReader("fits"), nil); status != http.StatusCreated {
+		t.Fatalf("PUT under quota: status %d, want 201", status)
+	}
+}
+
+// upload stores content as name through POST /up, which keeps a copy in the
+// upload directory.
+func upload(t *testing.T, server *httptest.Server, name, content string) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", name)
+	io.WriteString(part, content)
+	form.Close()
+	resp, err := http.Post(server.URL+"/up", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /up: status %d", resp.StatusCode)
+	}
+}
+
+// download fetches name through GET /down/.
+func download(t *testing.T, server *httptest.Server, name string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/down/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestDAVChangesUploadedCopy(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.Server.AdminPassword = "secret" })
+	server, _ := newDavServer(t)
+
+	upload(t, server, "a.txt", "old")
+	if status, body := download(t, server, "a.txt"); status != http.StatusOK || body != "old" {
+		t.Fatalf("GET /down/ after upload: status %d body %q", status, body)
+	}
+	if status, _ := davDo(t, server, http.MethodPut, "/dav/a.txt", strings.NewReader("new"), nil); status != http.StatusNoContent && status != http.StatusCreated {
+		t.Fatalf("PUT: status %d", status)
+	}
+	if status, body := download(t, server, "a.txt"); status != http.StatusOK || body != "new" {
+		t.Fatalf("GET /down/ after overwrite: status %d body %q, want the new content", status, body)
+	}
+
+	upload(t, server, "b.txt", "moved")
+	status, _ := davDo(t, server, "MOVE", "/dav/b.txt", nil, map[string]string{"Destination": server.URL + "/dav/c.txt"})
+	if status != http.StatusCreated {
+		t.Fatalf("MOVE: status %d", status)
+	}
+	if status, _ := download(t, server, "b.txt"); status != http.StatusNotFound {
+		t.Fatalf("GET /down/ after MOVE: status %d for the old name, want 404", status)
+	}
+
+	upload(t, server, "d.txt", "gone")
+	if status, _ := davDo(t, server, http.MethodDelete, "/dav/d.txt", nil, nil); status != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d", status)
+	}
+	if status, _ := download(t, server, "d.txt"); status != http.StatusNotFound {
+		t.Fatalf("GET /down/ after DELETE: status %d, want 404", status)
+	}
+}
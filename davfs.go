@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"tempo/crates"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// davFS presents a crates.Backend as a WebDAV file system. Directories are
+// implied by "/" in stored names; empty ones made with MKCOL are only kept
+// in memory until a file is stored in them.
+type davFS struct {
+	store crates.Backend
+	app   *App // Set when store is the app's default bucket, whose upload directory copies must follow changes
+	mutex sync.Mutex
+	dirs  map[string]struct{} // Explicitly created directories
+}
+
+func newDavFS(store crates.Backend) *davFS {
+	return &davFS{store: store, dirs: make(map[string]struct{})}
+}
+
+// dropLocalCopy forgets the upload directory copy of name, which no longer
+// matches what is stored.
+func (d *davFS) dropLocalCopy(name string) {
+	if d.app != nil {
+		d.app.dropLocalCopy(name)
+	}
+}
+
+// davName turns a WebDAV path into a stored name; the root is "".
+func davName(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// davInfo describes a stored file or an implied directory.
+type davInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	sha256  string
+}
+
+func (i *davInfo) Name() string       { return path.Base("/" + i.name) }
+func (i *davInfo) Size() int64        { return i.size }
+func (i *davInfo) ModTime() time.Time { return i.modTime }
+func (i *davInfo) IsDir() bool        { return i.dir }
+func (i *davInfo) Sys() any           { return nil }
+
+func (i *davInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ETag uses the stored checksum so clients see a change only when the
+// content changed.
+func (i *davInfo) ETag(ctx context.Context) (string, error) {
+	if i.sha256 == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + i.sha256 + `"`, nil
+}
+
+// ContentType answers from the extension, so PROPFIND never downloads files
+// to sniff them.
+func (i *davInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(i.name)); ctype != "" {
+		return ctype, nil
+	}
+	return "application/octet-stream", nil
+}
+
+func fileDavInfo(info *crates.FileInfo) *davInfo {
+	return &davInfo{name: info.Name, size: info.Size, modTime: info.UploadedAt, sha256: info.SHA256}
+}
+
+// children lists what is directly inside dir, and whether dir exists.
+func (d *davFS) children(ctx context.Context, dir string) ([]fs.FileInfo, bool, error) {
+	infos, err := d.store.List(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	exists := dir == ""
+	entries := make(map[string]*davInfo)
+	addDir := func(name string, modTime time.Time) {
+		if entry, ok := entries[name]; !ok {
+			entries[name] = &davInfo{name: prefix + name, dir: true, modTime: modTime}
+		} else if modTime.After(entry.modTime) {
+			entry.modTime = modTime
+		}
+	}
+	for _, info := range infos {
+		rest, ok := strings.CutPrefix(info.Name, prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		exists = true
+		if first, _, nested := strings.Cut(rest, "/"); nested {
+			addDir(first, info.UploadedAt)
+		} else {
+			entries[rest] = fileDavInfo(&info)
+		}
+	}
+
+	d.mutex.Lock()
+	for explicit := range d.dirs {
+		if explicit == dir {
+			exists = true
+		} else if rest, ok := strings.CutPrefix(explicit, prefix); ok {
+			first, _, _ := strings.Cut(rest, "/")
+			addDir(first, time.Time{})
+		}
+	}
+	d.mutex.Unlock()
+
+	list := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, exists, nil
+}
+
+// stat finds name as a file first and as a directory otherwise.
+func (d *davFS) stat(ctx context.Context, name string) (*davInfo, error) {
+	if name != "" {
+		info, err := d.store.Stat(ctx, name)
+		if err == nil {
+			return fileDavInfo(info), nil
+		} else if !errors.Is(err, crates.ErrNotFound) {
+			return nil, err
+		}
+	}
+	_, exists, err := d.children(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, notExist("stat", name)
+	}
+	return &davInfo{name: name, dir: true, modTime: time.Now()}, nil
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return d.stat(ctx, davName(name))
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = davName(name)
+	if name == "" {
+		return fs.ErrExist
+	}
+	if _, err := d.stat(ctx, name); err == nil {
+		return fs.ErrExist
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if parent := path.Dir(name); parent != "." {
+		if info, err := d.stat(ctx, parent); err != nil {
+			return err
+		} else if !info.dir {
+			return notExist("mkdir", parent)
+		}
+	}
+
+	d.mutex.Lock()
+	d.dirs[name] = struct{}{}
+	d.mutex.Unlock()
+	return nil
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = davName(name)
+	info, err := d.stat(ctx, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		if info == nil {
+			return nil, err
+		}
+		if info.dir {
+			children, _, err := d.children(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			return &davDir{info: info, children: children}, nil
+		}
+		return d.openRead(ctx, info)
+	}
+
+	switch {
+	case info != nil && info.dir:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case info != nil && flag&os.O_EXCL != 0:
+		return nil, fs.ErrExist
+	case info == nil && flag&os.O_CREATE == 0:
+		return nil, err
+	}
+	// Like a file system, files can only be created in existing directories
+	if parent := path.Dir(name); info == nil && parent != "." {
+		if parentInfo, err := d.stat(ctx, parent); err != nil {
+			return nil, err
+		} else if !parentInfo.dir {
+			return nil, notExist("open", parent)
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "tempo-dav-*")
+	if err != nil {
+		return nil, err
+	}
+	if info != nil && flag&os.O_TRUNC == 0 {
+		// Keep the current content for partial writes
+		if _, err := d.store.Download(ctx, name, tmp); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+		if flag&os.O_APPEND == 0 {
+			tmp.Seek(0, io.SeekStart)
+		}
+	}
+	return &davWriter{File: tmp, fs: d, ctx: ctx, name: name}, nil
+}
+
+// openRead copies the stored file to a temporary file, so it can be served
+// with seeking and ranges.
+func (d *davFS) openRead(ctx context.Context, info *davInfo) (webdav.File, error) {
+	tmp, err := os.CreateTemp("", "tempo-dav-*")
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.store.Download(ctx, info.name, tmp)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		if errors.Is(err, crates.ErrNotFound) {
+			return nil, notExist("open", info.name)
+		}
+		return nil, err
+	}
+	return &davReader{File: tmp, info: info}, nil
+}
+
+// matching returns the stored names at name or below it.
+func (d *davFS) matching(ctx context.Context, name string) ([]string, error) {
+	infos, err := d.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.Name == name || strings.HasPrefix(info.Name, name+"/") {
+			names = append(names, info.Name)
+		}
+	}
+	return names, nil
+}
+
+// forgetDirs drops explicit directories at name or below it, returning
+// whether there were any.
+func (d *davFS) forgetDirs(name string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	found := false
+	for dir := range d.dirs {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			delete(d.dirs, dir)
+			found = true
+		}
+	}
+	return found
+}
+
+// fileStored forgets the explicit parent directories of name, which the
+// stored file implies from now on.
+func (d *davFS) fileStored(name string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		delete(d.dirs, dir)
+	}
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	name = davName(name)
+	if name == "" {
+		return fs.ErrPermission
+	}
+	names, err := d.matching(ctx, name)
+	if err != nil {
+		return err
+	}
+	hadDirs := d.forgetDirs(name)
+	if len(names) == 0 && !hadDirs {
+		return notExist("remove", name)
+	}
+	for _, stored := range names {
+		var err error
+		if d.app != nil {
+			err = d.app.RemoveFile(ctx, stored) // Like DELETE /:filename, so the local copy and shares go too
+		} else {
+			err = d.store.Delete(ctx, stored)
+		}
+		if err != nil && !errors.Is(err, crates.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = davName(oldName), davName(newName)
+	if oldName == "" || newName == "" {
+		return fs.ErrPermission
+	}
+	names, err := d.matching(ctx, oldName)
+	if err != nil {
+		return err
+	}
+
+	// Directories move with everything stored below them
+	d.mutex.Lock()
+	movedDirs := false
+	for dir := range d.dirs {
+		if dir == oldName || strings.HasPrefix(dir, oldName+"/") {
+			delete(d.dirs, dir)
+			d.dirs[newName+strings.TrimPrefix(dir, oldName)] = struct{}{}
+			movedDirs = true
+		}
+	}
+	d.mutex.Unlock()
+	if len(names) == 0 && !movedDirs {
+		return notExist("rename", oldName)
+	}
+
+	for _, stored := range names {
+		target := newName + strings.TrimPrefix(stored, oldName)
+		if err := d.store.Rename(ctx, stored, target); err != nil {
+			return err
+		}
+		d.dropLocalCopy(stored)
+		d.dropLocalCopy(target) // Replaced if it existed
+	}
+	return nil
+}
+
+// davReader serves a downloaded copy of a stored file.
+type davReader struct {
+	*os.File
+	info *davInfo
+}
+
+func (r *davReader) Stat() (fs.FileInfo, error) { return r.info, nil }
+
+func (r *davReader) Readdir(int) ([]fs.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (r *davReader) Write([]byte) (int, error) { return 0, fs.ErrPermission }
+
+func (r *davReader) Close() error {
+	err := r.File.Close()
+	os.Remove(r.File.Name())
+	return err
+}
+
+// davWriter collects written content in a temporary file and stores it on
+// Close.
+type davWriter struct {
+	*os.File
+	fs   *davFS
+	ctx  context.Context
+	name string
+}
+
+func (w *davWriter) Readdir(int) ([]fs.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (w *davWriter) Stat() (fs.FileInfo, error) {
+	info, err := w.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &davInfo{name: w.name, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func (w *davWriter) Close() error {
+	defer os.Remove(w.File.Name())
+	defer w.File.Close()
+
+	info, err := w.File.Stat()
+	if err != nil {
+		return err
+	}
+	if err := checkQuota(w.ctx, w.fs.store, w.name, info.Size()); err != nil {
+		return err
+	}
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.fs.store.Upload(w.ctx, w.name, w.File); err != nil {
+		return err
+	}
+	w.fs.dropLocalCopy(w.name)
+	w.fs.fileStored(w.name)
+	return nil
+}
+
+// davDir is an open directory.
+type davDir struct {
+	info     *davInfo
+	children []fs.FileInfo
+	offset   int
+}
+
+func (d *davDir) Close() error                                 { return nil }
+func (d *davDir) Read([]byte) (int, error)                     { return 0, errors.New("is a directory") }
+func (d *davDir) Write([]byte) (int, error)                    { return 0, errors.New("is a directory") }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *davDir) Stat() (fs.FileInfo, error)                   { return d.info, nil }
+
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	rest := d.children[d.offset:]
+	if count <= 0 {
+		d.offset = len(d.children)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(rest))
+	d.offset += n
+	return rest[:n], nil
+}
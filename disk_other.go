@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// freeDiskBytes is not implemented on this platform.
+func freeDiskBytes(path string) (uint64, error) {
+	return 0, errDiskUnsupported
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"tempo/crates"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// Event types published when stored files change or are read.
+const (
+	EventUploaded   = "file.uploaded"
+	EventDownloaded = "file.downloaded"
+	EventDeleted    = "file.deleted"
+	EventRenamed    = "file.renamed"
+	EventCleanedUp  = "file.cleaned_up" // Removed by the auto-cleanup
+)
+
+// eventHistory is how many past events are kept for clients resuming with
+// Last-Event-ID.
+const eventHistory = 1000
+
+// eventKeepAlive is how often an idle event stream tells the client, and
+// any proxy on the way, that it is still open.
+const eventKeepAlive = 15 * time.Second
+
+// Event describes one change to the stored files.
+type Event struct {
+	ID     uint64           `json:"id"`
+	Type   string           `json:"type"`
+	Bucket string           `json:"bucket"` // Empty for files kept only on the server
+	Name   string           `json:"name"`
+	From   string           `json:"from,omitempty"` // Old name of a renamed file
+	File   *crates.FileInfo `json:"file,omitempty"`
+	Time   time.Time        `json:"time"`
+}
+
+// Events fans published events out to every subscriber. Subscribers that
+// fall behind are dropped rather than slowing down storage calls.
+type Events struct {
+	mutex       sync.Mutex
+	nextID      uint64
+	history     []Event // The last eventHistory events, oldest first
+	subscribers map[chan Event]struct{}
+}
+
+// NewEvents returns an event hub without subscribers.
+func NewEvents() *Events {
+	return &Events{subscribers: make(map[chan Event]struct{})}
+}
+
+// Publish stamps event with an ID and time and hands it to the subscribers.
+func (e *Events) Publish(event Event) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.nextID++
+	event.ID = e.nextID
+	event.Time = time.Now().UTC()
+	if len(e.history) == eventHistory {
+		e.history = append(e.history[:0], e.history[1:]...)
+	}
+	e.history = append(e.history, event)
+	for ch := range e.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Too slow, closing tells the subscriber it missed events
+			delete(e.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the kept events with an ID above after, a channel
+// receiving every event from now on, closed if the subscriber falls behind,
+// and a function ending the subscription.
+func (e *Events) Subscribe(after uint64) ([]Event, <-chan Event, func()) {
+	ch := make(chan Event, 256)
+	e.mutex.Lock()
+	var missed []Event
+	if after < e.nextID { // A larger ID is from before a restart
+		for _, event := range e.history {
+			if event.ID > after {
+				missed = append(missed, event)
+			}
+		}
+	}
+	e.subscribers[ch] = struct{}{}
+	e.mutex.Unlock()
+
+	return missed, ch, func() {
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		if _, ok := e.subscribers[ch]; ok {
+			delete(e.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// eventFilter selects events by name prefix and type, an empty field
+// matching everything.
+type eventFilter struct {
+	prefix string
+	types  []string
+}
+
+func (f eventFilter) match(event Event) bool {
+	if f.prefix != "" && !strings.HasPrefix(event.Name, f.prefix) && !strings.HasPrefix(event.From, f.prefix) {
+		return false
+	}
+	return len(f.types) == 0 || slices.Contains(f.types, event.Type)
+}
+
+// eventStore publishes an event for every change made through a backend.
+type eventStore struct {
+	crates.Backend
+	bucket string
+	events *Events
+}
+
+func (s eventStore) Upload(ctx context.Context, name string, r io.Reader) (*crates.FileInfo, error) {
+	info, err := s.Backend.Upload(ctx, name, r)
+	if err == nil {
+		activity.recordUpload(ctx, info.Size)
+		s.events.Publish(Event{Type: EventUploaded, Bucket: s.bucket, Name: name, File: info})
+	}
+	return info, err
+}
+
+func (s eventStore) Download(ctx context.Context, name string, w io.Writer) (int64, error) {
+	n, err := s.Backend.Download(ctx, name, w)
+	if err == nil {
+		s.events.Publish(Event{Type: EventDownloaded, Bucket: s.bucket, Name: name})
+	}
+	return n, err
+}
+
+func (s eventStore) DownloadRange(ctx context.Context, name string, offset, length int64, w io.Writer) (int64, error) {
+	n, err := s.Backend.DownloadRange(ctx, name, offset, length, w)
+	if err == nil {
+		s.events.Publish(Event{Type: EventDownloaded, Bucket: s.bucket, Name: name})
+	}
+	return n, err
+}
+
+func (s eventStore) Rename(ctx context.Context, oldName, newName string) error {
+	err := s.Backend.Rename(ctx, oldName, newName)
+	if err == nil {
+		s.events.Publish(Event{Type: EventRenamed, Bucket: s.bucket, Name: newName, From: oldName})
+	}
+	return err
+}
+
+func (s eventStore) Delete(ctx context.Context, name string) error {
+	err := s.Backend.Delete(ctx, name)
+	if err == nil {
+		s.events.Publish(Event{Type: EventDeleted, Bucket: s.bucket, Name: name})
+	}
+	return err
+}
+
+// eventBuckets hands out event publishing backends for every bucket.
+type eventBuckets struct {
+	crates.Buckets
+	events *Events
+}
+
+func (b eventBuckets) Bucket(name string) crates.Backend {
+	return eventStore{Backend: b.Buckets.Bucket(name), bucket: name, events: b.events}
+}
+
+// wsPing sends a WebSocket ping frame.
+var wsPing = websocket.Codec{Marshal: func(any) ([]byte, byte, error) {
+	return nil, websocket.PingFrame, nil
+}}
+
+// streamEvents sends events as Server-Sent Events, or as JSON messages when
+// the request is a WebSocket upgrade. The prefix and type query parameters
+// filter them, type repeated or comma separated, and Last-Event-ID (or the
+// last_event_id parameter, browsers cannot set headers on WebSockets)
+// replays the kept events the client missed.
+func (a *App) streamEvents(ctx *gin.Context) {
+	filter := eventFilter{prefix: ctx.Query("prefix")}
+	for _, types := range ctx.QueryArray("type") {
+		for _, t := range strings.Split(types, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				filter.types = append(filter.types, t)
+			}
+		}
+	}
+	after := uint64(math.MaxUint64) // New events only
+	lastID := ctx.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = ctx.Query("last_event_id")
+	}
+	if lastID != "" {
+		id, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+		after = id
+	}
+
+	missed, events, unsubscribe := a.events.Subscribe(after)
+	defer unsubscribe()
+
+	if ctx.IsWebsocket() {
+		websocket.Server{Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			// Reading handles close frames and notices when the client is gone
+			gone := make(chan struct{})
+			go func() {
+				io.Copy(io.Discard, ws)
+				close(gone)
+			}()
+			a.relayEvents(gone, filter, missed, events, func(event *Event) error {
+				if event == nil {
+					return wsPing.Send(ws, nil)
+				}
+				return websocket.JSON.Send(ws, event)
+			})
+		}}.ServeHTTP(ctx.Writer, ctx.Request)
+		return
+	}
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no") // Keep nginx from holding events back
+	ctx.Status(http.StatusOK)
+	ctx.Writer.Flush()
+	a.relayEvents(ctx.Request.Context().Done(), filter, missed, events, func(event *Event) error {
+		var err error
+		if event == nil {
+			_, err = io.WriteString(ctx.Writer, ": keep-alive\n\n")
+		} else {
+			data, _ := json.Marshal(event)
+			_, err = fmt.Fprintf(ctx.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		}
+		ctx.Writer.Flush()
+		return err
+	})
+}
+
+// relayEvents calls send with the missed and then the live events matching
+// filter, and with nil when idle for eventKeepAlive. It returns when the
+// client is gone, the server stops, sending fails or the subscription was
+// dropped for falling behind; clients then resume with the last ID they got.
+func (a *App) relayEvents(gone <-chan struct{}, filter eventFilter, missed []Event, events <-chan Event, send func(*Event) error) {
+	for i := range missed {
+		if filter.match(missed[i]) {
+			if err := send(&missed[i]); err != nil {
+				return
+			}
+		}
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case <-a.ctx.Done():
+			return
+		case <-keepAlive.C:
+			if err := send(nil); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if !filter.match(event) {
+				continue
+			}
+			if err := send(&event); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"tempo/crates"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// errNotArchive is returned for uploads that are no ZIP or tar file.
+	errNotArchive = errors.New("not a ZIP or tar archive")
+	// errExtractLimit is returned when an archive unpacks to more than the
+	// extract limits allow, e.g. a zip bomb.
+	errExtractLimit = errors.New("archive exceeds the extraction limits")
+)
+
+// ExtractResult is the outcome for one archive member.
+type ExtractResult struct {
+	Entry   string           `json:"entry"`          // Name inside the archive
+	Name    string           `json:"name,omitempty"` // Stored as
+	Size    int64            `json:"size,omitempty"`
+	File    *crates.FileInfo `json:"file,omitempty"`
+	Skipped string           `json:"skipped,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// extractor stores the members of one archive and keeps count of them.
+type extractor struct {
+	app       *App
+	ctx       context.Context
+	prefix    string
+	localOnly bool
+	limits    ExtractConfig
+	source    *countingReader // The archive as uploaded
+	entries   int
+	total     int64
+	results   []ExtractResult
+}
+
+// ExtractArchive stores every regular file of the ZIP or tar(.gz/.zst)
+// archive in r under prefix, each like a normal upload. Members with unsafe
+// paths are refused. When the archive breaks the extract limits every member
+// stored so far is removed again and errExtractLimit is returned.
+func (a *App) ExtractArchive(ctx context.Context, r io.Reader, size int64, prefix string, localOnly bool) ([]ExtractResult, error) {
+	e := &extractor{
+		app:       a,
+		ctx:       ctx,
+		prefix:    prefix,
+		localOnly: localOnly,
+		limits:    currentConfig().Extract,
+		source:    &countingReader{r: r},
+		results:   []ExtractResult{},
+	}
+	buffered := bufio.NewReaderSize(e.source, 64*1024)
+	magic, _ := buffered.Peek(512)
+
+	var err error
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		err = e.zip(r, size, buffered)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(buffered); err == nil {
+			err = e.tar(gz)
+		}
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(buffered); err == nil {
+			err = e.tar(zr)
+			zr.Close()
+		}
+	case len(magic) > 262 && string(magic[257:262]) == "ustar":
+		err = e.tar(buffered)
+	default:
+		return nil, errNotArchive
+	}
+
+	if errors.Is(err, errExtractLimit) {
+		// Undoing our own partial extraction, not a delete the hooks may veto
+		rollback := withHooksRan(context.WithoutCancel(ctx))
+		for _, result := range e.results {
+			if result.Name != "" && result.Error == "" {
+				a.RemoveFile(rollback, result.Name)
+			}
+		}
+		return nil, err
+	}
+	return e.results, err
+}
+
+// zip needs random access, so an upload that is not already a file is
+// spooled to the upload directory first.
+func (e *extractor) zip(r io.Reader, size int64, buffered io.Reader) error {
+	ra, ok := r.(io.ReaderAt)
+	if !ok || size <= 0 {
+		spool, err := os.CreateTemp(e.app.workDir, "extract-*.zip")
+		if err != nil {
+			return fmt.Errorf("failed to spool archive: %w", err)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if size, err = io.Copy(spool, buffered); err != nil {
+			return fmt.Errorf("failed to spool archive: %w", err)
+		}
+		ra = spool
+	}
+	e.source.n = size
+
+	archive, err := zip.NewReader(ra, size)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNotArchive, err)
+	}
+	// The directory tells what is coming, refuse obvious bombs up front
+	var declared uint64
+	for _, member := range archive.File {
+		declared += member.UncompressedSize64
+	}
+	if err := e.check(len(archive.File), int64(min(declared, 1<<62))); err != nil {
+		return err
+	}
+
+	for _, member := range archive.File {
+		if !member.Mode().IsRegular() {
+			if err := e.skip(member.Name, member.Mode().IsDir()); err != nil {
+				return err
+			}
+			continue
+		}
+		content, err := member.Open()
+		if err != nil {
+			e.results = append(e.results, ExtractResult{Entry: member.Name, Error: err.Error()})
+			continue
+		}
+		err = e.store(member.Name, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *extractor) tar(r io.Reader) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w: %v", errNotArchive, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			if err := e.skip(header.Name, header.Typeflag == tar.TypeDir); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := e.store(header.Name, archive); err != nil {
+			return err
+		}
+	}
+}
+
+// check fails once entries or bytes go past the limits, or the bytes
+// unpacked grow too far beyond the bytes read from the archive.
+func (e *extractor) check(entries int, total int64) error {
+	limits := e.limits
+	switch {
+	case limits.MaxEntries > 0 && entries > limits.MaxEntries:
+		return fmt.Errorf("%w: more than %d entries", errExtractLimit, limits.MaxEntries)
+	case limits.MaxTotalMB > 0 && total > int64(mb(limits.MaxTotalMB)):
+		return fmt.Errorf("%w: more than %d MB", errExtractLimit, limits.MaxTotalMB)
+	case limits.MaxRatio > 0 && total > int64(mb(1)) && total > int64(limits.MaxRatio)*max(e.source.n, 1):
+		return fmt.Errorf("%w: unpacks to more than %d times its size", errExtractLimit, limits.MaxRatio)
+	}
+	return nil
+}
+
+// skip counts a member that is not stored; directories are left out of the
+// results.
+func (e *extractor) skip(entry string, dir bool) error {
+	e.entries++
+	if err := e.check(e.entries, e.total); err != nil {
+		return err
+	}
+	if !dir {
+		e.results = append(e.results, ExtractResult{Entry: entry, Skipped: "not a regular file"})
+	}
+	return nil
+}
+
+// store uploads one member. Only a broken limit ends the extraction; other
+// failures are reported for the member.
+func (e *extractor) store(entry string, r io.Reader) error {
+	e.entries++
+	if err := e.check(e.entries, e.total); err != nil {
+		return err
+	}
+	result := ExtractResult{Entry: entry}
+	name, ok := safeEntryName(entry)
+	if !ok {
+		result.Error = "unsafe path"
+		e.results = append(e.results, result)
+		return nil
+	}
+	if e.prefix != "" {
+		name = e.prefix + "/" + name
+	}
+
+	written, info, err := e.app.StoreFile(e.ctx, name, &limitedEntry{r: r, e: e}, e.localOnly)
+	if errors.Is(err, errExtractLimit) {
+		return e.check(e.entries, e.total) // Without the StoreFile wrapping
+	}
+	result.Name, result.Size, result.File = name, written, info
+	if err != nil {
+		result.Error = err.Error()
+	}
+	e.results = append(e.results, result)
+	return nil
+}
+
+// safeEntryName turns an archive member name into a stored name, refusing
+// absolute paths and ".." so nothing lands outside the prefix (zip slip).
+func safeEntryName(entry string) (string, bool) {
+	entry = strings.ReplaceAll(entry, `\`, "/")
+	if strings.HasPrefix(entry, "/") || hasDriveLetter(entry) {
+		return "", false
+	}
+	for _, part := range strings.Split(entry, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	name, err := cleanName(entry)
+	return name, err == nil
+}
+
+// hasDriveLetter reports whether entry starts with a Windows drive, like
+// "C:/x" or "C:", while "a:b.txt" is an ordinary name.
+func hasDriveLetter(entry string) bool {
+	if len(entry) < 2 || entry[1] != ':' {
+		return false
+	}
+	letter := entry[0] | 0x20 // Lower case
+	return letter >= 'a' && letter <= 'z' && (len(entry) == 2 || entry[2] == '/')
+}
+
+// limitedEntry counts the bytes of a member against the limits while it is
+// read.
+type limitedEntry struct {
+	r io.Reader
+	e *extractor
+}
+
+func (l *limitedEntry) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.e.total += int64(n)
+	if limitErr := l.e.check(l.e.entries, l.e.total); limitErr != nil {
+		return n, limitErr
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// extractRequested reports whether an upload asks for ?extract=true.
+func extractRequested(ctx *gin.Context) bool {
+	extract, _ := strconv.ParseBool(ctx.Query("extract"))
+	return extract
+}
+
+// extractPrefix is where the members of archiveName go: the prefix query
+// parameter, or the archive name without its extension.
+func extractPrefix(ctx *gin.Context, archiveName string) (string, error) {
+	prefix, ok := ctx.GetQuery("prefix")
+	if !ok {
+		prefix = path.Base(strings.ReplaceAll(archiveName, `\`, "/"))
+		for _, ext := range []string{".zip", ".tar.gz", ".tgz", ".tar.zst", ".tzst", ".tar"} {
+			if strings.HasSuffix(strings.ToLower(prefix), ext) {
+				prefix = prefix[:len(prefix)-len(ext)]
+				break
+			}
+		}
+	}
+	if strings.Trim(prefix, "/") == "" {
+		return "", nil
+	}
+	return cleanName(prefix)
+}
+
+// extractErrorStatus picks the HTTP status for an error from ExtractArchive.
+func extractErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errExtractLimit):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errNotArchive), errors.Is(err, errInvalidName):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// extractUpload answers an upload with ?extract=true by unpacking the
+// archive instead of storing it.
+func (a *App) extractUpload(ctx *gin.Context, uploadCtx context.Context, archiveName string, r io.Reader, size int64, localOnly bool) {
+	prefix, err := extractPrefix(ctx, archiveName)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid prefix"})
+		return
+	}
+	results, err := a.ExtractArchive(uploadCtx, r, size, prefix, localOnly)
+	if err != nil {
+		reqLogger(a.logger, ctx).Warn("Failed to extract archive", "filename", archiveName, "error", err)
+		body := gin.H{"error": err.Error()}
+		if len(results) > 0 {
+			body["files"] = results // Stored before the archive turned out broken
+		}
+		ctx.JSON(extractErrorStatus(err), body)
+		return
+	}
+
+	status, stored := http.StatusOK, 0
+	for _, result := range results {
+		if result.Error != "" {
+			status = http.StatusMultiStatus
+		} else if result.Name != "" {
+			stored++
+		}
+	}
+	reqLogger(a.logger, ctx).Info("Archive extracted", "filename", archiveName, "prefix", prefix, "files", stored, "entries", len(results))
+	ctx.JSON(status, gin.H{"archive": archiveName, "prefix": prefix, "files": results})
+}
@@ -1,54 +1,62 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"tempo/crates"
+	"sync"
 )
 
 
 
 
-func ClearServer() error {
-	// Get database files
-	dbFiles := crates.Grider("list")
-	
-	// Convert slice to map for O(1) lookups
-	dbFileMap := make(map[string]struct{}, len(dbFiles))
-	for _, file := range dbFiles {
-		dbFileMap[file] = struct{}{}
-	}
-	
-	// Read directory contents
-	dirFiles, err := os.ReadDir("./")
-	if err != nil {
-		return fmt.Errorf("failed to read directory: %w", err)
-	}
-	
-	// Process each file
+// ClearServer removes the copies in uploadDir of the files already stored
+// in the database, dbFiles being their names. Nothing outside uploadDir is
+// touched, whatever the stored names are.
+func ClearServer(uploadDir string, dbFiles []string) error {
 	removedCount := 0
-	for _, file := range dirFiles {
-		if file.IsDir() {
-			continue // Skip directories
+	for _, file := range dbFiles {
+		name, err := cleanName(file)
+		if err != nil || name != file {
+			continue // Not a name an upload could have left behind
+		}
+		fullPath := filepath.Join(uploadDir, filepath.FromSlash(name))
+		if info, err := os.Lstat(fullPath); err != nil || !info.Mode().IsRegular() {
+			continue
 		}
-		
-		filename := file.Name()
-		// Check if file exists in database files using map lookup
-		if _, exists := dbFileMap[filename]; exists {
-			// Construct full path
-			fullPath := filepath.Join("./", filename)
-			
-			// Remove file and handle potential errors
-			if err := os.Remove(fullPath); err != nil {
-				log.Printf("Warning: could not remove file %s: %v", filename, err)
-			} else {
-				removedCount++
-			}
+		if err := os.Remove(fullPath); err != nil {
+			slog.Warn("could not remove file", "filename", name, "error", err)
+		} else {
+			removedCount++
 		}
 	}
-	
-	log.Printf("ClearServer: removed %d files", removedCount)
+
+	slog.Info("ClearServer: removed files", "count", removedCount)
 	return nil
-}
\ No newline at end of file
+}
+
+// waitAll runs every wait function concurrently and returns once all of them
+// have returned, or with ctx's error if ctx ends first.
+func waitAll(ctx context.Context, waits ...func()) error {
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, wait := range waits {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				wait()
+			}()
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative tempopb/tempo.proto
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"tempo/crates"
+	"tempo/tempopb"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcChunkSize is the size of the content chunks Download sends.
+const grpcChunkSize = 64 << 10
+
+// newGRPCServer returns a gRPC server with the Files service, sharing the
+// storage path of the HTTP routes through App.
+func newGRPCServer(app *App) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(app.grpcUnary),
+		grpc.ChainStreamInterceptor(app.grpcStream),
+	)
+	tempopb.RegisterFilesServer(server, &grpcFiles{app: app})
+	return server
+}
+
+// grpcHandler sends gRPC requests to server and everything else to next, so
+// both can share one port over h2c.
+func grpcHandler(server *grpc.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			server.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// grpcPrepare authenticates a call and gives its context a request ID, like
+// the apiAuth and requestID middleware do for HTTP.
+func grpcPrepare(ctx context.Context) (context.Context, string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := ""
+	if ids := md.Get(strings.ToLower(RequestIDHeader)); len(ids) > 0 && len(ids[0]) <= 64 {
+		id = ids[0]
+	}
+	if id == "" {
+		id = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(RequestIDHeader), id))
+	ctx = crates.WithRequestID(ctx, id)
+
+	authorization := md.Get("authorization")
+	if len(authorization) == 0 {
+		return ctx, id, status.Error(codes.Unauthenticated, "authentication failed")
+	}
+	identity, ok := bearerIdentity(authorization[0])
+	if !ok {
+		return ctx, id, status.Error(codes.Unauthenticated, "authentication failed")
+	}
+	return withUploader(ctx, identity), id, nil
+}
+
+// grpcLog writes one structured line per call and records its metrics.
+func (a *App) grpcLog(ctx context.Context, method, id string, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	switch code {
+	case codes.OK, codes.Canceled:
+	case codes.Internal, codes.Unknown, codes.DataLoss, codes.Unavailable:
+		level = slog.LevelError
+	default:
+		level = slog.LevelWarn
+	}
+	a.logger.Log(ctx, level, "grpc", "request_id", id, "method", method, "code", code.String(),
+		"latency_ms", time.Since(start).Milliseconds())
+	grpcRequests.WithLabelValues(method, code.String()).Inc()
+	grpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+func (a *App) grpcUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	ctx, id, err := grpcPrepare(ctx)
+	var resp any
+	if err == nil {
+		resp, err = handler(ctx, req)
+	}
+	a.grpcLog(ctx, info.FullMethod, id, start, err)
+	return resp, err
+}
+
+func (a *App) grpcStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, id, err := grpcPrepare(stream.Context())
+	if err == nil {
+		err = handler(srv, &grpcContextStream{ServerStream: stream, ctx: ctx})
+	}
+	a.grpcLog(ctx, info.FullMethod, id, start, err)
+	return err
+}
+
+// grpcContextStream replaces the context of a stream.
+type grpcContextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcContextStream) Context() context.Context { return s.ctx }
+
+// grpcError turns storage errors into status errors with matching codes.
+func grpcError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, crates.ErrNotFound):
+		return status.Error(codes.NotFound, "file not found")
+	case errors.Is(err, errInvalidName):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errQuotaExceeded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, errHookRejected):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func grpcFileInfo(info *crates.FileInfo) *tempopb.FileInfo {
+	if info == nil {
+		return nil
+	}
+	return &tempopb.FileInfo{
+		Id:         info.ID,
+		Name:       info.Name,
+		Size:       info.Size,
+		UploadedAt: timestamppb.New(info.UploadedAt),
+		Sha256:     info.SHA256,
+		Md5:        info.MD5,
+	}
+}
+
+// grpcFiles implements tempopb.FilesServer.
+type grpcFiles struct {
+	tempopb.UnimplementedFilesServer
+	app *App
+}
+
+func (g *grpcFiles) Upload(stream grpc.ClientStreamingServer[tempopb.UploadRequest, tempopb.FileInfo]) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "expected a first message naming the file")
+	}
+	name, err := cleanName(first.GetName())
+	if err != nil {
+		return grpcError(err)
+	}
+
+	// Feed the chunks to StoreFile as one stream
+	reader, writer := io.Pipe()
+	go func() {
+		if _, err := writer.Write(first.GetChunk()); err != nil {
+			return
+		}
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+				writer.CloseWithError(err)
+				return
+			}
+			if _, err := writer.Write(msg.GetChunk()); err != nil {
+				return
+			}
+		}
+	}()
+	written, info, err := g.app.StoreFile(stream.Context(), name, reader, false)
+	reader.CloseWithError(err) // Unblocks the receiving goroutine on failure
+	if err != nil {
+		g.app.logger.Error("Failed to store upload", "request_id", crates.RequestID(stream.Context()),
+			"filename", name, "error", err)
+		return grpcError(err)
+	}
+	g.app.logger.Info("File uploaded over gRPC", "request_id", crates.RequestID(stream.Context()),
+		"filename", name, "bytes", written)
+	return stream.SendAndClose(grpcFileInfo(info))
+}
+
+func (g *grpcFiles) Download(req *tempopb.DownloadRequest, stream grpc.ServerStreamingServer[tempopb.DownloadResponse]) error {
+	ctx := stream.Context()
+	name, err := cleanName(req.GetName())
+	if err != nil {
+		return grpcError(err)
+	}
+	info, err := g.app.store.Stat(ctx, name)
+	if err != nil && !(errors.Is(err, crates.ErrNotFound) && g.app.hasLocalCopy(name)) {
+		return grpcError(err)
+	}
+	if req.GetOffset() < 0 {
+		return status.Error(codes.InvalidArgument, "offset must not be negative")
+	}
+
+	sender := &grpcChunkSender{stream: stream}
+	if info != nil {
+		sender.first = &tempopb.DownloadResponse{Info: grpcFileInfo(info)}
+	}
+	// Like ServeFile, serve uploads still on disk without a GridFS round trip
+	if g.app.hasLocalCopy(name) {
+		downloadCache.WithLabelValues("hit").Inc()
+		file, err := os.Open(g.app.localPath(name))
+		if err != nil {
+			return grpcError(err)
+		}
+		defer file.Close()
+		if sender.first == nil {
+			if stat, err := file.Stat(); err == nil {
+				sender.first = &tempopb.DownloadResponse{Info: &tempopb.FileInfo{Name: name, Size: stat.Size()}}
+			}
+		}
+		if _, err := file.Seek(req.GetOffset(), io.SeekStart); err != nil {
+			return grpcError(err)
+		}
+		_, err = io.Copy(sender, file)
+		if err == nil {
+			err = sender.Flush()
+		}
+		if err == nil {
+			g.app.events.Publish(Event{Type: EventDownloaded, Bucket: crates.DefaultBucket(), Name: name})
+		}
+		return grpcError(err)
+	}
+	downloadCache.WithLabelValues("miss").Inc()
+	if info == nil { // The local copy went away since the Stat
+		return status.Error(codes.NotFound, "file not found")
+	}
+	length := max(info.Size-req.GetOffset(), 0)
+	if _, err := g.app.store.DownloadRange(ctx, name, req.GetOffset(), length, sender); err != nil {
+		return grpcError(err)
+	}
+	return grpcError(sender.Flush())
+}
+
+// grpcChunkSender writes a download to a stream in grpcChunkSize chunks.
+type grpcChunkSender struct {
+	stream grpc.ServerStreamingServer[tempopb.DownloadResponse]
+	first  *tempopb.DownloadResponse // Metadata, sent with the first chunk
+	buf    []byte
+}
+
+func (s *grpcChunkSender) Write(p []byte) (int, error) {
+	n := len(p)
+	s.buf = append(s.buf, p...)
+	for len(s.buf) >= grpcChunkSize {
+		if err := s.send(s.buf[:grpcChunkSize]); err != nil {
+			return 0, err
+		}
+		s.buf = s.buf[grpcChunkSize:]
+	}
+	return n, nil
+}
+
+// Flush sends what is left, and the metadata when nothing was sent yet.
+func (s *grpcChunkSender) Flush() error {
+	if len(s.buf) > 0 || s.first != nil {
+		return s.send(s.buf)
+	}
+	return nil
+}
+
+func (s *grpcChunkSender) send(chunk []byte) error {
+	msg := &tempopb.DownloadResponse{Chunk: chunk}
+	if s.first != nil {
+		msg.Info, s.first = s.first.Info, nil
+	}
+	if err := s.stream.Send(msg); err != nil {
+		return err
+	}
+	bytesDownloaded.Add(float64(len(chunk)))
+	return nil
+}
+
+func (g *grpcFiles) List(ctx context.Context, req *tempopb.ListRequest) (*tempopb.ListResponse, error) {
+	pageSize := int(req.GetPageSize())
+	if pageSize <= 0 || pageSize > 1000 {
+		pageSize = 1000
+	}
+	after := ""
+	if token := req.GetPageToken(); token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid page token")
+		}
+		after = string(decoded)
+	}
+
+	infos, err := g.app.ListFiles(ctx, req.GetPrefix())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &tempopb.ListResponse{}
+	for i := range infos {
+		if infos[i].Name <= after {
+			continue
+		}
+		if len(resp.Files) == pageSize {
+			// The token is the last name sent, so pages stay stable while files change
+			resp.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(resp.Files[pageSize-1].Name))
+			break
+		}
+		resp.Files = append(resp.Files, grpcFileInfo(&infos[i]))
+	}
+	return resp, nil
+}
+
+func (g *grpcFiles) Stat(ctx context.Context, req *tempopb.StatRequest) (*tempopb.FileInfo, error) {
+	name, err := cleanName(req.GetName())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	info, err := g.app.store.Stat(ctx, name)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcFileInfo(info), nil
+}
+
+func (g *grpcFiles) Delete(ctx context.Context, req *tempopb.DeleteRequest) (*tempopb.DeleteResponse, error) {
+	if err := g.app.RemoveFile(ctx, req.GetName()); err != nil {
+		return nil, grpcError(err)
+	}
+	g.app.logger.Info("File removed over gRPC", "request_id", crates.RequestID(ctx), "filename", req.GetName())
+	return &tempopb.DeleteResponse{}, nil
+}
+
+func (g *grpcFiles) Watch(req *tempopb.WatchRequest, stream grpc.ServerStreamingServer[tempopb.Event]) error {
+	_, events, unsubscribe := g.app.events.Subscribe(math.MaxUint64) // New events only
+	defer unsubscribe()
+	filter := eventFilter{prefix: req.GetPrefix()}
+	// The server context ends watches on shutdown, GracefulStop would wait forever
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-g.app.ctx.Done():
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case event, ok := <-events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watcher fell behind and missed events")
+			}
+			if !filter.match(event) {
+				continue
+			}
+			err := stream.Send(&tempopb.Event{
+				Id:     event.ID,
+				Type:   event.Type,
+				Bucket: event.Bucket,
+				Name:   event.Name,
+				From:   event.From,
+				File:   grpcFileInfo(event.File),
+				Time:   timestamppb.New(event.Time),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"tempo/crates"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server lifecycle states reported by the readiness probe
+const (
+	stateStarting int32 = iota
+	stateReady
+	stateDraining
+)
+
+var stateNames = map[int32]string{
+	stateStarting: "starting",
+	stateReady:    "ready",
+	stateDraining: "draining",
+}
+
+// errDiskUnsupported is returned by freeDiskBytes where free space cannot be
+// queried; the disk check is then reported as skipped.
+var errDiskUnsupported = errors.New("free disk space is not supported on this platform")
+
+// errCheckSkipped marks a check that does not apply to this configuration.
+var errCheckSkipped = errors.New("check does not apply")
+
+// CheckResult is the outcome of a single readiness check.
+type CheckResult struct {
+	Status    string `json:"status"` // ok, fail or skipped
+	LatencyMs int64  `json:"latency_ms"`
+	Detail    string `json:"detail,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Health serves the liveness and readiness probes and tracks the server
+// lifecycle and background workers they report on.
+type Health struct {
+	uploadDir string
+	started   time.Time
+
+	state   atomic.Int32
+	mutex   sync.RWMutex
+	workers map[string]bool
+	wg      sync.WaitGroup
+}
+
+// NewHealth creates a Health in the starting state. Thresholds are read from
+// the current configuration on every probe.
+func NewHealth(uploadDir string) *Health {
+	return &Health{
+		uploadDir: uploadDir,
+		started:   time.Now(),
+		workers:   make(map[string]bool),
+	}
+}
+
+// SetState moves the server to stateStarting, stateReady or stateDraining.
+func (h *Health) SetState(state int32) {
+	h.state.Store(state)
+}
+
+// WorkerStarted registers a background worker as running.
+func (h *Health) WorkerStarted(name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.workers[name] = true
+}
+
+// WorkerStopped marks a background worker as no longer running.
+func (h *Health) WorkerStopped(name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.workers[name] = false
+}
+
+// Go runs fn in a goroutine that the readiness probe reports as a worker
+// until fn returns.
+func (h *Health) Go(name string, fn func()) {
+	h.WorkerStarted(name)
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer h.WorkerStopped(name)
+		fn()
+	}()
+}
+
+// Wait blocks until every worker started with Go has returned.
+func (h *Health) Wait() {
+	h.wg.Wait()
+}
+
+// Liveness reports that the process is up and serving HTTP. It deliberately
+// checks nothing else so a dependency outage doesn't get the process restarted.
+func (h *Health) Liveness(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":         "ok",
+		"uptime_seconds": int64(time.Since(h.started).Seconds()),
+	})
+}
+
+// Readiness runs every dependency check concurrently and answers 503 unless
+// all of them pass and the server is neither starting nor draining.
+func (h *Health) Readiness(ctx *gin.Context) {
+	checks := map[string]func(context.Context) (string, error){
+		"mongo":      h.checkMongo,
+		"upload_dir": h.checkUploadDir,
+		"disk":       h.checkDisk,
+		"workers":    h.checkWorkers,
+	}
+
+	results := make(map[string]CheckResult, len(checks))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := runCheck(ctx.Request.Context(), check)
+			mutex.Lock()
+			results[name] = result
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	state := h.state.Load()
+	ready := state == stateReady
+	for _, result := range results {
+		if result.Status == "fail" {
+			ready = false
+		}
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+	ctx.JSON(code, gin.H{
+		"status": status,
+		"state":  stateNames[state],
+		"checks": results,
+	})
+}
+
+// runCheck runs one readiness check and times it.
+func runCheck(ctx context.Context, check func(context.Context) (string, error)) CheckResult {
+	start := time.Now()
+	detail, err := check(ctx)
+
+	result := CheckResult{Status: "ok", LatencyMs: time.Since(start).Milliseconds(), Detail: detail}
+	if errors.Is(err, errDiskUnsupported) || errors.Is(err, errCheckSkipped) {
+		result.Status = "skipped"
+	} else if err != nil {
+		result.Status = "fail"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (h *Health) checkMongo(ctx context.Context) (string, error) {
+	if currentConfig().Server.Storage == "memory" {
+		return "in-memory storage", errCheckSkipped
+	}
+	ctx, cancel := context.WithTimeout(ctx, currentConfig().Ready.MongoTimeout)
+	defer cancel()
+	return "", crates.Ping(ctx)
+}
+
+func (h *Health) checkUploadDir(context.Context) (string, error) {
+	probe, err := os.CreateTemp(h.uploadDir, ".readyz-*")
+	if err != nil {
+		return "", fmt.Errorf("upload directory is not writable: %w", err)
+	}
+	probe.Close()
+	return h.uploadDir, os.Remove(probe.Name())
+}
+
+func (h *Health) checkDisk(context.Context) (string, error) {
+	free, err := freeDiskBytes(h.uploadDir)
+	if err != nil {
+		return "", err
+	}
+	minFree := mb(currentConfig().Ready.MinFreeMB)
+	detail := fmt.Sprintf("%d MB free, %d MB required", free>>20, minFree>>20)
+	if free < minFree {
+		return detail, errors.New("free disk space below threshold")
+	}
+	return detail, nil
+}
+
+func (h *Health) checkWorkers(context.Context) (string, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	var stopped []string
+	for name, running := range h.workers {
+		if !running {
+			stopped = append(stopped, name)
+		}
+	}
+	if len(stopped) > 0 {
+		return "", fmt.Errorf("workers not running: %v", stopped)
+	}
+	return fmt.Sprintf("%d workers running", len(h.workers)), nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"tempo/crates"
+	"time"
+)
+
+// Hook stages. pre_upload and pre_delete hooks can reject the change;
+// post_upload hooks run in the background once the file is stored.
+const (
+	HookPreUpload  = "pre_upload"
+	HookPostUpload = "post_upload"
+	HookPreDelete  = "pre_delete"
+)
+
+var hookStages = []string{HookPreUpload, HookPostUpload, HookPreDelete}
+
+// hookTimeout applies to external hooks without a timeout of their own.
+const hookTimeout = 10 * time.Second
+
+// errHookRejected matches every HookRejection.
+var errHookRejected = errors.New("rejected by hook")
+
+// HookFile describes the file a hook runs for. External hooks get it as
+// JSON on stdin.
+type HookFile struct {
+	Stage  string `json:"stage"`
+	Bucket string `json:"bucket"` // Empty for files kept only on the server
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"` // Of stored files, not known before the upload
+	Path   string `json:"path,omitempty"`   // pre_upload only: the content, hooks may rewrite it
+	Client string `json:"client"`           // Who made the change, e.g. "admin" or "user:partner"
+}
+
+// HookRejection is the error returned when a hook refuses a change.
+type HookRejection struct {
+	Hook   string
+	Reason string
+}
+
+func (r *HookRejection) Error() string {
+	return fmt.Sprintf("rejected by hook %s: %s", r.Hook, r.Reason)
+}
+
+func (r *HookRejection) Is(target error) bool {
+	return target == errHookRejected
+}
+
+// Reject is what an in-process hook returns to refuse a change with reason.
+func Reject(format string, args ...any) error {
+	return &HookRejection{Reason: fmt.Sprintf(format, args...)}
+}
+
+// HookFunc is an in-process hook. Any error from a pre_upload or pre_delete
+// hook stops the change; use Reject so clients learn why. pre_upload hooks
+// may rewrite the file at file.Path.
+type HookFunc func(ctx context.Context, file *HookFile) error
+
+type goHook struct {
+	name   string
+	stages []string
+	fn     HookFunc
+}
+
+var goHooks struct {
+	mutex sync.Mutex
+	list  []goHook
+}
+
+// RegisterHook adds an in-process hook for stages. Call it from an init
+// function in a file of this package; hooks run in the order registered,
+// before the external ones from the configuration.
+func RegisterHook(name string, fn HookFunc, stages ...string) {
+	goHooks.mutex.Lock()
+	defer goHooks.mutex.Unlock()
+	goHooks.list = append(goHooks.list, goHook{name: name, stages: stages, fn: fn})
+}
+
+// Hooks runs the in-process and external hooks around uploads and deletes.
+type Hooks struct {
+	logger  *slog.Logger
+	spool   string         // Directory where direct uploads wait for pre_upload hooks
+	running sync.WaitGroup // post_upload hooks in the background
+}
+
+func NewHooks(spool string, logger *slog.Logger) *Hooks {
+	return &Hooks{logger: logger, spool: spool}
+}
+
+// Wait blocks until the post_upload hooks started so far are done.
+func (h *Hooks) Wait() {
+	h.running.Wait()
+}
+
+// has reports whether any hook runs at stage.
+func (h *Hooks) has(stage string) bool {
+	goHooks.mutex.Lock()
+	defer goHooks.mutex.Unlock()
+	for _, hook := range goHooks.list {
+		if slices.Contains(hook.stages, stage) {
+			return true
+		}
+	}
+	return slices.ContainsFunc(currentConfig().Hooks, func(hook HookConfig) bool {
+		return slices.Contains(hook.Stages, stage)
+	})
+}
+
+// Run calls every hook for file.Stage in turn and stops at the first that
+// rejects the change or fails.
+func (h *Hooks) Run(ctx context.Context, file *HookFile) error {
+	goHooks.mutex.Lock()
+	list := slices.Clone(goHooks.list)
+	goHooks.mutex.Unlock()
+
+	for _, hook := range list {
+		if !slices.Contains(hook.stages, file.Stage) {
+			continue
+		}
+		if err := h.result(hook.name, file, hook.fn(ctx, file)); err != nil {
+			return err
+		}
+	}
+	for _, hook := range currentConfig().Hooks {
+		if !slices.Contains(hook.Stages, file.Stage) {
+			continue
+		}
+		if err := h.result(hook.Name, file, runExternalHook(ctx, hook, file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// result names the hook in err and logs it.
+func (h *Hooks) result(name string, file *HookFile, err error) error {
+	var rejection *HookRejection
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &rejection):
+		rejection.Hook = name
+		h.logger.Info("Hook rejected change", "hook", name, "stage", file.Stage, "filename", file.Name, "reason", rejection.Reason)
+		return rejection
+	}
+	h.logger.Error("Hook failed", "hook", name, "stage", file.Stage, "filename", file.Name, "error", err)
+	return fmt.Errorf("hook %s failed: %w", name, err)
+}
+
+// After runs the post_upload hooks for file in the background.
+func (h *Hooks) After(ctx context.Context, file HookFile) {
+	if !h.has(HookPostUpload) {
+		return
+	}
+	file.Stage, file.Path = HookPostUpload, ""
+	h.running.Add(1)
+	go func() {
+		defer h.running.Done()
+		h.Run(context.WithoutCancel(ctx), &file) // Failures are logged, the file stays
+	}()
+}
+
+// hookDecision is what external hooks may print on stdout.
+type hookDecision struct {
+	Allow  *bool  `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// runExternalHook runs the executable of hook with file as JSON on stdin.
+// A JSON decision on stdout wins; otherwise exit status 0 allows the change
+// and any other status rejects it, with stderr as the reason.
+func runExternalHook(ctx context.Context, hook HookConfig, file *HookFile) error {
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = hookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	input, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	cmd.Env = append(os.Environ(), "TEMPO_HOOK_STAGE="+file.Stage)
+	cmd.WaitDelay = time.Second // Children keeping the pipes open cannot hold us up
+	runErr := cmd.Run()
+
+	var decision hookDecision
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) > 0 && json.Unmarshal(out, &decision) == nil && decision.Allow != nil {
+		if *decision.Allow {
+			return nil
+		}
+		if decision.Reason == "" {
+			decision.Reason = "no reason given"
+		}
+		return &HookRejection{Reason: decision.Reason}
+	}
+	var exitErr *exec.ExitError
+	if errors.As(runErr, &exitErr) && ctx.Err() == nil {
+		reason := strings.TrimSpace(stderr.String())
+		if reason == "" {
+			reason = fmt.Sprintf("exit status %d", exitErr.ExitCode())
+		}
+		return &HookRejection{Reason: reason}
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("no answer within %s", timeout)
+	}
+	return runErr
+}
+
+type hooksRanKey struct{}
+
+// withHooksRan marks ctx as having run the hooks already, so the storage
+// wrapper does not run them a second time.
+func withHooksRan(ctx context.Context) context.Context {
+	return context.WithValue(ctx, hooksRanKey{}, true)
+}
+
+func hooksRan(ctx context.Context) bool {
+	ran, _ := ctx.Value(hooksRanKey{}).(bool)
+	return ran
+}
+
+// hookStore runs the hooks for changes made straight to the storage, like
+// those through S3 and WebDAV. Uploads are spooled to disk first when there
+// are pre_upload hooks, so they can look at and rewrite the content.
+type hookStore struct {
+	crates.Backend
+	bucket string
+	hooks  *Hooks
+}
+
+func (s hookStore) Upload(ctx context.Context, name string, r io.Reader) (*crates.FileInfo, error) {
+	if hooksRan(ctx) {
+		return s.Backend.Upload(ctx, name, r)
+	}
+	file := HookFile{Stage: HookPreUpload, Bucket: s.bucket, Name: name, Client: uploaderFrom(ctx)}
+	if s.hooks.has(HookPreUpload) {
+		spooled, err := s.hooks.spoolUpload(ctx, &file, r)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(spooled.Name())
+		defer spooled.Close()
+		r = spooled
+	}
+	info, err := s.Backend.Upload(ctx, name, r)
+	if err != nil {
+		return nil, err
+	}
+	file.Size, file.SHA256 = info.Size, info.SHA256
+	s.hooks.After(ctx, file)
+	return info, nil
+}
+
+// spoolUpload writes r to a temporary file, runs the pre_upload hooks on it
+// and opens the result.
+func (h *Hooks) spoolUpload(ctx context.Context, file *HookFile, r io.Reader) (*os.File, error) {
+	spool, err := os.CreateTemp(h.spool, "hook-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to spool upload: %w", err)
+	}
+	file.Path = spool.Name()
+	file.Size, err = io.Copy(spool, r)
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = h.Run(ctx, file)
+	}
+	var spooled *os.File
+	if err == nil {
+		spooled, err = os.Open(file.Path) // Anew, hooks may have replaced the file
+	}
+	if err != nil {
+		os.Remove(file.Path)
+		return nil, err
+	}
+	return spooled, nil
+}
+
+func (s hookStore) Delete(ctx context.Context, name string) error {
+	if !hooksRan(ctx) && s.hooks.has(HookPreDelete) {
+		info, err := s.Backend.Stat(ctx, name)
+		if err != nil {
+			return err
+		}
+		file := HookFile{Stage: HookPreDelete, Bucket: s.bucket, Name: name, Size: info.Size, SHA256: info.SHA256, Client: uploaderFrom(ctx)}
+		if err := s.hooks.Run(ctx, &file); err != nil {
+			return err
+		}
+	}
+	return s.Backend.Delete(ctx, name)
+}
+
+// hookBuckets hands out hook running backends for every bucket.
+type hookBuckets struct {
+	crates.Buckets
+	hooks *Hooks
+}
+
+func (b hookBuckets) Bucket(name string) crates.Backend {
+	return hookStore{Backend: b.Buckets.Bucket(name), bucket: name, hooks: b.hooks}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"tempo/crates"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/tiff"
+)
+
+// thumbBucket holds the resized variants of stored images, as
+// <bucket>/<image name>/<width>.<ext>.
+const thumbBucket = internalBucketPrefix + "thumbs"
+
+// imageHeaderSize is how much of an image is read to learn its dimensions
+// before the whole of it is.
+const imageHeaderSize = 1 << 20
+
+// errNotImage is returned for files the image pipeline cannot read.
+var errNotImage = errors.New("not a supported image")
+
+func init() {
+	// image/jpeg, image/png and image/gif register themselves
+	image.RegisterFormat("bmp", "BM", bmp.Decode, bmp.DecodeConfig)
+	image.RegisterFormat("tiff", "II*\x00", tiff.Decode, tiff.DecodeConfig)
+	image.RegisterFormat("tiff", "MM\x00*", tiff.Decode, tiff.DecodeConfig)
+}
+
+// isImage reports whether name has one of the supported image extensions.
+func isImage(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tif", ".tiff":
+		return true
+	}
+	return false
+}
+
+// thumbName is where the variant of name in bucket at width is stored in
+// thumbBucket. Images that may be transparent keep PNG, everything else
+// becomes JPEG.
+func thumbName(bucket, name string, width int) string {
+	ext := ".jpg"
+	switch strings.ToLower(path.Ext(name)) {
+	case ".png", ".gif":
+		ext = ".png"
+	}
+	return bucket + "/" + name + "/" + strconv.Itoa(width) + ext
+}
+
+// thumbWidth picks the configured width to serve for a requested one: the
+// smallest that is at least as wide, else the widest.
+func thumbWidth(widths []int, requested int) int {
+	sorted := slices.Sorted(slices.Values(widths))
+	for _, width := range sorted {
+		if width >= requested {
+			return width
+		}
+	}
+	return sorted[len(sorted)-1]
+}
+
+// makeThumb decodes the stored image name from bucket and writes a variant
+// at width to thumbBucket. Both go straight to the storage, so neither
+// counts as a client's download or upload.
+func (a *App) makeThumb(ctx context.Context, bucket, name string, width int) ([]byte, error) {
+	cfg := currentConfig().Images
+	store := a.internal.Bucket(bucket)
+	if err := checkImageSize(ctx, store, name, cfg.MaxMegapixels); err != nil {
+		return nil, err
+	}
+	var original bytes.Buffer
+	if _, err := store.Download(ctx, name, &original); err != nil {
+		return nil, err
+	}
+	data, err := resizeImage(original.Bytes(), width, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := a.internal.Bucket(thumbBucket).Upload(ctx, thumbName(bucket, name, width), bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to store thumbnail: %w", err)
+	}
+	return data, nil
+}
+
+// checkImageSize reads the dimensions from the first imageHeaderSize bytes
+// of name and refuses images over maxMegapixels, so they are never loaded
+// whole. Zero allows any size.
+func checkImageSize(ctx context.Context, store crates.Backend, name string, maxMegapixels int) error {
+	if maxMegapixels <= 0 {
+		return nil
+	}
+	var header bytes.Buffer
+	if _, err := store.DownloadRange(ctx, name, 0, imageHeaderSize, &header); err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(&header)
+	if err != nil {
+		return fmt.Errorf("%w: no dimensions in the first %d KB: %v", errNotImage, imageHeaderSize>>10, err)
+	}
+	if config.Width*config.Height > maxMegapixels*1_000_000 {
+		return fmt.Errorf("%w: larger than %d megapixels", errNotImage, maxMegapixels)
+	}
+	return nil
+}
+
+// resizeImage scales data down to width, turned upright when the JPEG says
+// it was taken rotated. Images that are narrower keep their size.
+func resizeImage(data []byte, width int, cfg ImagesConfig) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotImage, err)
+	}
+	if cfg.MaxMegapixels > 0 && config.Width*config.Height > cfg.MaxMegapixels*1_000_000 {
+		return nil, fmt.Errorf("%w: larger than %d megapixels", errNotImage, cfg.MaxMegapixels)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotImage, err)
+	}
+	if format == "jpeg" {
+		src = orient(src, jpegOrientation(data))
+	}
+
+	bounds := src.Bounds()
+	width = min(width, bounds.Dx())
+	height := max(1, int(math.Round(float64(bounds.Dy())*float64(width)/float64(bounds.Dx()))))
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	var out bytes.Buffer
+	if format == "png" || format == "gif" {
+		err = png.Encode(&out, dst)
+	} else {
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: cfg.Quality})
+	}
+	return out.Bytes(), err
+}
+
+// orient applies an EXIF orientation (1 to 8) to img.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if orientation >= 5 { // Rotated by 90 degrees, width and height swap
+		w, h = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = w-1-y, x
+			case 7:
+				dx, dy = w-1-y, h-1-x
+			case 8:
+				dx, dy = y, h-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG, 1 when it has none.
+func jpegOrientation(data []byte) int {
+	r := bufio.NewReader(bytes.NewReader(data))
+	orientation := 1
+	readJPEG(r, io.Discard, func(marker byte, payload []byte) []byte {
+		if marker == 0xe1 && bytes.HasPrefix(payload, exifHeader) {
+			orientation = exifOrientation(payload[len(exifHeader):])
+		}
+		return payload
+	})
+	return orientation
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifOrientation finds the orientation tag in the first IFD of a TIFF
+// structure, as found in EXIF.
+func exifOrientation(tiffData []byte) int {
+	if len(tiffData) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiffData[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiffData[4:]))
+	if ifd+2 > len(tiffData) {
+		return 1
+	}
+	count := int(order.Uint16(tiffData[ifd:]))
+	for i := range count {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiffData) {
+			break
+		}
+		if order.Uint16(tiffData[entry:]) == 0x0112 {
+			return int(order.Uint16(tiffData[entry+8:]))
+		}
+	}
+	return 1
+}
+
+// orientationExif is an EXIF block holding nothing but the orientation, so
+// stripped photos still display upright.
+func orientationExif(orientation int) []byte {
+	block := append([]byte{}, exifHeader...)
+	block = append(block, "MM\x00\x2a"...)
+	block = binary.BigEndian.AppendUint32(block, 8) // First IFD
+	block = binary.BigEndian.AppendUint16(block, 1) // One entry
+	block = binary.BigEndian.AppendUint16(block, 0x0112)
+	block = binary.BigEndian.AppendUint16(block, 3) // SHORT
+	block = binary.BigEndian.AppendUint32(block, 1)
+	block = binary.BigEndian.AppendUint16(block, uint16(orientation))
+	block = binary.BigEndian.AppendUint16(block, 0)
+	return binary.BigEndian.AppendUint32(block, 0) // No next IFD
+}
+
+// readJPEG copies a JPEG from r to w segment by segment until the image
+// data starts, which is copied as is. keep sees every marker segment before
+// the image data and returns the payload to write, or nil to drop it.
+func readJPEG(r *bufio.Reader, w io.Writer, keep func(marker byte, payload []byte) []byte) error {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(soi[:]); err != nil {
+		return err
+	}
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:2]); err != nil {
+			return err
+		}
+		if header[0] != 0xff {
+			return errNotImage
+		}
+		marker := header[1]
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			if _, err := w.Write(header[:2]); err != nil { // No payload
+				return err
+			}
+			continue
+		}
+		if _, err := io.ReadFull(r, header[2:]); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		if length < 2 {
+			return errNotImage
+		}
+		payload := make([]byte, length-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		if marker == 0xda { // Start of scan, the rest is image data
+			if _, err := w.Write(append(header[:], payload...)); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, r)
+			return err
+		}
+		if payload = keep(marker, payload); payload == nil {
+			continue
+		}
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)+2))
+		if _, err := w.Write(append(header[:], payload...)); err != nil {
+			return err
+		}
+	}
+}
+
+// stripJPEG drops EXIF (keeping only the orientation), XMP, IPTC and
+// comments from a JPEG without touching the image data.
+func stripJPEG(r *bufio.Reader, w io.Writer) error {
+	return readJPEG(r, w, func(marker byte, payload []byte) []byte {
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(payload, exifHeader):
+			if orientation := exifOrientation(payload[len(exifHeader):]); orientation > 1 && orientation <= 8 {
+				return orientationExif(orientation)
+			}
+			return nil
+		case marker == 0xe1, marker == 0xed, marker == 0xfe: // XMP, IPTC, comments
+			return nil
+		}
+		return payload
+	})
+}
+
+// pngMetadata are the chunks stripPNG drops.
+var pngMetadata = []string{"eXIf", "tEXt", "zTXt", "iTXt", "tIME"}
+
+// stripPNG drops the EXIF, text and time chunks from a PNG.
+func stripPNG(r *bufio.Reader, w io.Writer) error {
+	var signature [8]byte
+	if _, err := io.ReadFull(r, signature[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(signature[:]); err != nil {
+		return err
+	}
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4])) + 4 // With the CRC
+		if slices.Contains(pngMetadata, string(header[4:])) {
+			if _, err := io.CopyN(io.Discard, r, length); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, length); err != nil {
+			return err
+		}
+	}
+}
+
+// stripMetadata returns r with the metadata removed when name is a JPEG or
+// PNG and images.strip_metadata is set. Files that do not parse are left
+// as they are.
+func stripMetadata(name string, r io.Reader) io.Reader {
+	if !currentConfig().Images.StripMetadata {
+		return r
+	}
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(8)
+	var strip func(*bufio.Reader, io.Writer) error
+	switch {
+	case bytes.HasPrefix(magic, []byte{0xff, 0xd8, 0xff}):
+		strip = stripJPEG
+	case bytes.HasPrefix(magic, []byte("\x89PNG\r\n\x1a\n")):
+		strip = stripPNG
+	default:
+		return buffered
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(strip(buffered, writer))
+	}()
+	return reader
+}
+
+type strippedKey struct{}
+
+// withStripped marks ctx as uploading a file StoreFile stripped already.
+func withStripped(ctx context.Context) context.Context {
+	return context.WithValue(ctx, strippedKey{}, true)
+}
+
+func stripped(ctx context.Context) bool {
+	done, _ := ctx.Value(strippedKey{}).(bool)
+	return done
+}
+
+// imageStore strips image metadata from uploads made straight to the
+// storage, like those through S3 and WebDAV.
+type imageStore struct {
+	crates.Backend
+}
+
+func (s imageStore) Upload(ctx context.Context, name string, r io.Reader) (*crates.FileInfo, error) {
+	if stripped(ctx) {
+		return s.Backend.Upload(ctx, name, r)
+	}
+	return s.Backend.Upload(ctx, name, stripMetadata(name, r))
+}
+
+// imageBuckets hands out metadata stripping backends for every bucket.
+type imageBuckets struct {
+	crates.Buckets
+}
+
+func (b imageBuckets) Bucket(name string) crates.Backend {
+	return imageStore{Backend: b.Buckets.Bucket(name)}
+}
+
+// processImages keeps the thumbnails in line with the stored images until
+// ctx ends: made after uploads, removed after deletes and redone after
+// renames.
+func (a *App) processImages(ctx context.Context) {
+	lastID := uint64(math.MaxUint64) // New events only
+	missed, ch, unsubscribe := a.events.Subscribe(lastID)
+	defer func() { unsubscribe() }()
+	for {
+		for _, event := range missed {
+			a.imageEvent(ctx, event)
+			lastID = event.ID
+		}
+		missed = nil
+
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				// Fell behind while resizing, pick up again from the kept events
+				a.logger.Warn("Images: event subscriber fell behind, resuming", "last_event_id", lastID)
+				unsubscribe()
+				missed, ch, unsubscribe = a.events.Subscribe(lastID)
+				continue
+			}
+			a.imageEvent(ctx, event)
+			lastID = event.ID
+		}
+	}
+}
+
+func (a *App) imageEvent(ctx context.Context, event Event) {
+	if event.Bucket == "" {
+		return // Kept on the server only
+	}
+	switch event.Type {
+	case EventUploaded:
+		a.makeThumbs(ctx, event.Bucket, event.Name)
+	case EventDeleted, EventCleanedUp:
+		a.removeThumbs(ctx, event.Bucket, event.Name)
+	case EventRenamed:
+		a.removeThumbs(ctx, event.Bucket, event.From)
+		a.makeThumbs(ctx, event.Bucket, event.Name)
+	}
+}
+
+func (a *App) makeThumbs(ctx context.Context, bucket, name string) {
+	if !isImage(name) {
+		return
+	}
+	for _, width := range currentConfig().Images.Widths {
+		if _, err := a.makeThumb(ctx, bucket, name, width); err != nil {
+			a.logger.Warn("Failed to make thumbnail", "filename", name, "width", width, "error", err)
+			return
+		}
+	}
+	a.logger.Debug("Thumbnails made", "filename", name)
+}
+
+func (a *App) removeThumbs(ctx context.Context, bucket, name string) {
+	if !isImage(name) {
+		return
+	}
+	thumbs := a.internal.Bucket(thumbBucket)
+	for _, width := range currentConfig().Images.Widths {
+		if err := thumbs.Delete(ctx, thumbName(bucket, name, width)); err != nil && !errors.Is(err, crates.ErrNotFound) {
+			a.logger.Warn("Failed to remove thumbnail", "filename", name, "width", width, "error", err)
+		}
+	}
+}
+
+// serveThumb answers GET /api/v1/files/:name/thumb?w=, making the variant
+// right away when the pipeline has not got to it yet.
+func (a *App) serveThumb(ctx *gin.Context) {
+	name, err := cleanName(ctx.Param("name"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	widths := currentConfig().Images.Widths
+	if len(widths) == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Thumbnails are turned off"})
+		return
+	}
+	if !isImage(name) {
+		ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Not an image"})
+		return
+	}
+	requested, err := strconv.Atoi(ctx.DefaultQuery("w", "0"))
+	if err != nil || requested < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "w must be a width in pixels"})
+		return
+	}
+	width := thumbWidth(widths, requested)
+
+	bucket := crates.DefaultBucket()
+	var thumb bytes.Buffer
+	_, err = a.internal.Bucket(thumbBucket).Download(ctx.Request.Context(), thumbName(bucket, name, width), &thumb)
+	data := thumb.Bytes()
+	if errors.Is(err, crates.ErrNotFound) {
+		data, err = a.makeThumb(ctx.Request.Context(), bucket, name, width)
+	}
+	switch {
+	case errors.Is(err, crates.ErrNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	case errors.Is(err, errNotImage):
+		ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		reqLogger(a.logger, ctx).Error("Failed to make thumbnail", "filename", name, "width", width, "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to make thumbnail"})
+		return
+	}
+
+	ctx.Header("Cache-Control", "private, max-age=3600")
+	ctx.Header("X-Thumbnail-Of", name)
+	ctx.Data(http.StatusOK, http.DetectContentType(data), data)
+}
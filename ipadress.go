@@ -1,16 +1,36 @@
 package main
 
 import (
+	"cmp"
 	"fmt"
 	"net"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
 )
 
-func GetLocalIP() (string, error) {
+// LocalAddress is one address the server listens on, as reported to clients.
+type LocalAddress struct {
+	Interface string `json:"interface"`
+	IP        string `json:"ip"`
+	Family    string `json:"family"` // ipv4 or ipv6
+	Private   bool   `json:"private"`
+	URL       string `json:"url"`
+	Ignored   bool   `json:"ignored,omitempty"` // Matched a network.ignore rule
+}
+
+// LocalAddresses lists the addresses of every interface that is up, except
+// loopback and IPv6 link-local ones, which other machines cannot put in a
+// URL. Ignored interfaces come last; the rest are ordered by the prefer
+// rules, then IPv4 before IPv6 and private before public.
+func LocalAddresses(cfg *Config) ([]LocalAddress, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
+	var addresses []LocalAddress
 	for _, iface := range interfaces {
 		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
 			continue // Ignore down interfaces and loopback
@@ -18,7 +38,7 @@ func GetLocalIP() (string, error) {
 
 		addrs, err := iface.Addrs()
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
 		for _, addr := range addrs {
@@ -29,9 +49,80 @@ func GetLocalIP() (string, error) {
 			case *net.IPAddr:
 				ip = v.IP
 			}
-			if ip != nil && ip.IsPrivate() {
-				return ip.String(), nil
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
 			}
+			family := "ipv6"
+			if ip.To4() != nil {
+				family = "ipv4"
+			}
+			addresses = append(addresses, LocalAddress{
+				Interface: iface.Name,
+				IP:        ip.String(),
+				Family:    family,
+				Private:   ip.IsPrivate(),
+				URL:       "http://" + net.JoinHostPort(ip.String(), strconv.Itoa(cfg.Server.Port)) + "/",
+				Ignored:   matchInterface(cfg.Network.Ignore, iface.Name) < len(cfg.Network.Ignore),
+			})
+		}
+	}
+
+	slices.SortStableFunc(addresses, func(x, y LocalAddress) int {
+		return cmp.Or(
+			compareTrue(!x.Ignored, !y.Ignored),
+			cmp.Compare(matchInterface(cfg.Network.Prefer, x.Interface), matchInterface(cfg.Network.Prefer, y.Interface)),
+			compareTrue(x.Family == "ipv4", y.Family == "ipv4"),
+			compareTrue(x.Private, y.Private),
+		)
+	})
+	return addresses, nil
+}
+
+// matchInterface returns the index of the first pattern matching name, or
+// len(patterns) when none does.
+func matchInterface(patterns []string, name string) int {
+	for i, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return i
+		}
+	}
+	return len(patterns)
+}
+
+// compareTrue orders true before false.
+func compareTrue(x, y bool) int {
+	switch {
+	case x == y:
+		return 0
+	case x:
+		return -1
+	}
+	return 1
+}
+
+// preferredURL is the URL clients should open: network.public_url when set,
+// otherwise the first address that is not ignored.
+func preferredURL(cfg *Config, addresses []LocalAddress) string {
+	if cfg.Network.PublicURL != "" {
+		return strings.TrimSuffix(cfg.Network.PublicURL, "/") + "/"
+	}
+	for _, address := range addresses {
+		if !address.Ignored {
+			return address.URL
+		}
+	}
+	return fmt.Sprintf("http://localhost:%d/", cfg.Server.Port)
+}
+
+// GetLocalIP returns the preferred private address of the server.
+func GetLocalIP() (string, error) {
+	addresses, err := LocalAddresses(currentConfig())
+	if err != nil {
+		return "", err
+	}
+	for _, address := range addresses {
+		if address.Private && !address.Ignored {
+			return address.IP, nil
 		}
 	}
 	return "", fmt.Errorf("no private IP address found")
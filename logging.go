@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"tempo/crates"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// RequestIDHeader is the header used to receive and return request IDs.
+const RequestIDHeader = "X-Request-ID"
+
+// logLevel is shared by every handler so a config reload can change it.
+var logLevel slog.LevelVar
+
+// setupLogging builds the process-wide slog logger from the log settings. The
+// returned closer flushes and closes the rotated log file.
+func setupLogging(cfg LogConfig) (*slog.Logger, io.Closer) {
+	rotator := &lumberjack.Logger{
+		Filename:   cfg.File,
+		MaxSize:    cfg.MaxSizeMB,
+		MaxAge:     cfg.MaxAgeDays,
+		MaxBackups: cfg.MaxBackups,
+		Compress:   true,
+	}
+	out := io.MultiWriter(os.Stdout, rotator)
+
+	applyLogLevel(cfg.Level)
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	var handler slog.Handler
+	if cfg.Format == "text" {
+		handler = slog.NewTextHandler(out, opts)
+	} else {
+		handler = slog.NewJSONHandler(out, opts)
+	}
+
+	logger := slog.New(errorRecorder{Handler: handler})
+	// Also routes the standard log package, so stray log.Printf calls end up
+	// in the same structured stream
+	slog.SetDefault(logger)
+	return logger, rotator
+}
+
+// applyLogLevel sets the level of every handler; invalid values are rejected
+// by Config.Validate before they get here.
+func applyLogLevel(value string) {
+	if level, err := parseLevel(value); err == nil {
+		logLevel.Set(level)
+	}
+}
+
+func parseLevel(value string) (slog.Level, error) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown level %q", value)
+	}
+}
+
+// requestID assigns every request an ID (reusing a sane incoming one), returns
+// it in the response headers and stores it in the request context so the
+// storage layer logs it too.
+func requestID() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.GetHeader(RequestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+
+		ctx.Set("request_id", id)
+		ctx.Header(RequestIDHeader, id)
+		ctx.Request = ctx.Request.WithContext(crates.WithRequestID(ctx.Request.Context(), id))
+		trace.SpanFromContext(ctx.Request.Context()).SetAttributes(attribute.String("request.id", id))
+		ctx.Next()
+	}
+}
+
+// requestLogger writes one structured line per request, replacing Gin's
+// free-text access log.
+func requestLogger(logger *slog.Logger) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		path := ctx.Request.URL.Path
+		ctx.Next()
+
+		status := ctx.Writer.Status()
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		} else if status >= 400 {
+			level = slog.LevelWarn
+		}
+
+		attrs := []any{"request_id", ctx.GetString("request_id")}
+		if sc := trace.SpanContextFromContext(ctx.Request.Context()); sc.HasTraceID() {
+			attrs = append(attrs, "trace_id", sc.TraceID().String())
+		}
+		logger.Log(ctx.Request.Context(), level, "request", append(attrs,
+			"method", ctx.Request.Method,
+			"path", path,
+			"status", status,
+			"latency_ms", time.Since(start).Milliseconds(),
+			"client_ip", ctx.ClientIP(),
+			"bytes_out", ctx.Writer.Size(),
+		)...)
+	}
+}
+
+// reqLogger returns the logger annotated with the request ID of ctx.
+func reqLogger(logger *slog.Logger, ctx *gin.Context) *slog.Logger {
+	return logger.With("request_id", ctx.GetString("request_id"))
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,8 +1,7 @@
 package main
 
-
-
+import "os"
 
 func main() {
-	Server()
+	os.Exit(runCLI(os.Args[1:]))
 }
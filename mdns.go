@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// mdnsService is the DNS-SD service type servers advertise on the LAN.
+const mdnsService = "_servido._tcp"
+
+// version is reported to LAN clients; release builds set it with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// mdnsText is the TXT record of the advertisement. The JSON API and the web
+// UI always need a token, and TLS is left to a proxy in front.
+func mdnsText() []string {
+	return []string{
+		"version=" + version,
+		"auth=true",
+		"tls=false",
+		"path=/ui/",
+	}
+}
+
+// mdnsInstance is the advertised name, the host name unless configured.
+func mdnsInstance(cfg *Config) string {
+	if cfg.MDNS.Name != "" {
+		return cfg.MDNS.Name
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "tempo"
+	}
+	return "tempo on " + strings.Split(host, ".")[0]
+}
+
+// advertise announces the server over mDNS until the returned server is shut
+// down.
+func advertise(cfg *Config, logger *slog.Logger) (*zeroconf.Server, error) {
+	instance := mdnsInstance(cfg)
+	server, err := zeroconf.Register(instance, mdnsService, "local.", cfg.Server.Port, mdnsText(), nil)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Advertising on the LAN over mDNS", "service", mdnsService, "instance", instance)
+	return server, nil
+}
+
+// discovered is one server found on the LAN.
+type discovered struct {
+	Name      string            `json:"name"`
+	Host      string            `json:"host"`
+	URL       string            `json:"url"`
+	Addresses []string          `json:"addresses"`
+	Reachable bool              `json:"reachable"`
+	Text      map[string]string `json:"txt"`
+}
+
+func discoverCommand(args []string) int {
+	flags, opts := newClientFlags("discover")
+	timeout := flags.Duration("timeout", 3*time.Second, "how long to browse the LAN")
+	all := flags.Bool("all", false, "also list servers that do not answer")
+	if code, ok := parseClientFlags(flags, opts, args, 0); !ok {
+		return code
+	}
+
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return fail("discover", err)
+	}
+	ctx, stop := cliContext()
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Browse(ctx, mdnsService, "local.", entries); err != nil {
+		return fail("discover", err)
+	}
+
+	// Check every answer while browsing goes on
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	found := map[string]*discovered{}
+	for entry := range entries {
+		if _, seen := found[entry.Instance]; seen {
+			continue
+		}
+		server := &discovered{Name: unescapeInstance(entry.Instance), Host: strings.TrimSuffix(entry.HostName, "."), Text: map[string]string{}}
+		for _, txt := range entry.Text {
+			key, value, _ := strings.Cut(txt, "=")
+			server.Text[key] = value
+		}
+		for _, ip := range entry.AddrIPv4 {
+			server.Addresses = append(server.Addresses, net.JoinHostPort(ip.String(), strconv.Itoa(entry.Port)))
+		}
+		for _, ip := range entry.AddrIPv6 {
+			server.Addresses = append(server.Addresses, net.JoinHostPort(ip.String(), strconv.Itoa(entry.Port)))
+		}
+		found[entry.Instance] = server
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			url := probeServer(server.Addresses, server.Text["tls"] == "true")
+			mutex.Lock()
+			server.URL, server.Reachable = url, url != ""
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	servers := []*discovered{}
+	for _, server := range found {
+		if server.Reachable || *all {
+			servers = append(servers, server)
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+
+	if opts.json {
+		if err := printJSON(servers); err != nil {
+			return 1
+		}
+		return 0
+	}
+	if len(servers) == 0 {
+		fmt.Fprintln(os.Stderr, "No servers found")
+		return 1
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tURL\tVERSION\tAUTH\tTLS")
+	for _, server := range servers {
+		url := server.URL
+		if url == "" {
+			url = "unreachable (" + strings.Join(server.Addresses, ", ") + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", server.Name, url, server.Text["version"], server.Text["auth"], server.Text["tls"])
+	}
+	tw.Flush()
+	return 0
+}
+
+// unescapeInstance undoes the DNS escaping of spaces and dots in instance
+// names.
+func unescapeInstance(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+1 < len(name) {
+			i++
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+// probeServer returns the base URL of the first address answering /ping, or
+// "" if none does.
+func probeServer(addresses []string, tls bool) string {
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	for _, address := range addresses {
+		base := scheme + "://" + address
+		resp, err := client.Get(base + "/ping")
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return base
+		}
+	}
+	return ""
+}
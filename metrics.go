@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tempo_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tempo_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14), // 5ms .. ~40s
+	}, []string{"route", "method"})
+
+	grpcRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tempo_grpc_requests_total",
+		Help: "gRPC calls by method and status code.",
+	}, []string{"method", "code"})
+
+	grpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tempo_grpc_request_duration_seconds",
+		Help:    "gRPC call latency by method.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"method"})
+
+	bytesUploaded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tempo_uploaded_bytes_total",
+		Help: "Bytes received through the upload routes.",
+	})
+
+	bytesDownloaded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tempo_downloaded_bytes_total",
+		Help: "Bytes sent through the download route.",
+	})
+
+	downloadCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tempo_download_cache_total",
+		Help: "Downloads served from the local upload directory (hit) or fetched from GridFS (miss).",
+	}, []string{"result"})
+
+	cleanupRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tempo_cleanup_runs_total",
+		Help: "Background cleanup job runs by job and outcome.",
+	}, []string{"job", "outcome"})
+
+	scrubIssues = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tempo_scrub_issues",
+		Help: "Damaged files found by the last scrub pass.",
+	})
+
+	scrubOrphanChunks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tempo_scrub_orphan_chunks_removed_total",
+		Help: "Orphaned GridFS chunks removed by the scrubber.",
+	})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tempo_webhook_deliveries_total",
+		Help: "Webhook delivery attempts by result (delivered, retry or failed).",
+	}, []string{"result"})
+)
+
+// registerRuntimeMetrics exposes gauges that are computed when scraped: the
+// file queue depth, the download cache hit ratio and upload directory usage.
+func registerRuntimeMetrics(queueDepth func() int, uploadDir string) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tempo_file_queue_depth",
+		Help: "Files currently tracked in the server file queue.",
+	}, func() float64 { return float64(queueDepth()) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tempo_download_cache_hit_ratio",
+		Help: "Share of downloads served from the local upload directory.",
+	}, func() float64 {
+		hits := counterValue(downloadCache.WithLabelValues("hit"))
+		misses := counterValue(downloadCache.WithLabelValues("miss"))
+		if hits+misses == 0 {
+			return 0
+		}
+		return hits / (hits + misses)
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tempo_upload_dir_bytes",
+		Help: "Total size of the files in the upload directory.",
+	}, func() float64 {
+		size, _ := dirUsage(uploadDir)
+		return float64(size)
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tempo_upload_dir_files",
+		Help: "Number of files in the upload directory.",
+	}, func() float64 {
+		_, count := dirUsage(uploadDir)
+		return float64(count)
+	})
+}
+
+// metricsMiddleware counts requests and records their latency per route.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		// Use the route template so /down/:filename is one series, not one per file
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := ctx.Request.Method
+		httpRequests.WithLabelValues(route, method, strconv.Itoa(ctx.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// metricsHandler serves the Prometheus text exposition format.
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+// dirUsage returns the total size and number of regular files under dir.
+func dirUsage(dir string) (int64, int) {
+	var size int64
+	var count int
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+			count++
+		}
+		return nil
+	})
+	return size, count
+}
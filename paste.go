@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"tempo/crates"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gin-gonic/gin"
+)
+
+// pasteBucket holds the stored text of every paste, out of reach of the
+// file listings and downloads so burnt pastes really are gone.
+const pasteBucket = internalBucketPrefix + "pastes"
+
+// Paste is a text snippet stored as a file in pasteBucket.
+type Paste struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`               // Stored file
+	Language  string    `json:"language,omitempty"` // Chroma lexer name, plain text when empty
+	Size      int64     `json:"size"`
+	Burn      bool      `json:"burn"` // Deleted after the first view
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Views     int       `json:"views"`
+}
+
+// PasteStore keeps the pastes in memory and persists them to a JSON file,
+// like the share links.
+type PasteStore struct {
+	path   string
+	mutex  sync.Mutex
+	pastes map[string]*Paste
+}
+
+// NewPasteStore loads the pastes saved at path. Expired ones are kept so the
+// sweep removes their files.
+func NewPasteStore(path string) (*PasteStore, error) {
+	s := &PasteStore{path: path, pastes: make(map[string]*Paste)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read pastes: %w", err)
+	}
+
+	var saved []*Paste
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse pastes: %w", err)
+	}
+	for _, paste := range saved {
+		s.pastes[paste.ID] = paste
+	}
+	return s, nil
+}
+
+// NewID returns an unused short ID.
+func (s *PasteStore) NewID() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for {
+		id := make([]byte, 6)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		encoded := base64.RawURLEncoding.EncodeToString(id)
+		if _, taken := s.pastes[encoded]; !taken {
+			return encoded, nil
+		}
+	}
+}
+
+// Add records a paste whose text is already stored.
+func (s *PasteStore) Add(paste *Paste) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pastes[paste.ID] = paste
+	return s.save()
+}
+
+// Open returns the paste for id, or false if it is unknown or expired.
+func (s *PasteStore) Open(id string) (Paste, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	paste, ok := s.pastes[id]
+	if !ok || time.Now().After(paste.ExpiresAt) {
+		return Paste{}, false
+	}
+	return *paste, true
+}
+
+// View counts a view of the paste id once its text was read, or returns
+// false if it is gone meanwhile. A burn-after-reading paste is forgotten, so
+// only one viewer ever gets it.
+func (s *PasteStore) View(id string) (Paste, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	paste, ok := s.pastes[id]
+	if !ok {
+		return Paste{}, false
+	}
+	paste.Views++
+	if paste.Burn {
+		delete(s.pastes, id)
+	}
+	s.save()
+	return *paste, true
+}
+
+// Remove forgets the paste id.
+func (s *PasteStore) Remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.pastes, id)
+	s.save()
+}
+
+// Expired forgets and returns the pastes past their expiry.
+func (s *PasteStore) Expired() []Paste {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var expired []Paste
+	now := time.Now()
+	for id, paste := range s.pastes {
+		if now.After(paste.ExpiresAt) {
+			expired = append(expired, *paste)
+			delete(s.pastes, id)
+		}
+	}
+	if len(expired) > 0 {
+		s.save()
+	}
+	return expired
+}
+
+// save writes the pastes to disk; the caller holds the mutex.
+func (s *PasteStore) save() error {
+	list := make([]*Paste, 0, len(s.pastes))
+	for _, paste := range s.pastes {
+		list = append(list, paste)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// pasteLexer finds the lexer for a language given by the client, or guesses
+// it from the text when none is given. It returns nil for unknown languages.
+func pasteLexer(language, text string) chroma.Lexer {
+	if language != "" {
+		return lexers.Get(language)
+	}
+	if lexer := lexers.Analyse(text); lexer != nil {
+		return lexer
+	}
+	return lexers.Fallback
+}
+
+// pasteExtension picks a file extension from the lexer's file patterns, so
+// the stored file opens in the right editor.
+func pasteExtension(lexer chroma.Lexer) string {
+	for _, pattern := range lexer.Config().Filenames {
+		if ext := path.Ext(pattern); strings.HasPrefix(pattern, "*.") && !strings.ContainsAny(ext, "*?[") {
+			return ext
+		}
+	}
+	return ".txt"
+}
+
+// createPaste answers POST /api/v1/paste. The body is the raw text; the
+// lang, ttl and burn query parameters are optional.
+func (a *App) createPaste(ctx *gin.Context) {
+	pasteCfg := currentConfig().Paste
+	maxBytes := int64(pasteCfg.MaxSizeKB) * 1024
+	text, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxBytes+1))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read paste"})
+		return
+	}
+	switch {
+	case len(text) == 0:
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Expected the text in the request body"})
+		return
+	case int64(len(text)) > maxBytes:
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Pastes are limited to %d KB", pasteCfg.MaxSizeKB)})
+		return
+	case !utf8.Valid(text):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Pastes must be UTF-8 text"})
+		return
+	}
+
+	ttl := pasteCfg.DefaultTTL
+	if value := ctx.Query("ttl"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be a positive duration such as 1h"})
+			return
+		}
+		ttl = min(parsed, pasteCfg.MaxTTL)
+	}
+	burn := false
+	if value := ctx.Query("burn"); value != "" {
+		if burn, err = strconv.ParseBool(value); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "burn must be true or false"})
+			return
+		}
+	}
+	lexer := pasteLexer(ctx.Query("lang"), string(text))
+	if lexer == nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Unknown language " + strconv.Quote(ctx.Query("lang"))})
+		return
+	}
+	language := ""
+	if lexer != lexers.Fallback {
+		language = lexer.Config().Name
+	}
+
+	id, err := a.pastes.NewID()
+	if err != nil {
+		reqLogger(a.logger, ctx).Error("Failed to create paste ID", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create paste"})
+		return
+	}
+	name := id + pasteExtension(lexer)
+	info, err := a.internal.Bucket(pasteBucket).Upload(ctx.Request.Context(), name, bytes.NewReader(text))
+	if err != nil {
+		reqLogger(a.logger, ctx).Error("Failed to store paste", "filename", name, "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store paste"})
+		return
+	}
+	written := info.Size
+
+	now := time.Now().UTC()
+	paste := &Paste{ID: id, Name: name, Language: language, Size: written, Burn: burn, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	if err := a.pastes.Add(paste); err != nil {
+		reqLogger(a.logger, ctx).Error("Failed to save paste", "id", id, "error", err)
+		a.pastes.Remove(id)
+		a.removePaste(context.WithoutCancel(ctx.Request.Context()), *paste)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create paste"})
+		return
+	}
+
+	reqLogger(a.logger, ctx).Info("Paste created", "id", id, "language", language, "bytes", written, "burn", burn)
+	link := requestBaseURL(ctx) + "/p/" + url.PathEscape(id)
+	ctx.JSON(http.StatusCreated, gin.H{
+		"id":         id,
+		"name":       name,
+		"language":   language,
+		"size":       written,
+		"burn":       burn,
+		"expires_at": paste.ExpiresAt,
+		"url":        link,
+		"raw_url":    link + "/raw",
+	})
+}
+
+// viewPaste answers GET /p/:id and /p/:id/raw without authentication.
+// Browsers get the highlighted HTML view unless raw is asked for; other
+// clients get the text. For a burn-after-reading paste, browsers first get
+// a page asking to confirm with a POST, so link previews do not burn it.
+func (a *App) viewPaste(raw bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		paste, ok := a.pastes.Open(ctx.Param("id"))
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Paste not found or expired"})
+			return
+		}
+		html := !raw && strings.Contains(ctx.GetHeader("Accept"), "text/html")
+		if paste.Burn && html && ctx.Request.Method != http.MethodPost {
+			var page bytes.Buffer
+			if err := pasteConfirmPage.Execute(&page, paste); err != nil {
+				reqLogger(a.logger, ctx).Error("Failed to render paste confirmation", "id", paste.ID, "error", err)
+				ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read paste"})
+				return
+			}
+			ctx.Header("Cache-Control", "no-store")
+			ctx.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+			return
+		}
+
+		var text bytes.Buffer
+		_, err := a.internal.Bucket(pasteBucket).Download(ctx.Request.Context(), paste.Name, &text)
+		if errors.Is(err, crates.ErrNotFound) {
+			a.pastes.Remove(paste.ID) // Deleted from the storage meanwhile
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Paste not found or expired"})
+			return
+		} else if err != nil {
+			reqLogger(a.logger, ctx).Error("Failed to read paste", "id", paste.ID, "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read paste"})
+			return
+		}
+		// Only now that the text is read does the view count, and burn
+		if paste, ok = a.pastes.View(paste.ID); !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Paste not found or expired"})
+			return
+		}
+		if paste.Burn {
+			a.removePaste(context.WithoutCancel(ctx.Request.Context()), paste)
+			ctx.Header("Cache-Control", "no-store")
+		}
+
+		if !html {
+			ctx.Data(http.StatusOK, "text/plain; charset=utf-8", text.Bytes())
+			return
+		}
+		page, err := renderPaste(paste, text.String())
+		if err != nil {
+			reqLogger(a.logger, ctx).Error("Failed to highlight paste", "id", paste.ID, "error", err)
+			ctx.Data(http.StatusOK, "text/plain; charset=utf-8", text.Bytes())
+			return
+		}
+		ctx.Data(http.StatusOK, "text/html; charset=utf-8", page)
+	}
+}
+
+// removePaste deletes the stored text of a burnt or expired paste.
+func (a *App) removePaste(ctx context.Context, paste Paste) {
+	if err := a.internal.Bucket(pasteBucket).Delete(ctx, paste.Name); err != nil && !errors.Is(err, crates.ErrNotFound) {
+		a.logger.Error("Failed to remove paste", "id", paste.ID, "filename", paste.Name, "error", err)
+	}
+}
+
+// expirePastes removes expired pastes every minute until ctx ends.
+func (a *App) expirePastes(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired := a.pastes.Expired()
+			for _, paste := range expired {
+				a.removePaste(ctx, paste)
+			}
+			if len(expired) > 0 {
+				a.logger.Info("Expired pastes removed", "count", len(expired))
+				recordCleanup("paste_expiry", "success", fmt.Sprintf("%d pastes", len(expired)))
+			}
+		}
+	}
+}
+
+var pastePage = template.Must(template.New("paste").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <meta name="robots" content="noindex">
+  <title>Paste {{.Paste.ID}}</title>
+  <link rel="stylesheet" href="/ui/style.css">
+  <style>{{.CSS}}</style>
+</head>
+<body>
+  <header>
+    <h1>Paste {{.Paste.ID}}</h1>
+    <nav><span>{{with .Paste.Language}}{{.}}{{else}}Plain text{{end}}</span></nav>
+    <div class="actions"><a class="button" href="/p/{{.Paste.ID}}/raw">Raw</a></div>
+  </header>
+  <main>
+    {{if .Paste.Burn}}<p class="error">This paste was deleted after this view.</p>
+    {{else}}<p class="empty">Expires {{.Paste.ExpiresAt.Format "2006-01-02 15:04 MST"}}</p>{{end}}
+    {{.Code}}
+  </main>
+</body>
+</html>
+`))
+
+var pasteConfirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <meta name="robots" content="noindex">
+  <title>Paste {{.ID}}</title>
+  <link rel="stylesheet" href="/ui/style.css">
+</head>
+<body>
+  <header>
+    <h1>Paste {{.ID}}</h1>
+  </header>
+  <main>
+    <p class="error">This paste is deleted once it has been viewed.</p>
+    <form method="post" action="/p/{{.ID}}"><button type="submit">View and delete</button></form>
+  </main>
+</body>
+</html>
+`))
+
+// renderPaste builds the HTML view of a paste with syntax highlighting.
+func renderPaste(paste Paste, text string) ([]byte, error) {
+	lexer := lexers.Fallback
+	if paste.Language != "" {
+		if found := lexers.Get(paste.Language); found != nil {
+			lexer = found
+		}
+	}
+	tokens, err := chroma.Coalesce(lexer).Tokenise(nil, text)
+	if err != nil {
+		return nil, err
+	}
+	formatter := chromahtml.New(chromahtml.WithClasses(true), chromahtml.WithLineNumbers(true), chromahtml.WithLinkableLineNumbers(true, "L"))
+	style := styles.Get("github")
+	var code, css bytes.Buffer
+	if err := formatter.Format(&code, style, tokens); err != nil {
+		return nil, err
+	}
+	if err := formatter.WriteCSS(&css, style); err != nil {
+		return nil, err
+	}
+
+	var page bytes.Buffer
+	err = pastePage.Execute(&page, map[string]any{
+		"Paste": paste,
+		"CSS":   template.CSS(css.String()),
+		"Code":  template.HTML(code.String()),
+	})
+	return page.Bytes(), err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// progress draws a transfer progress bar on stderr. A nil *progress is valid
+// and draws nothing, which is what quiet mode and non-terminals get.
+type progress struct {
+	out   io.Writer
+	label string
+	total int64 // -1 while unknown
+	done  int64
+	start time.Time
+	drawn time.Time
+}
+
+// newProgress returns a bar for label, or nil when it should not be shown.
+func newProgress(label string, total int64, quiet bool) *progress {
+	if quiet || !isTerminal(os.Stderr) {
+		return nil
+	}
+	return &progress{out: os.Stderr, label: label, total: total, start: time.Now()}
+}
+
+// isTerminal reports whether f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// SetTotal sets the expected size once it is known.
+func (p *progress) SetTotal(total int64) {
+	if p != nil {
+		p.total = total
+	}
+}
+
+// Write counts transferred bytes so the bar can be used with io.TeeReader
+// and io.MultiWriter.
+func (p *progress) Write(b []byte) (int, error) {
+	if p != nil {
+		p.done += int64(len(b))
+		if time.Since(p.drawn) > 100*time.Millisecond {
+			p.draw()
+		}
+	}
+	return len(b), nil
+}
+
+// Finish draws the final state and ends the line.
+func (p *progress) Finish() {
+	if p != nil {
+		p.draw()
+		fmt.Fprintln(p.out)
+	}
+}
+
+func (p *progress) draw() {
+	p.drawn = time.Now()
+	rate := float64(p.done) / max(time.Since(p.start).Seconds(), 0.001)
+
+	if p.total <= 0 {
+		fmt.Fprintf(p.out, "\r%-30s %10s  %10s/s", p.label, formatBytes(p.done), formatBytes(int64(rate)))
+		return
+	}
+	const width = 30
+	ratio := min(float64(p.done)/float64(p.total), 1)
+	filled := int(ratio * width)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	fmt.Fprintf(p.out, "\r%-30s [%s] %3.0f%% %10s  %10s/s", p.label, bar, ratio*100, formatBytes(p.done), formatBytes(int64(rate)))
+}
+
+// formatBytes renders n with a binary unit, e.g. 1.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"tempo/crates"
+)
+
+// errQuotaExceeded is returned when storing a file would break a quota.
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// checkQuota reports whether name can be stored with size bytes. The file
+// it replaces, if any, does not count against the total.
+func checkQuota(ctx context.Context, store crates.Backend, name string, size int64) error {
+	quota := currentConfig().Quota
+	if quota.MaxFileMB > 0 && size > int64(quota.MaxFileMB)<<20 {
+		return fmt.Errorf("%w: files may be at most %d MB", errQuotaExceeded, quota.MaxFileMB)
+	}
+	if quota.MaxTotalMB <= 0 {
+		return nil
+	}
+
+	infos, err := store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check quota: %w", err)
+	}
+	total := size
+	for _, info := range infos {
+		if info.Name != name {
+			total += info.Size
+		}
+	}
+	if total > int64(quota.MaxTotalMB)<<20 {
+		return fmt.Errorf("%w: storage is limited to %d MB", errQuotaExceeded, quota.MaxTotalMB)
+	}
+	return nil
+}
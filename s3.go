@@ -0,0 +1,867 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"tempo/crates"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+var (
+	errS3NoSuchBucket     = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist."}
+	errS3NoSuchKey        = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errS3NoSuchUpload     = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist."}
+	errS3InvalidBucket    = &s3Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid."}
+	errS3InvalidKey       = &s3Error{http.StatusBadRequest, "InvalidArgument", "The object key cannot be stored by this server."}
+	errS3InvalidPart      = &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found."}
+	errS3InvalidOrder     = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order."}
+	errS3InvalidRange     = &s3Error{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable."}
+	errS3Precondition     = &s3Error{http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the preconditions you specified did not hold."}
+	errS3MalformedXML     = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed."}
+	errS3BadMD5           = &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what was received."}
+	errS3TooLarge         = &s3Error{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size."}
+	errS3QuotaExceeded    = &s3Error{http.StatusInsufficientStorage, "QuotaExceeded", "The storage quota is exceeded."}
+	errS3NotImplemented   = &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+	errS3MethodNotAllowed = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	errS3Internal         = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+)
+
+// s3BucketName matches the bucket names accepted, which are also used as
+// GridFS bucket names.
+var s3BucketName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// s3Unsupported are subresources answered with NotImplemented.
+var s3Unsupported = []string{"acl", "policy", "tagging", "versioning", "versions", "lifecycle", "cors", "website", "encryption", "object-lock", "retention", "legal-hold"}
+
+// s3Auth verifies the SigV4 signature of every request.
+func (a *App) s3Auth(ctx *gin.Context) {
+	key, err := verifySigV4(ctx.Request, currentConfig().S3.Region)
+	if err != nil {
+		a.writeS3Error(ctx, err)
+		ctx.Abort()
+		return
+	}
+	ctx.Request = ctx.Request.WithContext(withUploader(ctx.Request.Context(), key.label()))
+	ctx.Next()
+}
+
+// writeS3Error answers with the S3 XML error for err.
+func (a *App) writeS3Error(ctx *gin.Context, err error) {
+	var s3err *s3Error
+	switch {
+	case errors.As(err, &s3err):
+	case errors.Is(err, crates.ErrNotFound):
+		s3err = errS3NoSuchKey
+	case errors.Is(err, errQuotaExceeded):
+		s3err = errS3QuotaExceeded
+	case errors.Is(err, errInvalidName):
+		s3err = errS3InvalidKey
+	case errors.Is(err, errHookRejected):
+		s3err = &s3Error{errS3AccessDenied.Status, errS3AccessDenied.Code, err.Error()}
+	default:
+		reqLogger(a.logger, ctx).Error("S3 request failed", "error", err)
+		s3err = errS3Internal
+	}
+
+	if ctx.Request.Method == http.MethodHead {
+		ctx.Status(s3err.Status) // HEAD answers carry no body
+		return
+	}
+	ctx.XML(s3err.Status, struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string
+		Message   string
+		Resource  string
+		RequestId string
+	}{Code: s3err.Code, Message: s3err.Message, Resource: ctx.Request.URL.Path, RequestId: ctx.GetString("request_id")})
+}
+
+// registerS3 routes every path-style S3 request, /bucket/key, on r.
+func (a *App) registerS3(r *gin.Engine) {
+	r.Use(func(ctx *gin.Context) {
+		ctx.Header("x-amz-request-id", ctx.GetString("request_id"))
+		ctx.Next()
+	})
+	r.Any("/*path", a.s3Auth, a.s3Handler)
+}
+
+// s3Handler dispatches on the bucket, key, method and query subresources.
+func (a *App) s3Handler(ctx *gin.Context) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(ctx.Request.URL.Path, "/"), "/")
+	query := ctx.Request.URL.Query()
+	method := ctx.Request.Method
+
+	if bucket == "" {
+		if method != http.MethodGet {
+			a.writeS3Error(ctx, errS3MethodNotAllowed)
+			return
+		}
+		a.s3ListBuckets(ctx)
+		return
+	}
+	if !s3BucketName.MatchString(bucket) || strings.Contains(bucket, "..") {
+		a.writeS3Error(ctx, errS3InvalidBucket)
+		return
+	}
+	for _, sub := range s3Unsupported {
+		if query.Has(sub) {
+			a.writeS3Error(ctx, errS3NotImplemented)
+			return
+		}
+	}
+
+	if key == "" {
+		switch {
+		case method == http.MethodGet && query.Has("location"):
+			ctx.XML(http.StatusOK, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+				Region  string   `xml:",chardata"`
+			}{Xmlns: s3Namespace, Region: currentConfig().S3.Region})
+		case method == http.MethodGet && query.Has("uploads"):
+			a.writeS3Error(ctx, errS3NotImplemented)
+		case method == http.MethodGet:
+			a.s3ListObjects(ctx, bucket)
+		case method == http.MethodHead:
+			if err := a.s3BucketExists(ctx, bucket); err != nil {
+				a.writeS3Error(ctx, err)
+				return
+			}
+			ctx.Header("x-amz-bucket-region", currentConfig().S3.Region)
+			ctx.Status(http.StatusOK)
+		case method == http.MethodPut:
+			if err := a.buckets.Create(ctx.Request.Context(), bucket); err != nil {
+				a.writeS3Error(ctx, err)
+				return
+			}
+			ctx.Header("Location", "/"+bucket)
+			ctx.Status(http.StatusOK)
+		case method == http.MethodPost && query.Has("delete"):
+			a.s3DeleteObjects(ctx, bucket)
+		default:
+			a.writeS3Error(ctx, errS3MethodNotAllowed)
+		}
+		return
+	}
+
+	if !s3ValidKey(key) {
+		a.writeS3Error(ctx, errS3InvalidKey)
+		return
+	}
+	uploadID := query.Get("uploadId")
+	switch {
+	case method == http.MethodPut && ctx.GetHeader("x-amz-copy-source") != "":
+		a.writeS3Error(ctx, errS3NotImplemented)
+	case method == http.MethodPut && uploadID != "":
+		a.s3UploadPart(ctx, bucket, key, uploadID, query.Get("partNumber"))
+	case method == http.MethodPut:
+		a.s3PutObject(ctx, bucket, key)
+	case method == http.MethodGet, method == http.MethodHead:
+		a.s3GetObject(ctx, bucket, key)
+	case method == http.MethodDelete && uploadID != "":
+		a.s3AbortUpload(ctx, bucket, key, uploadID)
+	case method == http.MethodDelete:
+		if err := a.s3Delete(ctx, bucket, key); err != nil {
+			a.writeS3Error(ctx, err)
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	case method == http.MethodPost && query.Has("uploads"):
+		a.s3CreateUpload(ctx, bucket, key)
+	case method == http.MethodPost && uploadID != "":
+		a.s3CompleteUpload(ctx, bucket, key, uploadID)
+	default:
+		a.writeS3Error(ctx, errS3MethodNotAllowed)
+	}
+}
+
+// s3ValidKey reports whether key is stored under its own name, which
+// cleanName leaves alone.
+func s3ValidKey(key string) bool {
+	name, err := cleanName(key)
+	return err == nil && name == key
+}
+
+// s3Delete removes key from bucket; a missing key is not an error. In the
+// default bucket it goes through RemoveFile, so the upload directory copy,
+// the queue entry and the share links go too.
+func (a *App) s3Delete(ctx *gin.Context, bucket, key string) error {
+	var err error
+	if bucket == crates.DefaultBucket() {
+		err = a.RemoveFile(ctx.Request.Context(), key)
+	} else {
+		err = a.buckets.Bucket(bucket).Delete(ctx.Request.Context(), key)
+	}
+	if errors.Is(err, crates.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// s3BucketExists returns errS3NoSuchBucket unless bucket is listed.
+func (a *App) s3BucketExists(ctx *gin.Context, bucket string) error {
+	names, err := a.buckets.Names(ctx.Request.Context())
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == bucket {
+			return nil
+		}
+	}
+	return errS3NoSuchBucket
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+func (a *App) s3ListBuckets(ctx *gin.Context) {
+	names, err := a.buckets.Names(ctx.Request.Context())
+	if err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	out := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   s3Owner
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Owner: s3Owner{ID: "tempo", DisplayName: "tempo"}}
+	created := time.Unix(0, 0).UTC().Format(time.RFC3339) // GridFS does not record it
+	for _, name := range names {
+		out.Buckets = append(out.Buckets, bucket{Name: name, CreationDate: created})
+	}
+	ctx.XML(http.StatusOK, out)
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+// s3ListObjects answers ListObjectsV2 (list-type=2) and the original
+// ListObjects, which pages with a marker instead of a continuation token.
+func (a *App) s3ListObjects(ctx *gin.Context, bucket string) {
+	query := ctx.Request.URL.Query()
+	if err := a.s3BucketExists(ctx, bucket); err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	v2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := 1000
+	if value := query.Get("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			a.writeS3Error(ctx, &s3Error{http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer."})
+			return
+		}
+		maxKeys = min(n, 1000)
+	}
+	after := query.Get("marker")
+	if v2 {
+		after = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				a.writeS3Error(ctx, &s3Error{http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect."})
+				return
+			}
+			after = string(decoded)
+		}
+	}
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+	}
+
+	infos, err := a.buckets.Bucket(bucket).List(ctx.Request.Context())
+	if err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	var contents []s3Object
+	var prefixes []s3Prefix
+	seen := make(map[string]bool)
+	truncated, last := false, ""
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name, prefix) || info.Name <= after {
+			continue
+		}
+		// Keys sharing the part up to the delimiter are rolled up into one prefix
+		entry := info.Name
+		if delimiter != "" {
+			if i := strings.Index(info.Name[len(prefix):], delimiter); i >= 0 {
+				entry = info.Name[:len(prefix)+i+len(delimiter)]
+				if seen[entry] || entry <= after {
+					continue
+				}
+			}
+		}
+		if len(contents)+len(prefixes) >= maxKeys {
+			truncated = true
+			break
+		}
+		if entry != info.Name {
+			seen[entry] = true
+			prefixes = append(prefixes, s3Prefix{Prefix: encode(entry)})
+			last = entry
+			continue
+		}
+		contents = append(contents, s3Object{
+			Key:          encode(info.Name),
+			LastModified: info.UploadedAt.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         s3ETag(info),
+			Size:         info.Size,
+			StorageClass: "STANDARD",
+		})
+		last = info.Name
+	}
+
+	type result struct {
+		XMLName               xml.Name   `xml:"ListBucketResult"`
+		Xmlns                 string     `xml:"xmlns,attr"`
+		Name                  string     `xml:"Name"`
+		Prefix                string     `xml:"Prefix"`
+		Delimiter             string     `xml:"Delimiter,omitempty"`
+		MaxKeys               int        `xml:"MaxKeys"`
+		EncodingType          string     `xml:"EncodingType,omitempty"`
+		IsTruncated           bool       `xml:"IsTruncated"`
+		Marker                *string    `xml:"Marker"`
+		NextMarker            string     `xml:"NextMarker,omitempty"`
+		KeyCount              *int       `xml:"KeyCount"`
+		ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+		StartAfter            string     `xml:"StartAfter,omitempty"`
+		Contents              []s3Object `xml:"Contents"`
+		CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+	}
+	out := result{
+		Xmlns:          s3Namespace,
+		Name:           bucket,
+		Prefix:         encode(prefix),
+		Delimiter:      encode(delimiter),
+		MaxKeys:        maxKeys,
+		EncodingType:   query.Get("encoding-type"),
+		IsTruncated:    truncated,
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	}
+	if v2 {
+		count := len(contents) + len(prefixes)
+		out.KeyCount = &count
+		out.ContinuationToken = query.Get("continuation-token")
+		out.StartAfter = encode(query.Get("start-after"))
+		if truncated {
+			out.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else {
+		marker := encode(query.Get("marker"))
+		out.Marker = &marker
+		if truncated {
+			out.NextMarker = encode(last)
+		}
+	}
+	ctx.XML(http.StatusOK, out)
+}
+
+// s3ETag is the quoted MD5 of a stored file, as S3 clients expect.
+func s3ETag(info crates.FileInfo) string {
+	if info.MD5 == "" {
+		return `"` + info.SHA256 + `"` // Stored before MD5 sums were kept
+	}
+	return `"` + info.MD5 + `"`
+}
+
+// s3Spool saves the request body to a temporary file, which verifies the
+// payload signature before anything is stored, and checks Content-MD5.
+func (a *App) s3Spool(ctx *gin.Context, dir string) (*os.File, string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, "", err
+	}
+	file, err := os.CreateTemp(dir, "s3-*")
+	if err != nil {
+		return nil, "", err
+	}
+	fail := func(err error) (*os.File, string, error) {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, "", err
+	}
+
+	sum := md5.New()
+	body := io.Reader(ctx.Request.Body)
+	if limit := currentConfig().Quota.MaxFileMB; limit > 0 {
+		body = io.LimitReader(body, int64(limit)<<20+1)
+	}
+	written, err := io.Copy(io.MultiWriter(file, sum), body)
+	if err != nil {
+		return fail(err)
+	}
+	if limit := currentConfig().Quota.MaxFileMB; limit > 0 && written > int64(limit)<<20 {
+		return fail(errS3TooLarge)
+	}
+	if want := ctx.GetHeader("Content-MD5"); want != "" && want != base64.StdEncoding.EncodeToString(sum.Sum(nil)) {
+		return fail(errS3BadMD5)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return file, hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// s3Remove closes and removes a spooled file.
+func s3Remove(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+func (a *App) s3PutObject(ctx *gin.Context, bucket, key string) {
+	store := a.buckets.Bucket(bucket)
+	if ctx.Request.ContentLength > 0 {
+		// Refuse before reading the body when the size is known
+		if err := checkQuota(ctx.Request.Context(), store, key, ctx.Request.ContentLength); err != nil {
+			a.writeS3Error(ctx, err)
+			return
+		}
+	}
+
+	file, _, err := a.s3Spool(ctx, filepath.Join(a.workDir, "s3-tmp"))
+	if err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	defer s3Remove(file)
+	stat, err := file.Stat()
+	if err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	info, err := a.s3Store(ctx, bucket, key, file, stat.Size())
+	if err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	ctx.Header("ETag", s3ETag(*info))
+	ctx.Status(http.StatusOK)
+}
+
+// s3Store checks the quota and uploads r to bucket as key. An upload
+// directory copy of a replaced file in the default bucket is dropped.
+func (a *App) s3Store(ctx *gin.Context, bucket, key string, r io.Reader, size int64) (*crates.FileInfo, error) {
+	store := a.buckets.Bucket(bucket)
+	if err := checkQuota(ctx.Request.Context(), store, key, size); err != nil {
+		return nil, err
+	}
+	info, err := store.Upload(ctx.Request.Context(), key, r)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == crates.DefaultBucket() {
+		a.dropLocalCopy(key)
+	}
+	bytesUploaded.Add(float64(size))
+	reqLogger(a.logger, ctx).Info("S3 object stored", "bucket", bucket, "key", key, "bytes", size)
+	return info, nil
+}
+
+// s3GetObject serves GET and HEAD. The object is streamed from the storage,
+// a single Range fetching only the chunks holding it; conditional requests
+// are answered from the stored ETag and upload time.
+func (a *App) s3GetObject(ctx *gin.Context, bucket, key string) {
+	store := a.buckets.Bucket(bucket)
+	info, err := store.Stat(ctx.Request.Context(), key)
+	if err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	etag := s3ETag(*info)
+	ctx.Header("ETag", etag)
+	ctx.Header("Accept-Ranges", "bytes")
+	ctx.Header("Last-Modified", info.UploadedAt.UTC().Format(http.TimeFormat))
+	ctx.Header("Content-Type", "application/octet-stream")
+	switch s3Precondition(ctx.Request, etag, info.UploadedAt) {
+	case http.StatusPreconditionFailed:
+		a.writeS3Error(ctx, errS3Precondition)
+		return
+	case http.StatusNotModified:
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+
+	status, offset, length := http.StatusOK, int64(0), info.Size
+	if spec := ctx.GetHeader("Range"); spec != "" && s3IfRange(ctx.Request, etag) {
+		var ok bool
+		offset, length, ok = s3ParseRange(spec, info.Size)
+		if !ok {
+			ctx.Header("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			a.writeS3Error(ctx, errS3InvalidRange)
+			return
+		}
+		if length < info.Size {
+			status = http.StatusPartialContent
+			ctx.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size))
+		}
+	}
+	ctx.Header("Content-Length", strconv.FormatInt(length, 10))
+	ctx.Status(status)
+	if ctx.Request.Method == http.MethodHead {
+		return
+	}
+
+	n, err := store.DownloadRange(ctx.Request.Context(), key, offset, length, ctx.Writer)
+	bytesDownloaded.Add(float64(n))
+	if err != nil {
+		// The status is sent, all that is left is cutting the response short
+		reqLogger(a.logger, ctx).Error("S3 object download failed", "bucket", bucket, "key", key, "error", err)
+		ctx.Abort()
+	}
+}
+
+// s3ParseRange returns the offset and length of a "bytes=" Range for an
+// object of size bytes. Several ranges, or a malformed header, are answered
+// with the whole object as HTTP allows; ok is false only when the range
+// starts past the end.
+func s3ParseRange(spec string, size int64) (offset, length int64, ok bool) {
+	spec, found := strings.CutPrefix(spec, "bytes=")
+	first, last, dash := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found || !dash || strings.Contains(spec, ",") {
+		return 0, size, true
+	}
+	if first == "" { // The last bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, size, true
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false
+		}
+		n = min(n, size)
+		return size - n, n, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, true
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, size, true
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+	return start, end - start + 1, true
+}
+
+// s3Precondition returns 412 or 304 when the If-* headers of r rule out
+// sending the object, 0 when it should be sent.
+func s3Precondition(r *http.Request, etag string, modified time.Time) int {
+	modified = modified.Truncate(time.Second)
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !s3ETagMatch(match, etag) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && modified.After(since) {
+		return http.StatusPreconditionFailed
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if s3ETagMatch(match, etag) {
+			return http.StatusNotModified
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+		return http.StatusNotModified
+	}
+	return 0
+}
+
+// s3IfRange reports whether the Range of r applies, that is without an
+// If-Range or with one naming the current ETag.
+func s3IfRange(r *http.Request, etag string) bool {
+	ifRange := r.Header.Get("If-Range")
+	return ifRange == "" || ifRange == etag
+}
+
+// s3ETagMatch reports whether the comma separated ETag list matches etag,
+// weakly as If-None-Match compares them.
+func s3ETagMatch(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *App) s3DeleteObjects(ctx *gin.Context, bucket string) {
+	var in struct {
+		Quiet   bool
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(ctx.Request.Body, 2<<20)).Decode(&in); err != nil {
+		a.writeS3Error(ctx, errS3MalformedXML)
+		return
+	}
+
+	type deleted struct {
+		Key string
+	}
+	type failed struct {
+		Key     string
+		Code    string
+		Message string
+	}
+	out := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Xmlns   string    `xml:"xmlns,attr"`
+		Deleted []deleted `xml:"Deleted"`
+		Errors  []failed  `xml:"Error"`
+	}{Xmlns: s3Namespace}
+	for _, object := range in.Objects {
+		if !s3ValidKey(object.Key) {
+			out.Errors = append(out.Errors, failed{Key: object.Key, Code: errS3InvalidKey.Code, Message: errS3InvalidKey.Message})
+			continue
+		}
+		if err := a.s3Delete(ctx, bucket, object.Key); err != nil {
+			out.Errors = append(out.Errors, failed{Key: object.Key, Code: errS3Internal.Code, Message: err.Error()})
+			continue
+		}
+		if !in.Quiet {
+			out.Deleted = append(out.Deleted, deleted{Key: object.Key})
+		}
+	}
+	ctx.XML(http.StatusOK, out)
+}
+
+// Multipart uploads keep their parts in the work directory until they are
+// completed or aborted: s3-multipart/<upload id>/<part number>, with the
+// bucket and key recorded in a "target" file.
+
+// s3UploadDir returns the directory of uploadID, or errS3NoSuchUpload when
+// it does not belong to bucket and key.
+func (a *App) s3UploadDir(bucket, key, uploadID string) (string, error) {
+	if _, err := hex.DecodeString(uploadID); err != nil || len(uploadID) != 32 {
+		return "", errS3NoSuchUpload
+	}
+	dir := filepath.Join(a.workDir, "s3-multipart", uploadID)
+	target, err := os.ReadFile(filepath.Join(dir, "target"))
+	if err != nil || string(target) != bucket+"/"+key {
+		return "", errS3NoSuchUpload
+	}
+	return dir, nil
+}
+
+func (a *App) s3CreateUpload(ctx *gin.Context, bucket, key string) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	uploadID := hex.EncodeToString(id)
+	dir := filepath.Join(a.workDir, "s3-multipart", uploadID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, "target"), []byte(bucket+"/"+key), 0644); err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+
+	ctx.XML(http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadId: uploadID})
+}
+
+func (a *App) s3UploadPart(ctx *gin.Context, bucket, key, uploadID, partNumber string) {
+	dir, err := a.s3UploadDir(bucket, key, uploadID)
+	if err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	number, err := strconv.Atoi(partNumber)
+	if err != nil || number < 1 || number > 10000 {
+		a.writeS3Error(ctx, &s3Error{http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000."})
+		return
+	}
+
+	file, etag, err := a.s3Spool(ctx, dir)
+	if err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	file.Close()
+	// Parts are named by number, so a retried part replaces the old one
+	part := filepath.Join(dir, fmt.Sprintf("%05d", number))
+	if err := os.Rename(file.Name(), part); err != nil {
+		os.Remove(file.Name())
+		a.writeS3Error(ctx, err)
+		return
+	}
+	if err := os.WriteFile(part+".etag", []byte(etag), 0644); err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	ctx.Header("ETag", `"`+etag+`"`)
+	ctx.Status(http.StatusOK)
+}
+
+func (a *App) s3CompleteUpload(ctx *gin.Context, bucket, key, uploadID string) {
+	dir, err := a.s3UploadDir(bucket, key, uploadID)
+	if err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	var in struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(ctx.Request.Body, 2<<20)).Decode(&in); err != nil || len(in.Parts) == 0 {
+		a.writeS3Error(ctx, errS3MalformedXML)
+		return
+	}
+
+	var readers []io.Reader
+	var size int64
+	for i, part := range in.Parts {
+		if i > 0 && part.PartNumber <= in.Parts[i-1].PartNumber {
+			a.writeS3Error(ctx, errS3InvalidOrder)
+			return
+		}
+		name := filepath.Join(dir, fmt.Sprintf("%05d", part.PartNumber))
+		etag, err := os.ReadFile(name + ".etag")
+		if err != nil || strings.Trim(part.ETag, `"`) != string(etag) {
+			a.writeS3Error(ctx, errS3InvalidPart)
+			return
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			a.writeS3Error(ctx, errS3InvalidPart)
+			return
+		}
+		defer file.Close()
+		if stat, err := file.Stat(); err == nil {
+			size += stat.Size()
+		}
+		readers = append(readers, file)
+	}
+
+	info, err := a.s3Store(ctx, bucket, key, io.MultiReader(readers...), size)
+	if err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	os.RemoveAll(dir)
+
+	ctx.XML(http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{Xmlns: s3Namespace, Location: "/" + bucket + "/" + key, Bucket: bucket, Key: key, ETag: s3ETag(*info)})
+}
+
+func (a *App) s3AbortUpload(ctx *gin.Context, bucket, key, uploadID string) {
+	dir, err := a.s3UploadDir(bucket, key, uploadID)
+	if err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		a.writeS3Error(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// expireS3Uploads removes multipart uploads untouched for s3.multipart_ttl,
+// left behind by clients that neither completed nor aborted them. Adding a
+// part updates the directory's modification time.
+func (a *App) expireS3Uploads(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.removeStaleS3Uploads(time.Now().Add(-currentConfig().S3.MultipartTTL))
+		}
+	}
+}
+
+// removeStaleS3Uploads removes the multipart uploads last changed before cutoff.
+func (a *App) removeStaleS3Uploads(cutoff time.Time) {
+	root := filepath.Join(a.workDir, "s3-multipart")
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			a.logger.Error("Failed to list S3 multipart uploads", "error", err)
+			recordCleanup("s3_multipart_expiry", "error", err.Error())
+		}
+		return
+	}
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+			a.logger.Error("Failed to remove S3 multipart upload", "upload_id", entry.Name(), "error", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		a.logger.Info("Abandoned S3 multipart uploads removed", "count", removed)
+		recordCleanup("s3_multipart_expiry", "success", fmt.Sprintf("%d uploads", removed))
+	}
+}
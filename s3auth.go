@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SigV4 constants, see the AWS Signature Version 4 documentation.
+const (
+	sigV4Algorithm     = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat    = "20060102T150405Z"
+	unsignedPayload    = "UNSIGNED-PAYLOAD"
+	streamingPayload   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsigned  = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	streamingTrailer   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	emptySHA256        = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxSigV4ClockSkew  = 15 * time.Minute
+	maxPresignedExpiry = 7 * 24 * time.Hour
+)
+
+// s3Error is an S3 error response.
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string { return e.Code + ": " + e.Message }
+
+var (
+	errS3AccessDenied     = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errS3InvalidAccessKey = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records."}
+	errS3SignatureMatch   = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	errS3TimeSkewed       = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	errS3Expired          = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errS3BadDigest        = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	errS3AuthMalformed    = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	errS3InvalidRegion    = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed; the region is wrong."}
+)
+
+// sigV4Request is what a request claims about its signature.
+type sigV4Request struct {
+	accessKey     string
+	date          string // yyyymmdd from the credential scope
+	region        string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	payloadHash   string
+	presigned     bool
+}
+
+// signingKey derives the SigV4 key for secret, date and region.
+func signingKey(secret, date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifySigV4 authenticates r against the configured API keys. It returns
+// the key, and r.Body is replaced so the payload is checked as it is read.
+func verifySigV4(r *http.Request, region string) (APIKey, error) {
+	req, err := parseSigV4(r)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if req.region != region {
+		return APIKey{}, errS3InvalidRegion
+	}
+	key, ok := findAPIKey(req.accessKey)
+	if !ok {
+		return APIKey{}, errS3InvalidAccessKey
+	}
+
+	scope := req.date + "/" + req.region + "/s3/aws4_request"
+	stringToSign := sigV4Algorithm + "\n" + req.amzDate.Format(sigV4TimeFormat) + "\n" + scope + "\n" +
+		sha256Hex([]byte(canonicalRequest(r, req)))
+	signing := signingKey(key.SecretKey, req.date, req.region)
+	expected := hex.EncodeToString(hmacSHA256(signing, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(req.signature)) {
+		return APIKey{}, errS3SignatureMatch
+	}
+
+	switch req.payloadHash {
+	case unsignedPayload:
+	case streamingPayload, streamingTrailer:
+		r.Body = newChunkedReader(r.Body, &chunkSigner{
+			key: signing, amzDate: req.amzDate.Format(sigV4TimeFormat), scope: scope, previous: req.signature,
+		})
+		fixDecodedLength(r)
+	case streamingUnsigned:
+		r.Body = newChunkedReader(r.Body, nil)
+		fixDecodedLength(r)
+	default:
+		if _, err := hex.DecodeString(req.payloadHash); err != nil || len(req.payloadHash) != 64 {
+			return APIKey{}, errS3BadDigest
+		}
+		r.Body = &hashingReader{r: r.Body, hash: sha256.New(), want: req.payloadHash}
+	}
+	return key, nil
+}
+
+// fixDecodedLength sets the length of the content inside an aws-chunked body.
+func fixDecodedLength(r *http.Request) {
+	r.ContentLength = -1
+	if n, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+		r.ContentLength = n
+	}
+}
+
+// parseSigV4 reads the signature from the Authorization header or, for
+// presigned URLs, from the query string.
+func parseSigV4(r *http.Request) (*sigV4Request, error) {
+	req := &sigV4Request{}
+	var credential, signedHeaders, amzDate string
+
+	query := r.URL.Query()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		rest, ok := strings.CutPrefix(auth, sigV4Algorithm+" ")
+		if !ok {
+			return nil, errS3AuthMalformed
+		}
+		for _, part := range strings.Split(rest, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				req.signature = value
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		if amzDate == "" {
+			amzDate = r.Header.Get("Date")
+		}
+		req.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if req.payloadHash == "" {
+			req.payloadHash = emptySHA256 // Not sent for requests without a body by some clients
+		}
+	} else if query.Get("X-Amz-Algorithm") == sigV4Algorithm {
+		req.presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		req.signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		req.payloadHash = unsignedPayload
+	} else {
+		return nil, errS3AccessDenied
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" || signedHeaders == "" || req.signature == "" {
+		return nil, errS3AuthMalformed
+	}
+	req.accessKey, req.date, req.region = parts[0], parts[1], parts[2]
+	req.signedHeaders = strings.Split(signedHeaders, ";")
+
+	var err error
+	req.amzDate, err = time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil {
+		if req.amzDate, err = http.ParseTime(amzDate); err != nil {
+			return nil, errS3AuthMalformed
+		}
+	}
+	if req.amzDate.UTC().Format("20060102") != req.date {
+		return nil, errS3AuthMalformed
+	}
+
+	now := time.Now()
+	if req.presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignedExpiry {
+			return nil, errS3AuthMalformed
+		}
+		if now.After(req.amzDate.Add(time.Duration(expires)*time.Second)) || req.amzDate.After(now.Add(maxSigV4ClockSkew)) {
+			return nil, errS3Expired
+		}
+	} else if d := now.Sub(req.amzDate); d > maxSigV4ClockSkew || d < -maxSigV4ClockSkew {
+		return nil, errS3TimeSkewed
+	}
+	return req, nil
+}
+
+// canonicalRequest builds the SigV4 canonical request for r.
+func canonicalRequest(r *http.Request, req *sigV4Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method + "\n")
+	b.WriteString(awsURIEncode(r.URL.Path, false) + "\n")
+
+	// Query parameters sorted by name, then value
+	query := r.URL.Query()
+	var params []string
+	for name, values := range query {
+		if req.presigned && name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	b.WriteString(strings.Join(params, "&") + "\n")
+
+	for _, name := range req.signedHeaders {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else {
+			value = strings.Join(r.Header.Values(name), ",")
+			if name == "content-length" && value == "" && r.ContentLength >= 0 {
+				value = strconv.FormatInt(r.ContentLength, 10) // Go moves it out of Header
+			}
+		}
+		b.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	b.WriteString("\n" + strings.Join(req.signedHeaders, ";") + "\n")
+	b.WriteString(req.payloadHash)
+	return b.String()
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters, and
+// "/" too when encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// hashingReader fails at EOF when the body does not match the signed hash.
+type hashingReader struct {
+	r    io.ReadCloser
+	hash hash.Hash
+	want string
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if errors.Is(err, io.EOF) && hex.EncodeToString(h.hash.Sum(nil)) != h.want {
+		return n, errS3BadDigest
+	}
+	return n, err
+}
+
+func (h *hashingReader) Close() error { return h.r.Close() }
+
+// chunkSigner checks the signature chained through aws-chunked bodies.
+type chunkSigner struct {
+	key      []byte
+	amzDate  string
+	scope    string
+	previous string
+}
+
+func (s *chunkSigner) verify(data []byte, signature string) bool {
+	stringToSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + s.amzDate + "\n" + s.scope + "\n" +
+		s.previous + "\n" + emptySHA256 + "\n" + sha256Hex(data)
+	expected := hex.EncodeToString(hmacSHA256(s.key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return false
+	}
+	s.previous = signature
+	return true
+}
+
+// chunkedReader decodes an aws-chunked body: "size;chunk-signature=sig"
+// lines each followed by that many bytes, a zero-size chunk, then optional
+// trailing checksum headers. Chunk signatures are verified when signer is set.
+type chunkedReader struct {
+	body   io.ReadCloser
+	r      *bufio.Reader
+	signer *chunkSigner
+	chunk  *bytes.Reader
+	done   bool
+}
+
+func newChunkedReader(body io.ReadCloser, signer *chunkSigner) *chunkedReader {
+	return &chunkedReader{body: body, r: bufio.NewReader(body), signer: signer}
+}
+
+var errS3BadChunk = &s3Error{http.StatusBadRequest, "IncompleteBody", "The aws-chunked body is malformed."}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.chunk == nil || c.chunk.Len() == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	return c.chunk.Read(p)
+}
+
+// next reads one chunk into memory; SDKs send chunks of 64 KiB by default.
+func (c *chunkedReader) next() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return errS3BadChunk
+	}
+	sizeField, params, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 || size > 16<<20 {
+		return errS3BadChunk
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return errS3BadChunk
+	}
+	if c.signer != nil {
+		signature, _ := strings.CutPrefix(params, "chunk-signature=")
+		if !c.signer.verify(data, signature) {
+			return errS3SignatureMatch
+		}
+	}
+
+	if size == 0 {
+		// Trailing headers, if any, end with an empty line
+		for {
+			trailer, err := c.r.ReadString('\n')
+			if strings.TrimRight(trailer, "\r\n") == "" || err != nil {
+				break
+			}
+		}
+		c.done = true
+	} else if _, err := c.r.Discard(2); err != nil { // CRLF after the data
+		return errS3BadChunk
+	}
+	c.chunk = bytes.NewReader(data)
+	return nil
+}
+
+func (c *chunkedReader) Close() error { return c.body.Close() }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"tempo/crates"
+	"time"
+)
+
+// Scrubber runs GridFS integrity checks on a schedule or on demand and keeps
+// the latest report in memory and on disk for admins to fetch.
+type Scrubber struct {
+	reportPath string
+	logger     *slog.Logger
+
+	mutex   sync.Mutex
+	running bool
+	last    *crates.ScrubReport
+	wg      sync.WaitGroup
+}
+
+// NewScrubber creates a scrubber that persists its reports to reportPath.
+// A report left by a previous run is loaded so it survives restarts.
+func NewScrubber(reportPath string, logger *slog.Logger) *Scrubber {
+	s := &Scrubber{reportPath: reportPath, logger: logger}
+
+	if data, err := os.ReadFile(reportPath); err == nil {
+		var report crates.ScrubReport
+		if err := json.Unmarshal(data, &report); err == nil {
+			s.last = &report
+		}
+	}
+	return s
+}
+
+// Schedule starts a scrub pass every configured interval and blocks until ctx
+// is cancelled. A config reload restarts the interval.
+func (s *Scrubber) Schedule(ctx context.Context) {
+	ticker := time.NewTicker(currentConfig().Scrub.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger.Info("Scrubber shutting down")
+			return
+		case <-configReloaded():
+			ticker.Reset(currentConfig().Scrub.Interval)
+		case <-ticker.C:
+			if !s.Trigger(ctx) {
+				s.logger.Warn("Scrubber: previous pass still running, skipping")
+				recordCleanup("scrub", "skipped", "previous pass still running")
+			}
+		}
+	}
+}
+
+// Trigger starts a scrub pass in the background unless one is already in
+// progress, in which case it returns false.
+func (s *Scrubber) Trigger(ctx context.Context) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.running {
+		return false
+	}
+	s.running = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(ctx)
+	}()
+	return true
+}
+
+// Wait blocks until a running scrub pass has finished.
+func (s *Scrubber) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Scrubber) run(ctx context.Context) {
+	s.logger.Info("Scrubber: starting pass")
+	report, err := crates.Scrub(ctx, currentConfig().Scrub.Grace)
+	scrubOrphanChunks.Add(float64(report.OrphanChunks))
+	if err != nil {
+		s.logger.Error("Scrubber: pass failed", "error", err)
+		recordCleanup("scrub", "error", err.Error())
+	} else {
+		scrubIssues.Set(float64(len(report.Issues)))
+		recordCleanup("scrub", "success", fmt.Sprintf("%d files checked in %d buckets, %d issues, %d orphan chunks removed",
+			report.FilesChecked, len(report.Buckets), len(report.Issues), report.OrphanChunks))
+		s.logger.Info("Scrubber: pass finished", "buckets", len(report.Buckets), "files_checked", report.FilesChecked,
+			"issues", len(report.Issues), "orphan_chunks_removed", report.OrphanChunks)
+	}
+
+	if data, err := json.MarshalIndent(report, "", "  "); err != nil {
+		s.logger.Error("Scrubber: failed to encode report", "error", err)
+	} else if err := os.WriteFile(s.reportPath, data, 0644); err != nil {
+		s.logger.Error("Scrubber: failed to write report", "path", s.reportPath, "error", err)
+	}
+
+	s.mutex.Lock()
+	s.last = report
+	s.running = false
+	s.mutex.Unlock()
+}
+
+// Status returns the latest report (nil if none yet) and whether a pass is running.
+func (s *Scrubber) Status() (*crates.ScrubReport, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.last, s.running
+}
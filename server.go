@@ -2,67 +2,162 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"slices"
 	"strings"
+	"syscall"
 	"tempo/crates"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
+	"github.com/grandcat/zeroconf"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
 )
 
-// Server initializes the Gin server with improved implementation
-func Server() {
+// Server initializes the Gin server with improved implementation. args are the
+// command-line arguments cfg was loaded from, re-read on SIGHUP.
+func Server(cfg *Config, args []string) {
+	liveConfig.Store(cfg)
+	crates.Configure(crates.Settings{
+		URI:        cfg.Mongo.URI,
+		Database:   cfg.Mongo.Database,
+		Collection: cfg.Mongo.Collection,
+		LocalDir:   cfg.Server.UploadDir,
+	})
 
-	// Load .env file
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file:", err)
-	}
-	// Set up server logging
-	logFile, err := os.OpenFile("server.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal("Failed to open log file:", err)
-	}
+	// Set up structured logging with a rotated log file
+	logger, logFile := setupLogging(cfg.Log)
 	defer logFile.Close()
 
-	// Configure custom logger
-	logger := log.New(io.MultiWriter(os.Stdout, logFile), "[TEMPO] ", log.LstdFlags)
+	// Set up tracing for the configured exporter
+	shutdownTracing, err := setupTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		logger.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
 
 	// Set Gin to release mode for production
 	gin.SetMode(gin.ReleaseMode)
 
 	// Create a new Gin router with logging and recovery middleware
-	c := gin.New()
-	c.Use(gin.Recovery())
-	c.Use(gin.LoggerWithWriter(io.MultiWriter(os.Stdout, logFile)))
+	c := newRouter(logger)
+	c.UseRawPath = true // Lets names escape "/" as %2F in a single path segment
 
 	// Initialize file queue
 	arquivos := NewQueue()
 
 	// Define upload directory
-	uploadDir := "./uploads"
+	uploadDir := cfg.Server.UploadDir
 	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		logger.Fatal("Failed to create upload directory:", err)
+		logger.Error("Failed to create upload directory", "dir", uploadDir, "error", err)
+		os.Exit(1)
 	}
+	// Working files are kept apart, /down/ serves anything in the upload directory
+	workDir := cfg.Server.WorkDir
+	if err := os.MkdirAll(workDir, 0700); err != nil {
+		logger.Error("Failed to create work directory", "dir", workDir, "error", err)
+		os.Exit(1)
+	}
+
+	// Liveness and readiness probes
+	health := NewHealth(uploadDir)
+	c.GET("/healthz", health.Liveness)
+	c.GET("/readyz", health.Readiness)
+
+	// Prometheus metrics, scraped from /metrics
+	registerRuntimeMetrics(func() int { return arquivos.Len() }, uploadDir)
+	c.GET("/metrics", metricsHandler())
 
-	// Create server context that can be used for graceful shutdown
-	serverCtx, _ := context.WithCancel(context.Background())
+	// Server context, cancelled on SIGINT or SIGTERM to start a graceful shutdown
+	serverCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Share links, persisted so they survive restarts
+	shares, err := NewShareStore(cfg.Share.StorePath)
+	if err != nil {
+		logger.Error("Failed to load share links", "error", err)
+		os.Exit(1)
+	}
+
+	// Text pastes, persisted the same way
+	pastes, err := NewPasteStore(cfg.Paste.StorePath)
+	if err != nil {
+		logger.Error("Failed to load pastes", "error", err)
+		os.Exit(1)
+	}
+
+	// Webhook subscriptions and their delivery queue, persisted like the shares
+	webhooks, err := NewWebhooks(cfg.Webhook.StorePath, logger)
+	if err != nil {
+		logger.Error("Failed to load webhooks", "error", err)
+		os.Exit(1)
+	}
+
+	// GridFS integrity scrubber, runs on a schedule and on demand
+	scrubber := NewScrubber(cfg.Scrub.ReportPath, logger)
+
+	// Storage backend, GridFS unless running in memory for development. Every
+	// change made through it is published as an event after the hooks allowed
+	// it, and image uploads lose their metadata when images.strip_metadata is
+	// set. The server's own files go to internal buckets, hidden from clients
+	var buckets crates.Buckets = crates.GridFSBuckets{}
+	if cfg.Server.Storage == "memory" {
+		logger.Warn("Using in-memory storage, files are lost on restart")
+		buckets = crates.NewMemoryBuckets()
+	}
+	if cfg.Server.AdminPassword == "" {
+		logger.Warn("No admin password set (ADMPASSWORD), admin login is disabled and only API keys are accepted")
+	}
+
+	events := NewEvents()
+	hooks := NewHooks(workDir, logger)
+	internal := buckets
+	buckets = publicBuckets{imageBuckets{hookBuckets{Buckets: eventBuckets{Buckets: buckets, events: events}, hooks: hooks}}}
+	store := buckets.Bucket(crates.DefaultBucket())
+
+	app := &App{
+		cfg:       cfg,
+		logger:    logger,
+		uploadDir: uploadDir,
+		workDir:   workDir,
+		queue:     arquivos,
+		health:    health,
+		scrubber:  scrubber,
+		shares:    shares,
+		pastes:    pastes,
+		archives:  NewArchiveJobs(),
+		hooks:     hooks,
+		store:     store,
+		buckets:   buckets,
+		internal:  internal,
+		events:    events,
+		ctx:       serverCtx,
+	}
+
+	// JSON API used by the command-line client
+	app.registerAPI(c)
+
+	// WebDAV endpoint for mounting the storage as a network drive
+	app.registerDAV(c)
+
+	// Web UI for browsing, uploading and sharing files
+	registerUI(c)
+	registerConnect(c)
 
 	// Admin authentication middleware
 	adminAuth := func(ctx *gin.Context) {
-		adminPassword := os.Getenv("ADMPASSWORD")
-		if adminPassword == "" {
-			logger.Println("Warning: ADMPASSWORD environment variable is not set")
-			adminPassword = "iQuietDownIfItsWhatYouWant" // Fallback for development
-		}
-
-		if providedPassword := ctx.Param("admin"); providedPassword != adminPassword {
+		if !checkAdminPassword(ctx.Param("admin")) {
 			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication failed"})
 			ctx.Abort()
 			return
@@ -75,9 +170,11 @@ func Server() {
 	c.GET("/listserver/:admin", adminAuth, func(ctx *gin.Context) {
 		files := arquivos.ToSlice()
 		ctx.String(http.StatusOK, strings.Join(files, "\n"))
-		logger.Printf("Admin listed %d server files", len(files))
+		reqLogger(logger, ctx).Info("Admin listed server files", "count", len(files))
 	})
 
+	c.GET("/addresses/:admin", adminAuth, listAddresses)
+
 	c.GET("/ipserver/:admin", adminAuth, func(ctx *gin.Context) {
 		ip, err := GetLocalIP()
 		if err != nil {
@@ -86,56 +183,97 @@ func Server() {
 		}
 		ctx.String(http.StatusOK, ip)
 	})
-		
-		
-
-
 
 	// GET route to list database files (admin only)
 	c.GET("/listdatabase/:admin", adminAuth, func(ctx *gin.Context) {
-		files := crates.Grider("list")
+		infos, err := app.store.List(ctx.Request.Context())
+		if err != nil {
+			reqLogger(logger, ctx).Error("Failed to list database files", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list database files"})
+			return
+		}
+		files := fileNames(infos)
 		ctx.String(http.StatusOK, strings.Join(files, "\n"))
-		logger.Printf("Admin listed %d database files", len(files))
+		reqLogger(logger, ctx).Info("Admin listed database files", "count", len(files))
 		arquivos.PrintQueue()
 	})
 
-	// POST route for simple file upload (stored only on server)
-	c.POST("/", func(ctx *gin.Context) {
-		file, header, err := ctx.Request.FormFile("file")
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Failed to receive file"})
+	// GET route to fetch the latest scrub report (admin only)
+	c.GET("/scrub/:admin", adminAuth, func(ctx *gin.Context) {
+		report, running := scrubber.Status()
+		if report == nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "No scrub report available yet", "running": running})
 			return
 		}
-		defer file.Close()
-
-		filename := filepath.Base(header.Filename) // Sanitize filename
-		filePath := filepath.Join(uploadDir, filename)
+		ctx.JSON(http.StatusOK, gin.H{"running": running, "report": report})
+	})
 
-		out, err := os.Create(filePath)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create file on server"})
+	// POST route to start a scrub pass now (admin only)
+	c.POST("/scrub/:admin", adminAuth, func(ctx *gin.Context) {
+		if !scrubber.Trigger(crates.WithRequestID(serverCtx, ctx.GetString("request_id"))) {
+			ctx.JSON(http.StatusConflict, gin.H{"error": "A scrub pass is already running"})
 			return
 		}
-		defer out.Close()
+		reqLogger(logger, ctx).Info("Admin started a scrub pass")
+		ctx.JSON(http.StatusAccepted, gin.H{"message": "Scrub started"})
+	})
 
-		written, err := io.Copy(out, file)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+	// GET route for storage statistics and system status, with the admin
+	// password as bearer token like the dashboard sends it
+	c.GET("/admin/stats", adminBearer, app.adminStats)
+
+	// GET route to list webhook subscriptions (admin only)
+	c.GET("/webhooks/:admin", adminAuth, func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"webhooks": webhooks.List()})
+	})
+
+	// POST route to subscribe a URL to file events (admin only)
+	c.POST("/webhooks/:admin", adminAuth, func(ctx *gin.Context) {
+		var hook Webhook
+		if err := ctx.ShouldBindJSON(&hook); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook"})
 			return
 		}
+		created, err := webhooks.Create(hook)
+		if errors.Is(err, errInvalidWebhook) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			reqLogger(logger, ctx).Error("Failed to save webhooks", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add webhook"})
+			return
+		}
+		reqLogger(logger, ctx).Info("Admin added a webhook", "webhook", created.ID, "url", created.URL)
+		ctx.JSON(http.StatusCreated, created)
+	})
 
-		arquivos.Enqueue(filename)
-		logger.Printf("File uploaded: %s (%d bytes)", filename, written)
+	// DELETE route to remove a webhook subscription (admin only)
+	c.DELETE("/webhooks/:admin/:id", adminAuth, func(ctx *gin.Context) {
+		found, err := webhooks.Remove(ctx.Param("id"))
+		if !found {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		} else if err != nil {
+			reqLogger(logger, ctx).Error("Failed to save webhooks", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove webhook"})
+			return
+		}
+		reqLogger(logger, ctx).Info("Admin removed a webhook", "webhook", ctx.Param("id"))
+		ctx.JSON(http.StatusOK, gin.H{"message": "Webhook removed"})
+	})
 
-		arquivos.PrintQueue()
-		ctx.JSON(http.StatusOK, gin.H{
-			"message": fmt.Sprintf("File %s uploaded successfully!", filename),
-			"size":    written,
-		})
+	// GET route for the delivery log of a webhook (admin only)
+	c.GET("/webhooks/:admin/:id/deliveries", adminAuth, func(ctx *gin.Context) {
+		deliveries, found := webhooks.Deliveries(ctx.Param("id"))
+		if !found {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
 	})
 
-	// POST route for file upload to both server and database
-	c.POST("/up", func(ctx *gin.Context) {
+	// POST route for simple file upload (stored only on server)
+	c.POST("/", func(ctx *gin.Context) {
 		file, header, err := ctx.Request.FormFile("file")
 		if err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Failed to receive file"})
@@ -144,119 +282,53 @@ func Server() {
 		defer file.Close()
 
 		filename := filepath.Base(header.Filename) // Sanitize filename
-		filePath := filepath.Join(uploadDir, filename)
-
-		out, err := os.Create(filePath)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create file on server"})
+		uploadCtx := withUploader(ctx.Request.Context(), "ip:"+ctx.ClientIP())
+		if extractRequested(ctx) {
+			app.extractUpload(ctx, uploadCtx, filename, file, header.Size, true)
 			return
 		}
-		defer out.Close()
-
-		written, err := io.Copy(out, file)
+		written, _, err := app.StoreFile(uploadCtx, filename, file, true)
 		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+			reqLogger(logger, ctx).Error("Failed to store upload", "filename", filename, "error", err)
+			ctx.JSON(uploadErrorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
 
-		// Add to queue and database
-		arquivos.Enqueue(filename)
-		result := crates.Grider("up", filename)
-
-		logger.Printf("File uploaded to server and database: %s (%d bytes)", filename, written)
+		reqLogger(logger, ctx).Info("File uploaded", "filename", filename, "bytes", written)
 		arquivos.PrintQueue()
-
 		ctx.JSON(http.StatusOK, gin.H{
-			"message":         "File uploaded successfully to server and database",
-			"size":            written,
-			"database_result": result,
+			"message": fmt.Sprintf("File %s uploaded successfully!", filename),
+			"size":    written,
 		})
 	})
 
+	// POST route for file upload to both server and database
+	c.POST("/up", app.uploadToDatabase)
+
 	// DELETE route for file removal
 	c.DELETE("/:filename", func(ctx *gin.Context) {
-		filename := filepath.Base(ctx.Param("filename")) // Sanitize filename
-		filePath := filepath.Join(uploadDir, filename)
-
-		files := arquivos.ToSlice()
-		fileExists := slices.Contains(files, filename)
-
-		if fileExists {
-			if err := os.Remove(filePath); err != nil {
-				if os.IsNotExist(err) {
-					logger.Printf("File %s not found on filesystem", filename)
-				} else {
-					ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove file"})
-					logger.Printf("Error removing file %s: %v", filename, err)
-					return
-				}
-			}
-		}
+		filename := ctx.Param("filename") // Sanitized by RemoveFile
 
-		// Remove from queue regardless if file exists (clean up queue)
-		newQueue := NewQueue()
-		for _, file := range files {
-			if file != filename {
-				newQueue.Enqueue(file)
-			}
+		err := app.RemoveFile(ctx.Request.Context(), filename)
+		if errors.Is(err, crates.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		} else if errors.Is(err, errHookRejected) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			reqLogger(logger, ctx).Error("Error removing file", "filename", filename, "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove file"})
+			return
 		}
-		arquivos = newQueue
-
-		// Remove from database
-		_ = crates.Grider("delete", filename)
 
-		logger.Printf("File removed: %s (existed: %v)", filename, fileExists)
+		reqLogger(logger, ctx).Info("File removed", "filename", filename)
 		ctx.String(http.StatusOK, "File successfully removed from server and database")
 	})
 
 	// GET route to download file from database
 	c.GET("/down/:filename", func(ctx *gin.Context) {
-		filename := filepath.Base(ctx.Param("filename")) // Sanitize filename
-
-		// Check if file is in database
-		dbFiles := crates.Grider("list")
-		if !slices.Contains(dbFiles, filename) {
-			logger.Printf("File not found in database: %s", filename)
-			ctx.JSON(http.StatusNotFound, gin.H{"error": "File not found in database"})
-			return
-		}
-
-		_ = crates.Grider("down", filename)
-
-		outputPath := "./uploads/" + filename
-
-		if _, err := os.Stat(outputPath); os.IsNotExist(err) {
-			logger.Printf("File check error: %v", err)
-			currentDir, _ := os.Getwd()
-			logger.Printf("Current directory: %s", currentDir)
-			fileInfo, _ := os.Stat(outputPath)
-			// fileInfo, _ := os.Stat(filename)
-			var permissions string
-			if fileInfo != nil {
-				permissions = fileInfo.Mode().String()
-			} else {
-				permissions = "unknown"
-			}
-			logger.Printf("File permissions: %s", permissions)
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve file from database"})
-			return
-		}
-
-		// Send file to client
-		ctx.File(outputPath)
-		logger.Printf("File downloaded from database: %s", filename)
-
-		// Clean up file after sending
-		go func() {
-			// Give time for the file to be sent
-			time.Sleep(20 * time.Second)
-			filepath := "./uploads/" + filename
-			if err := os.Remove(filepath); err != nil {
-				logger.Printf("Error removing temporary file %s: %v", filename, err)
-			} else {
-				logger.Printf("Removed temporary file: %s", filename)
-			}
-		}()
+		app.ServeFile(ctx, ctx.Param("filename"))
 	})
 
 	// Health check endpoint
@@ -265,39 +337,51 @@ func Server() {
 	})
 
 	// Start auto-cleanup goroutine with context for graceful shutdown
-	go func() {
-		ticker := time.NewTicker(30 * time.Minute)
+	health.Go("auto_cleanup", func() {
+		ticker := time.NewTicker(currentConfig().Server.CleanupInterval)
 		defer ticker.Stop()
 
 		for {
 			select {
 			case <-serverCtx.Done():
-				logger.Println("Auto-cleanup routine shutting down")
+				logger.Info("Auto-cleanup routine shutting down")
 				return
 
+			case <-configReloaded():
+				ticker.Reset(currentConfig().Server.CleanupInterval)
+
 			case <-ticker.C:
 
-				arquivos = FromSliceToQueue(crates.Grider("list"))
+				infos, err := app.store.List(serverCtx)
+				if err != nil {
+					logger.Error("Auto-cleanup: Failed to list database files", "error", err)
+					recordCleanup("auto_cleanup", "error", "failed to list database files: "+err.Error())
+					continue
+				}
+				arquivos.Replace(fileNames(infos))
 
 				if arquivos.IsEmpty() {
-					logger.Println("Auto-cleanup: Queue is empty")
+					logger.Debug("Auto-cleanup: Queue is empty")
+					cleanupRuns.WithLabelValues("auto_cleanup", "empty").Inc()
 					continue
 				}
 
 				// Dequeue and process file
 				filename, ok := arquivos.Dequeue()
 				if !ok {
-					logger.Println("Auto-cleanup: Failed to dequeue file")
+					logger.Warn("Auto-cleanup: Failed to dequeue file")
+					recordCleanup("auto_cleanup", "error", "failed to dequeue file")
 					continue
 				}
 
-				logger.Printf("Auto-cleanup: Processing file %s", filename)
+				logger.Info("Auto-cleanup: Processing file", "filename", filename)
 
 				// Create DELETE request
 				req, err := http.NewRequest(http.MethodDelete,
-					fmt.Sprintf("http://localhost:8080/%s", filename), nil)
+					cfg.selfURL()+"/"+url.PathEscape(filename), nil)
 				if err != nil {
-					logger.Printf("Auto-cleanup: Error creating DELETE request: %v", err)
+					logger.Error("Auto-cleanup: Error creating DELETE request", "filename", filename, "error", err)
+					recordCleanup("auto_cleanup", "error", filename+": "+err.Error())
 					// Re-queue the file if we couldn't process it
 					arquivos.Enqueue(filename)
 					continue
@@ -307,7 +391,8 @@ func Server() {
 				client := &http.Client{Timeout: 10 * time.Second}
 				resp, err := client.Do(req)
 				if err != nil {
-					logger.Printf("Auto-cleanup: Error making DELETE request: %v", err)
+					logger.Error("Auto-cleanup: Error making DELETE request", "filename", filename, "error", err)
+					recordCleanup("auto_cleanup", "error", filename+": "+err.Error())
 					// Re-queue the file if we couldn't process it
 					arquivos.Enqueue(filename)
 					continue
@@ -318,83 +403,238 @@ func Server() {
 				resp.Body.Close()
 
 				// Clean up server files
-				if err := ClearServer(); err != nil {
-					logger.Printf("Auto-cleanup: Error in ClearServer: %v", err)
+				if err := ClearServer(uploadDir, fileNames(infos)); err != nil {
+					logger.Error("Auto-cleanup: Error in ClearServer", "error", err)
 				}
 
-				logger.Printf("Auto-cleanup: File %s removed, response: %s",
-					filename, strings.TrimSpace(string(body)))
+				if resp.StatusCode == http.StatusOK {
+					app.events.Publish(Event{Type: EventCleanedUp, Bucket: crates.DefaultBucket(), Name: filename})
+				}
+				recordCleanup("auto_cleanup", "success", filename)
+				logger.Info("Auto-cleanup: File removed", "filename", filename,
+					"response", strings.TrimSpace(string(body)))
 			}
 		}
-	}()
+	})
 
-	// Start server
-	port := os.Getenv("PORT")  // Get the port from the environment variable
-if port == "" {
-    log.Fatal("PORT environment variable is not set!")
-}
+	// Remove pastes once they expire
+	health.Go("paste_expiry", func() {
+		app.expirePastes(serverCtx)
+	})
 
-srv := &http.Server{
-    Addr:    ":" + port,  // Use the dynamic port
-    Handler: c,
-}
+	// Remove S3 multipart uploads that were never completed or aborted
+	health.Go("s3_multipart_expiry", func() {
+		app.expireS3Uploads(serverCtx)
+	})
 
-go func() {
-    logger.Println("Server starting on port", port)
-    if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-        logger.Fatalf("Server failed: %v", err)
-    }
-}()
+	// Make thumbnails of uploaded images
+	health.Go("images", func() {
+		app.processImages(serverCtx)
+	})
 
+	// Deliver file events to the webhook subscriptions
+	health.Go("webhooks", func() {
+		webhooks.Run(serverCtx, events)
+	})
+
+	// Start scheduled integrity scrubbing
+	health.Go("scrubber", func() {
+		scrubber.Schedule(serverCtx)
+	})
+
+	// gRPC API, on its own port and/or next to the routes above over h2c
+	var grpcSrv *grpc.Server
+	var handler http.Handler = c
+	if cfg.GRPC.Port > 0 || cfg.GRPC.Multiplex {
+		grpcSrv = newGRPCServer(app)
+	}
+	if cfg.GRPC.Multiplex {
+		handler = h2c.NewHandler(grpcHandler(grpcSrv, c), &http2.Server{})
+	}
+	if cfg.GRPC.Port > 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.GRPC.Port))
+		if err != nil {
+			logger.Error("gRPC failed", "error", err)
+			os.Exit(1)
+		}
+		go func() {
+			logger.Info("gRPC starting", "port", cfg.GRPC.Port)
+			if err := grpcSrv.Serve(listener); err != nil {
+				logger.Error("gRPC failed", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// Start server
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler: handler,
+	}
 
-	// Run server in goroutine so we can handle shutdown gracefully
+	// Serve in a goroutine so the main one can wait for a shutdown signal
 	go func() {
-		logger.Println("Server starting on :8080")
+		logger.Info("Server starting", "port", cfg.Server.Port)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Fatalf("Server failed: %v", err)
+			logger.Error("Server failed", "error", err)
+			os.Exit(1)
 		}
 	}()
 
-	// Listen for interrupt signal
-	// Note: In a real implementation, you'd use a signal channel here
-	// This is just a placeholder for the concept
-	select {
-	case <-serverCtx.Done():
-		logger.Println("Shutting down server...")
-
-		// Create shutdown context with timeout
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+	// S3-compatible API on its own port, for clients that need a host per endpoint
+	var s3srv *http.Server
+	if cfg.S3.Port > 0 {
+		s3 := newRouter(logger)
+		app.registerS3(s3)
+		s3srv = &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.S3.Port),
+			Handler: s3,
+		}
+		go func() {
+			logger.Info("S3 API starting", "port", cfg.S3.Port)
+			if err := s3srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("S3 API failed", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
 
-		// Start separate goroutine to warn about shutdown taking too long
+	// SFTP for machines that can only push files that way
+	var sftpSrv *sftpServer
+	if cfg.SFTP.Port > 0 {
+		sftpSrv, err = newSFTPServer(app, cfg.SFTP.HostKey)
+		if err != nil {
+			logger.Error("Failed to set up SFTP", "error", err)
+			os.Exit(1)
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.SFTP.Port))
+		if err != nil {
+			logger.Error("SFTP failed", "error", err)
+			os.Exit(1)
+		}
 		go func() {
+			logger.Info("SFTP starting", "port", cfg.SFTP.Port)
+			if err := sftpSrv.Serve(listener); err != nil {
+				logger.Error("SFTP failed", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// Let "tempo discover" find the server on the LAN
+	var mdnsSrv *zeroconf.Server
+	if cfg.MDNS.Enabled {
+		mdnsSrv, err = advertise(cfg, logger)
+		if err != nil {
+			logger.Warn("mDNS announcement failed, the server will not be discoverable", "error", err)
+		}
+	}
+
+	// Reload safe settings on SIGHUP
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	go func() {
+		for {
 			select {
-			case <-time.After(7 * time.Second):
-				logger.Println("Warning: Server shutdown is taking longer than expected")
-			case <-shutdownCtx.Done():
-				// Context finished normally, no need to warn
+			case <-serverCtx.Done():
 				return
+			case <-hangups:
+				restart, err := reloadConfig(args)
+				if err != nil {
+					logger.Error("Config reload failed, keeping the current settings", "error", err)
+					continue
+				}
+				if len(restart) > 0 {
+					logger.Warn("Some changed settings only take effect after a restart", "settings", restart)
+				}
+				logger.Info("Configuration reloaded")
 			}
-		}()
+		}
+	}()
 
-		// Close any open resources before shutting down HTTP server
-		// e.g. database, cache connections, etc.
-		// db.Close()
+	printBanner(os.Stderr, cfg, logger)
 
-		// Attempt graceful shutdown
-		if err := srv.Shutdown(shutdownCtx); err != nil {
-			logger.Printf("Server shutdown error: %v", err)
+	// Startup is done, let the readiness probe pass
+	health.SetState(stateReady)
 
-			// If graceful shutdown fails, force close
-			if err := srv.Close(); err != nil {
-				logger.Fatalf("Server forced close failed: %v", err)
-			}
-			logger.Println("Server closed forcefully")
-		} else {
-			logger.Println("Server shut down gracefully")
+	// Wait for SIGINT or SIGTERM
+	<-serverCtx.Done()
+	stop() // Restore default handling so a second signal kills the process
+
+	drainTimeout := currentConfig().Server.ShutdownTimeout
+	logger.Info("Shutting down server...", "drain_timeout", drainTimeout.String())
+	health.SetState(stateDraining)
+	if mdnsSrv != nil {
+		mdnsSrv.Shutdown() // Says goodbye so browsers drop the entry
+	}
+
+	// Create shutdown context with timeout
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	// Start separate goroutine to warn about shutdown taking too long
+	go func() {
+		select {
+		case <-time.After(drainTimeout * 3 / 4):
+			logger.Warn("Server shutdown is taking longer than expected")
+		case <-shutdownCtx.Done():
+			// Context finished normally, no need to warn
+			return
+		}
+	}()
+
+	// Stop accepting connections and wait for in-flight uploads and downloads
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Server shutdown error", "error", err)
+
+		// If graceful shutdown fails, force close
+		if err := srv.Close(); err != nil {
+			logger.Error("Server forced close failed", "error", err)
+		}
+		logger.Warn("Server closed forcefully")
+	}
+	if s3srv != nil {
+		if err := s3srv.Shutdown(shutdownCtx); err != nil {
+			logger.Error("S3 API shutdown error", "error", err)
+			s3srv.Close()
+		}
+	}
+	if grpcSrv != nil {
+		// Let running calls finish, Watch streams end with serverCtx
+		if err := waitAll(shutdownCtx, grpcSrv.GracefulStop); err != nil {
+			logger.Error("gRPC shutdown error", "error", err)
+			grpcSrv.Stop()
 		}
+	}
+	if sftpSrv != nil {
+		if err := sftpSrv.Shutdown(shutdownCtx); err != nil {
+			logger.Error("SFTP shutdown error", "error", err)
+		}
+	}
 
-		// Notify any monitoring systems that the server is down
-		// notifySystemMonitor("server-down")
+	// Background workers saw serverCtx end; wait for them, a running scrub
+	// pass, post_upload hooks and pending temporary file removals
+	if err := waitAll(shutdownCtx, health.Wait, scrubber.Wait, hooks.Wait, app.background.Wait); err != nil {
+		logger.Warn("Background jobs did not finish before the drain deadline", "error", err)
 	}
+
+	if err := crates.Disconnect(shutdownCtx); err != nil {
+		logger.Error("Failed to disconnect from MongoDB", "error", err)
+	}
+
+	// Tracing and the log file are flushed by the deferred calls above
+	logger.Info("Server shut down gracefully")
+}
+
+// newRouter returns a Gin engine with the tracing, logging, metrics and
+// recovery middleware every listener uses.
+func newRouter(logger *slog.Logger) *gin.Engine {
+	r := gin.New()
+	r.Use(tracingMiddleware())
+	r.Use(requestID())
+	r.Use(requestLogger(logger))
+	r.Use(metricsMiddleware())
+	r.Use(gin.RecoveryWithWriter(slog.NewLogLogger(logger.Handler(), slog.LevelError).Writer()))
+	return r
 }
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"tempo/crates"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpServer serves each user's namespace over SFTP. Uploads are stored with
+// App.StoreFile, like POST /up.
+type sftpServer struct {
+	app      *App
+	config   *ssh.ServerConfig
+	listener net.Listener
+
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+	views map[string]*davFS // Per user, so empty folders outlive a session
+	wg    sync.WaitGroup
+}
+
+// newSFTPServer loads or creates the host key at hostKeyPath.
+func newSFTPServer(app *App, hostKeyPath string) (*sftpServer, error) {
+	hostKey, err := loadHostKey(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	s := &sftpServer{
+		app:   app,
+		conns: make(map[net.Conn]struct{}),
+		views: make(map[string]*davFS),
+	}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if user, ok := findUser(meta.User()); ok && user.checkPassword(string(password)) {
+				return nil, nil
+			}
+			s.loginFailed(meta, "password")
+			return nil, errors.New("invalid user or password")
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if user, ok := findUser(meta.User()); ok && user.authorizedKey(key) {
+				return nil, nil
+			}
+			return nil, errors.New("key not authorized")
+		},
+		ServerVersion: "SSH-2.0-tempo",
+	}
+	s.config.AddHostKey(hostKey)
+	app.logger.Info("SFTP host key loaded", "path", hostKeyPath,
+		"fingerprint", ssh.FingerprintSHA256(hostKey.PublicKey()))
+	return s, nil
+}
+
+// loadHostKey reads the private key at path, generating an ed25519 key
+// there on first start.
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "tempo sftp host key")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to save SFTP host key: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read SFTP host key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SFTP host key %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+func (s *sftpServer) loginFailed(meta ssh.ConnMetadata, method string) {
+	s.app.logger.Warn("SFTP login failed", "user", meta.User(), "method", method,
+		"remote", meta.RemoteAddr().String())
+}
+
+// Serve accepts connections on listener until Shutdown.
+func (s *sftpServer) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	s.listener = listener
+	s.mutex.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mutex.Lock()
+		s.conns[conn] = struct{}{}
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+// Shutdown stops accepting connections, closes the open ones and waits for
+// their handlers. Transfers still running are dropped, and the files being
+// written are not stored.
+func (s *sftpServer) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	return waitAll(ctx, s.wg.Wait)
+}
+
+// view returns the file system showing user's namespace.
+func (s *sftpServer) view(user User) *davFS {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := user.Name + "\x00" + user.namespace() // A reload may move the namespace
+	view, ok := s.views[key]
+	if !ok {
+		view = newDavFS(newNamespaceStore(s.app.store, user.namespace()))
+		s.views[key] = view
+	}
+	return view
+}
+
+// handle runs one SSH connection, serving the sftp subsystem on its sessions.
+func (s *sftpServer) handle(conn net.Conn) {
+	defer conn.Close()
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		s.app.logger.Debug("SFTP handshake failed", "remote", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	user, ok := findUser(sshConn.User())
+	if !ok {
+		return // Removed by a reload since it logged in
+	}
+	id := newRequestID()
+	logger := s.app.logger.With("request_id", id, "user", user.Name, "remote", conn.RemoteAddr().String())
+	logger.Info("SFTP session started")
+	defer logger.Info("SFTP session ended")
+
+	var sessions sync.WaitGroup
+	defer sessions.Wait()
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			logger.Warn("SFTP channel not accepted", "error", err)
+			continue
+		}
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			s.session(channel, requests, &sftpHandler{
+				app:    s.app,
+				user:   user,
+				view:   s.view(user),
+				ctx:    withUploader(crates.WithRequestID(context.Background(), id), "user:"+user.Name),
+				logger: logger,
+			})
+		}()
+	}
+}
+
+// session waits for the sftp subsystem request and serves it; shells and
+// commands are refused.
+func (s *sftpServer) session(channel ssh.Channel, requests <-chan *ssh.Request, handler *sftpHandler) {
+	defer channel.Close()
+	for req := range requests {
+		// The payload is the subsystem name as an SSH string
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+
+		server := sftp.NewRequestServer(channel, sftp.Handlers{
+			FileGet: handler, FilePut: handler, FileCmd: handler, FileList: handler,
+		})
+		if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+			handler.logger.Debug("SFTP session failed", "error", err)
+		}
+		server.Close()
+		return
+	}
+}
+
+// sftpHandler answers the SFTP requests of one session.
+type sftpHandler struct {
+	app    *App
+	user   User
+	view   *davFS // The user's namespace
+	ctx    context.Context
+	logger *slog.Logger
+}
+
+// fullName returns the stored name of name inside the user's namespace.
+func (h *sftpHandler) fullName(name string) string {
+	return path.Join(h.user.namespace(), name)
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	file, err := h.view.OpenFile(h.ctx, r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	reader, ok := file.(*davReader)
+	if !ok {
+		file.Close()
+		return nil, errors.New("is a directory")
+	}
+	h.logger.Info("SFTP file downloaded", "filename", h.fullName(davName(r.Filepath)))
+	return reader, nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	name := davName(r.Filepath)
+	if name == "" {
+		return nil, fs.ErrPermission
+	}
+	info, err := h.view.stat(h.ctx, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	flags := r.Pflags()
+	switch {
+	case info != nil && info.dir:
+		return nil, errors.New("is a directory")
+	case info != nil && flags.Excl:
+		return nil, fs.ErrExist
+	}
+	// Like a file system, files can only be created in existing directories
+	if parent := path.Dir(name); info == nil && parent != "." {
+		if parentInfo, err := h.view.stat(h.ctx, parent); err != nil {
+			return nil, err
+		} else if !parentInfo.dir {
+			return nil, notExist("open", parent)
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "tempo-sftp-*")
+	if err != nil {
+		return nil, err
+	}
+	if info != nil && !flags.Trunc {
+		// Keep the current content so transfers can be resumed
+		if _, err := h.view.store.Download(h.ctx, name, tmp); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	}
+	return &sftpWriter{File: tmp, handler: h, name: name}, nil
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	name := davName(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		return nil // Stored files have no modes or times to change
+	case "Mkdir":
+		return h.view.Mkdir(h.ctx, name, 0755)
+	case "Rename":
+		moved, err := h.view.matching(h.ctx, name)
+		if err != nil {
+			return err
+		}
+		if err := h.view.Rename(h.ctx, name, davName(r.Target)); err != nil {
+			return err
+		}
+		for _, stored := range moved {
+			h.app.dropLocalCopy(h.fullName(stored))
+		}
+		h.logger.Info("SFTP file renamed", "from", h.fullName(name), "to", h.fullName(davName(r.Target)))
+		return nil
+	case "Rmdir":
+		info, err := h.view.stat(h.ctx, name)
+		if err != nil {
+			return err
+		}
+		if !info.dir || name == "" {
+			return errors.New("not a directory")
+		}
+		if children, _, err := h.view.children(h.ctx, name); err != nil {
+			return err
+		} else if len(children) > 0 {
+			return errors.New("directory not empty")
+		}
+		return h.view.RemoveAll(h.ctx, name)
+	case "Remove":
+		if info, err := h.view.stat(h.ctx, name); err != nil {
+			return err
+		} else if info.dir {
+			return errors.New("is a directory")
+		}
+		// Like DELETE /:filename, so the queue and local copy go too
+		err := h.app.RemoveFile(h.ctx, h.fullName(name))
+		if errors.Is(err, crates.ErrNotFound) {
+			return notExist("remove", name)
+		} else if err != nil {
+			return err
+		}
+		h.logger.Info("SFTP file removed", "filename", h.fullName(name))
+		return nil
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	name := davName(r.Filepath)
+	switch r.Method {
+	case "List":
+		info, err := h.view.stat(h.ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if !info.dir {
+			return nil, errors.New("not a directory")
+		}
+		children, _, err := h.view.children(h.ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return sftpLister(children), nil
+	case "Stat":
+		info, err := h.view.stat(h.ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return sftpLister{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// sftpLister hands out a directory listing in pages.
+type sftpLister []fs.FileInfo
+
+func (l sftpLister) ListAt(page []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(page, l[offset:])
+	if n < len(page) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpWriter collects an upload in a temporary file and stores it through
+// App.StoreFile once the client closes it.
+type sftpWriter struct {
+	*os.File
+	handler *sftpHandler
+	name    string
+	failed  error
+}
+
+// TransferError is called when the session ends with the file still open,
+// which leaves it incomplete.
+func (w *sftpWriter) TransferError(err error) {
+	w.failed = err
+}
+
+func (w *sftpWriter) Close() error {
+	defer os.Remove(w.File.Name())
+	defer w.File.Close()
+	if w.failed != nil {
+		return w.failed
+	}
+
+	h := w.handler
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	written, _, err := h.app.StoreFile(h.ctx, h.fullName(w.name), w.File, false)
+	if err != nil {
+		h.logger.Error("SFTP upload failed", "filename", h.fullName(w.name), "error", err)
+		return err
+	}
+	h.view.fileStored(w.name)
+	h.logger.Info("SFTP file uploaded", "filename", h.fullName(w.name), "bytes", written)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Share is a link that lets anyone holding the token download one file until
+// it expires.
+type Share struct {
+	Token     string    `json:"token"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Downloads int       `json:"downloads"`
+}
+
+// ShareStore keeps share links in memory and persists them to a JSON file so
+// they survive restarts.
+type ShareStore struct {
+	path   string
+	mutex  sync.Mutex
+	shares map[string]*Share
+}
+
+// NewShareStore loads the shares saved at path, dropping expired ones.
+func NewShareStore(path string) (*ShareStore, error) {
+	s := &ShareStore{path: path, shares: make(map[string]*Share)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read shares: %w", err)
+	}
+
+	var saved []*Share
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse shares: %w", err)
+	}
+	now := time.Now()
+	for _, share := range saved {
+		if share.ExpiresAt.After(now) {
+			s.shares[share.Token] = share
+		}
+	}
+	return s, nil
+}
+
+// Create makes a new share link for name valid for ttl.
+func (s *ShareStore) Create(name string, ttl time.Duration) (*Share, error) {
+	token := make([]byte, 18)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	share := &Share{
+		Token:     base64.RawURLEncoding.EncodeToString(token),
+		Name:      name,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.shares[share.Token] = share
+	return share, s.save()
+}
+
+// Open returns the share for token and counts a download, or false if the
+// token is unknown or expired.
+func (s *ShareStore) Open(token string) (Share, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	share, ok := s.shares[token]
+	if !ok {
+		return Share{}, false
+	}
+	if time.Now().After(share.ExpiresAt) {
+		delete(s.shares, token)
+		s.save()
+		return Share{}, false
+	}
+	share.Downloads++
+	s.save()
+	return *share, true
+}
+
+// RemoveFile revokes every share pointing at name.
+func (s *ShareStore) RemoveFile(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for token, share := range s.shares {
+		if share.Name == name {
+			delete(s.shares, token)
+		}
+	}
+	s.save()
+}
+
+// save writes the shares to disk; the caller holds the mutex.
+func (s *ShareStore) save() error {
+	list := make([]*Share, 0, len(s.shares))
+	for _, share := range s.shares {
+		list = append(list, share)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0600)
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"fmt"
+	"log/slog"
+	"slices"
 	"strings"
 	"sync"
 )
@@ -201,6 +202,34 @@ func (q *FileQueue) IsEmpty() bool {
 	return len(q.items) == 0
 }
 
+// Contains reports whether filename is in the queue
+func (q *FileQueue) Contains(filename string) bool {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	return slices.Contains(q.items, filename)
+}
+
+// Remove drops every occurrence of filename from the queue
+func (q *FileQueue) Remove(filename string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.items = slices.DeleteFunc(q.items, func(item string) bool { return item == filename })
+}
+
+// Replace swaps the queue contents for files
+func (q *FileQueue) Replace(files []string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.items = slices.Clone(files)
+}
+
+// Len returns the number of files in the queue
+func (q *FileQueue) Len() int {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	return len(q.items)
+}
+
 // ToSlice returns a copy of the queue as a slice
 func (q *FileQueue) ToSlice() []string {
 	q.mutex.RLock()
@@ -217,11 +246,11 @@ func (q *FileQueue) PrintQueue() {
 	defer q.mutex.RUnlock()
 
 	if len(q.items) == 0 {
-		fmt.Println("Queue is empty")
+		slog.Debug("Queue is empty")
 		return
 	}
 
-	fmt.Printf("Queue contents: %s\n", strings.Join(q.items, ", "))
+	slog.Debug("Queue contents", "size", len(q.items), "items", strings.Join(q.items, ", "))
 }
 
 
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"tempo/crates"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How much the admin dashboard shows.
+const (
+	activityHistory = 50 // Cleanup runs and errors kept
+	statsTopN       = 10 // Largest files and top uploaders
+	statsDays       = 30 // Days of uploads per day
+)
+
+// UploaderStats totals the uploads of one identity since the server started.
+type UploaderStats struct {
+	Name       string    `json:"name"`
+	Files      int       `json:"files"`
+	Bytes      int64     `json:"bytes"`
+	LastUpload time.Time `json:"last_upload"`
+}
+
+// CleanupRun is one run of a background cleanup job.
+type CleanupRun struct {
+	Time    time.Time `json:"time"`
+	Job     string    `json:"job"`
+	Outcome string    `json:"outcome"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// LoggedError is an error-level log line.
+type LoggedError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+	Attrs   string    `json:"attrs,omitempty"`
+}
+
+// Activity keeps what the admin dashboard shows that is stored nowhere else:
+// who uploaded how much and when, the cleanup history and recent errors. It
+// lives in memory and starts empty with the process.
+type Activity struct {
+	mutex     sync.Mutex
+	uploaders map[string]*UploaderStats
+	days      map[string]*dayStats // By date, the last statsDays only
+	cleanups  []CleanupRun
+	errors    []LoggedError
+}
+
+var activity = &Activity{uploaders: make(map[string]*UploaderStats), days: make(map[string]*dayStats)}
+
+// recordUpload counts a stored file for the uploader in ctx and for today.
+func (a *Activity) recordUpload(ctx context.Context, size int64) {
+	name := uploaderFrom(ctx)
+	now := time.Now().UTC()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	stats, ok := a.uploaders[name]
+	if !ok {
+		stats = &UploaderStats{Name: name}
+		a.uploaders[name] = stats
+	}
+	stats.Files++
+	stats.Bytes += size
+	stats.LastUpload = now
+
+	date := now.Format(time.DateOnly)
+	day, ok := a.days[date]
+	if !ok {
+		day = &dayStats{Date: date}
+		a.days[date] = day
+		oldest := now.AddDate(0, 0, -statsDays+1).Format(time.DateOnly)
+		for date := range a.days {
+			if date < oldest {
+				delete(a.days, date)
+			}
+		}
+	}
+	day.Files++
+	day.Bytes += size
+}
+
+// recordCleanup counts a run of a background cleanup job in the metrics and
+// the dashboard history.
+func recordCleanup(job, outcome, detail string) {
+	cleanupRuns.WithLabelValues(job, outcome).Inc()
+	activity.mutex.Lock()
+	defer activity.mutex.Unlock()
+	activity.cleanups = appendCapped(activity.cleanups,
+		CleanupRun{Time: time.Now().UTC(), Job: job, Outcome: outcome, Detail: detail})
+}
+
+func appendCapped[T any](list []T, item T) []T {
+	if len(list) == activityHistory {
+		list = append(list[:0], list[1:]...)
+	}
+	return append(list, item)
+}
+
+// errorRecorder passes log records on to the next handler and keeps the
+// error-level ones for the dashboard.
+type errorRecorder struct {
+	slog.Handler
+	attrs []slog.Attr
+}
+
+func (h errorRecorder) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelError {
+		var attrs []string
+		for _, attr := range h.attrs {
+			attrs = append(attrs, attr.String())
+		}
+		record.Attrs(func(attr slog.Attr) bool {
+			attrs = append(attrs, attr.String())
+			return true
+		})
+		activity.mutex.Lock()
+		activity.errors = appendCapped(activity.errors,
+			LoggedError{Time: record.Time.UTC(), Message: record.Message, Attrs: strings.Join(attrs, " ")})
+		activity.mutex.Unlock()
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h errorRecorder) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return errorRecorder{Handler: h.Handler.WithAttrs(attrs), attrs: append(slices.Clip(h.attrs), attrs...)}
+}
+
+func (h errorRecorder) WithGroup(name string) slog.Handler {
+	return errorRecorder{Handler: h.Handler.WithGroup(name), attrs: h.attrs}
+}
+
+type uploaderKey struct{}
+
+// withUploader records who is uploading through ctx, e.g. "admin",
+// "key:backup", "user:partner" or "ip:192.0.2.7".
+func withUploader(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, uploaderKey{}, name)
+}
+
+func uploaderFrom(ctx context.Context) string {
+	if name, ok := ctx.Value(uploaderKey{}).(string); ok {
+		return name
+	}
+	return "unknown"
+}
+
+// bucketStats totals the files of one storage bucket, or of the upload
+// directory.
+type bucketStats struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+type largeFile struct {
+	Bucket string `json:"bucket"`
+	crates.FileInfo
+}
+
+type dayStats struct {
+	Date  string `json:"date"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// adminStats answers GET /admin/stats with storage totals and system status
+// for the dashboard.
+func (a *App) adminStats(ctx *gin.Context) {
+	reqCtx := ctx.Request.Context()
+	names, err := a.buckets.Names(reqCtx)
+	if err != nil {
+		reqLogger(a.logger, ctx).Error("Failed to list buckets", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list buckets"})
+		return
+	}
+
+	// Stored files per bucket
+	buckets := []bucketStats{}
+	largest := []largeFile{}
+	totalFiles, totalBytes := 0, int64(0)
+	for _, name := range names {
+		infos, err := a.buckets.Bucket(name).List(reqCtx)
+		if err != nil {
+			reqLogger(a.logger, ctx).Error("Failed to list bucket", "bucket", name, "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list bucket " + name})
+			return
+		}
+		stats := bucketStats{Name: name, Files: len(infos)}
+		for _, info := range infos {
+			stats.Bytes += info.Size
+			largest = append(largest, largeFile{Bucket: name, FileInfo: info})
+		}
+		buckets = append(buckets, stats)
+		totalFiles += stats.Files
+		totalBytes += stats.Bytes
+	}
+	slices.SortFunc(largest, func(x, y largeFile) int { return cmp.Compare(y.Size, x.Size) })
+	largest = largest[:min(len(largest), statsTopN)]
+
+	// Copies kept in the upload directory until the auto-cleanup
+	queued := a.queue.ToSlice()
+	local := bucketStats{Name: "upload_dir", Files: len(queued)}
+	for _, name := range queued {
+		if info, err := os.Stat(a.localPath(name)); err == nil {
+			local.Bytes += info.Size()
+		}
+	}
+
+	// Uploads as they happened, files cleaned up since included
+	today := time.Now().UTC()
+	days := make([]dayStats, statsDays)
+	activity.mutex.Lock()
+	for i := range days {
+		days[i].Date = today.AddDate(0, 0, i-statsDays+1).Format(time.DateOnly)
+		if day, ok := activity.days[days[i].Date]; ok {
+			days[i] = *day
+		}
+	}
+	uploaders := make([]UploaderStats, 0, len(activity.uploaders))
+	for _, stats := range activity.uploaders {
+		uploaders = append(uploaders, *stats)
+	}
+	cleanups := append([]CleanupRun{}, activity.cleanups...)
+	errs := append([]LoggedError{}, activity.errors...)
+	activity.mutex.Unlock()
+	slices.SortFunc(uploaders, func(x, y UploaderStats) int { return cmp.Compare(y.Bytes, x.Bytes) })
+	uploaders = uploaders[:min(len(uploaders), statsTopN)]
+	slices.Reverse(cleanups) // Newest first
+	slices.Reverse(errs)
+
+	disk := gin.H{"path": a.uploadDir}
+	if free, err := freeDiskBytes(a.uploadDir); err != nil {
+		disk["error"] = err.Error()
+	} else {
+		disk["free_bytes"] = free
+		disk["min_free_bytes"] = mb(currentConfig().Ready.MinFreeMB)
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"generated_at":    time.Now().UTC(),
+		"uptime_seconds":  int64(time.Since(a.health.started).Seconds()),
+		"state":           stateNames[a.health.state.Load()],
+		"storage":         currentConfig().Server.Storage,
+		"totals":          gin.H{"files": totalFiles, "bytes": totalBytes},
+		"buckets":         buckets,
+		"upload_dir":      local,
+		"largest_files":   largest,
+		"uploads_per_day": days,
+		"top_uploaders":   uploaders,
+		"queue_depth":     a.queue.Len(),
+		"cleanup_history": cleanups,
+		"mongo":           runCheck(reqCtx, a.health.checkMongo),
+		"disk":            disk,
+		"workers":         runCheck(reqCtx, a.health.checkWorkers),
+		"recent_errors":   errs,
+	})
+}
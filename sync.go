@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"tempo/crates"
+	"time"
+)
+
+// defaultSyncState is the state file kept in the synced directory.
+const defaultSyncState = ".tempo-sync.json"
+
+// syncAction is what sync does with one file.
+type syncAction string
+
+const (
+	actionUpload       syncAction = "upload"
+	actionDownload     syncAction = "download"
+	actionDeleteRemote syncAction = "delete-remote"
+	actionDeleteLocal  syncAction = "delete-local"
+	actionConflict     syncAction = "conflict"
+)
+
+// localFile is a file found while walking the local tree.
+type localFile struct {
+	size    int64
+	modTime time.Time
+	sha256  string // Computed lazily, see localHash
+}
+
+// syncEntry records a file as it was after the last successful sync; the
+// next run compares both sides against it to see which one changed.
+type syncEntry struct {
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mod_time"`
+	SHA256       string    `json:"sha256"`
+	RemoteSHA256 string    `json:"remote_sha256,omitempty"`
+	UploadedAt   time.Time `json:"uploaded_at"`
+}
+
+// syncState is the JSON state file, keyed by path relative to the root.
+type syncState struct {
+	Server string                `json:"server"`
+	Prefix string                `json:"prefix,omitempty"`
+	Files  map[string]*syncEntry `json:"files"`
+}
+
+// syncPlan is one planned step, and its outcome once run.
+type syncPlan struct {
+	Action syncAction `json:"action"`
+	Path   string     `json:"path"`
+	Reason string     `json:"reason"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// patternList is a repeatable flag holding glob patterns.
+type patternList []string
+
+func (p *patternList) String() string     { return strings.Join(*p, ",") }
+func (p *patternList) Set(v string) error { *p = append(*p, v); return nil }
+
+// matchAny reports whether rel, or its base name, matches one of the patterns.
+func (p patternList) matchAny(rel string) bool {
+	for _, pattern := range p {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// syncer holds one run of the sync command.
+type syncer struct {
+	root     string
+	prefix   string
+	twoWay   bool
+	delete   bool
+	conflict string
+	include  patternList
+	exclude  patternList
+
+	remote Remote
+	local  map[string]*localFile
+	stored map[string]crates.FileInfo
+	state  *syncState
+	mutex  sync.Mutex // Guards state while transfers run in parallel
+}
+
+func syncCommand(args []string) int {
+	flags, opts := newClientFlags("sync")
+	s := &syncer{}
+	dryRun := flags.Bool("dry-run", false, "only print what would be done")
+	parallel := flags.Int("parallel", 4, "number of files transferred at once")
+	statePath := flags.String("state", "", "state file (default <dir>/"+defaultSyncState+")")
+	flags.StringVar(&s.prefix, "prefix", "", "remote folder the directory is mirrored into, e.g. project/")
+	flags.BoolVar(&s.twoWay, "two-way", false, "also download remote changes and propagate deletions both ways")
+	flags.BoolVar(&s.delete, "delete", false, "one-way mode: delete remote files that are missing locally")
+	flags.StringVar(&s.conflict, "conflict", "skip", "two-way mode: on conflicts keep skip, local, remote or newer")
+	flags.Var(&s.include, "include", "only sync paths matching this glob (repeatable)")
+	flags.Var(&s.exclude, "exclude", "skip paths matching this glob (repeatable)")
+	if code, ok := parseClientFlags(flags, opts, args, 1); !ok {
+		return code
+	}
+	switch s.conflict {
+	case "skip", "local", "remote", "newer":
+	default:
+		return fail("sync", fmt.Errorf("-conflict: %q must be skip, local, remote or newer", s.conflict))
+	}
+	if *parallel < 1 {
+		return fail("sync", errors.New("-parallel must be at least 1"))
+	}
+	if s.prefix != "" {
+		prefix, err := cleanName(s.prefix)
+		if err != nil {
+			return fail("sync", fmt.Errorf("-prefix: %w", err))
+		}
+		s.prefix = prefix + "/"
+	}
+
+	s.root = flags.Arg(0)
+	if info, err := os.Stat(s.root); err != nil {
+		return fail("sync", err)
+	} else if !info.IsDir() {
+		return fail("sync", fmt.Errorf("%s is not a directory", s.root))
+	}
+	if *statePath == "" {
+		*statePath = filepath.Join(s.root, defaultSyncState)
+	}
+
+	remote, err := opts.remote()
+	if err != nil {
+		return fail("sync", err)
+	}
+	s.remote = remote
+	ctx, stop := cliContext()
+	defer stop()
+	defer remote.Close(context.Background())
+
+	server := opts.server
+	if opts.direct {
+		server = "direct"
+	}
+	if s.state, err = loadSyncState(*statePath, server, s.prefix); err != nil {
+		return fail("sync", err)
+	}
+	if err := s.scan(ctx, *statePath); err != nil {
+		return fail("sync", err)
+	}
+
+	plans := s.plan()
+	if !*dryRun {
+		s.run(ctx, plans, *parallel)
+		if err := s.state.save(*statePath); err != nil {
+			return fail("sync", err)
+		}
+	}
+	return s.report(opts, plans, *dryRun)
+}
+
+// loadSyncState reads the state file. State recorded against another server
+// or prefix says nothing about this one, so it is ignored.
+func loadSyncState(statePath, server, prefix string) (*syncState, error) {
+	fresh := &syncState{Server: server, Prefix: prefix, Files: make(map[string]*syncEntry)}
+
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fresh, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read sync state: %w", err)
+	}
+	var state syncState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse sync state %s: %w", statePath, err)
+	}
+	if state.Server != server || state.Prefix != prefix || state.Files == nil {
+		return fresh, nil
+	}
+	return &state, nil
+}
+
+func (st *syncState) save(statePath string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write sync state: %w", err)
+	}
+	return os.Rename(tmp, statePath)
+}
+
+// selected applies the include and exclude patterns to rel.
+func (s *syncer) selected(rel string) bool {
+	if s.exclude.matchAny(rel) {
+		return false
+	}
+	return len(s.include) == 0 || s.include.matchAny(rel)
+}
+
+// scan walks the local tree and lists the remote files under the prefix.
+func (s *syncer) scan(ctx context.Context, statePath string) error {
+	s.local = make(map[string]*localFile)
+	absState, _ := filepath.Abs(statePath)
+
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if s.exclude.matchAny(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !s.selected(rel) {
+			return nil
+		}
+		if abs, _ := filepath.Abs(p); abs == absState || abs == absState+".tmp" || strings.HasSuffix(p, ".part") {
+			return nil // Our own state file and unfinished downloads
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		s.local[rel] = &localFile{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: %w", s.root, err)
+	}
+
+	infos, err := s.remote.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list remote files: %w", err)
+	}
+	s.stored = make(map[string]crates.FileInfo)
+	for _, info := range infos {
+		rel, ok := strings.CutPrefix(info.Name, s.prefix)
+		if ok && rel != "" && s.selected(rel) {
+			s.stored[rel] = info
+		}
+	}
+	return nil
+}
+
+// localHash returns the sha256 of a local file, hashing it on first use.
+func (s *syncer) localHash(rel string) (string, error) {
+	file := s.local[rel]
+	if file.sha256 != "" {
+		return file.sha256, nil
+	}
+	// Unchanged since the last sync, the recorded hash is still right
+	if entry := s.state.Files[rel]; entry != nil && entry.Size == file.size && entry.ModTime.Equal(file.modTime) && entry.SHA256 != "" {
+		file.sha256 = entry.SHA256
+		return file.sha256, nil
+	}
+
+	f, err := os.Open(filepath.Join(s.root, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	file.sha256 = hex.EncodeToString(h.Sum(nil))
+	return file.sha256, nil
+}
+
+// sameContent compares a local and a remote file, by hash when the server
+// recorded one and by size and time otherwise.
+func (s *syncer) sameContent(rel string) bool {
+	file, stored := s.local[rel], s.stored[rel]
+	if file.size != stored.Size {
+		return false
+	}
+	if stored.SHA256 == "" {
+		return !file.modTime.After(stored.UploadedAt) // Older uploads have no hash
+	}
+	sum, err := s.localHash(rel)
+	return err == nil && sum == stored.SHA256
+}
+
+// localChanged reports whether a local file differs from the recorded state.
+func (s *syncer) localChanged(rel string) bool {
+	entry := s.state.Files[rel]
+	if entry == nil {
+		return true
+	}
+	file := s.local[rel]
+	if file.size != entry.Size {
+		return true
+	}
+	if file.modTime.Equal(entry.ModTime) {
+		return false
+	}
+	sum, err := s.localHash(rel) // Touched, but maybe not edited
+	return err != nil || sum != entry.SHA256
+}
+
+// remoteChanged reports whether a remote file differs from the recorded state.
+func (s *syncer) remoteChanged(rel string) bool {
+	entry := s.state.Files[rel]
+	if entry == nil {
+		return true
+	}
+	stored := s.stored[rel]
+	if stored.SHA256 != "" && entry.RemoteSHA256 != "" {
+		return stored.SHA256 != entry.RemoteSHA256
+	}
+	return stored.Size != entry.Size || !stored.UploadedAt.Equal(entry.UploadedAt)
+}
+
+// plan decides what to do with every file on either side.
+func (s *syncer) plan() []syncPlan {
+	names := make(map[string]struct{}, len(s.local)+len(s.stored))
+	for rel := range s.local {
+		names[rel] = struct{}{}
+	}
+	for rel := range s.stored {
+		names[rel] = struct{}{}
+	}
+	for rel := range s.state.Files {
+		if _, ok := names[rel]; !ok {
+			delete(s.state.Files, rel) // Gone on both sides
+		}
+	}
+
+	var plans []syncPlan
+	add := func(action syncAction, rel, reason string) {
+		plans = append(plans, syncPlan{Action: action, Path: rel, Reason: reason})
+	}
+	for rel := range names {
+		_, isLocal := s.local[rel]
+		_, isRemote := s.stored[rel]
+		_, known := s.state.Files[rel]
+
+		if !s.twoWay {
+			switch {
+			case isLocal && !isRemote:
+				add(actionUpload, rel, "new")
+			case isLocal && !s.sameContent(rel):
+				add(actionUpload, rel, "changed")
+			case isLocal:
+				s.record(rel, nil)
+			case s.delete:
+				add(actionDeleteRemote, rel, "missing locally")
+			}
+			continue
+		}
+
+		switch {
+		case isLocal && isRemote:
+			localChanged, remoteChanged := s.localChanged(rel), s.remoteChanged(rel)
+			switch {
+			case !localChanged && !remoteChanged:
+			case s.sameContent(rel):
+				s.record(rel, nil) // Both ended up with the same content
+			case !remoteChanged:
+				add(actionUpload, rel, "changed locally")
+			case !localChanged:
+				add(actionDownload, rel, "changed remotely")
+			default:
+				s.resolve(rel, add)
+			}
+
+		case isLocal && known && !s.localChanged(rel):
+			add(actionDeleteLocal, rel, "deleted remotely")
+		case isLocal:
+			add(actionUpload, rel, "new")
+
+		case known && !s.remoteChanged(rel):
+			add(actionDeleteRemote, rel, "deleted locally")
+		default:
+			add(actionDownload, rel, "new remotely")
+		}
+	}
+
+	sort.Slice(plans, func(i, j int) bool { return plans[i].Path < plans[j].Path })
+	return plans
+}
+
+// resolve applies the -conflict policy to a file changed on both sides.
+func (s *syncer) resolve(rel string, add func(syncAction, string, string)) {
+	switch s.conflict {
+	case "local":
+		add(actionUpload, rel, "conflict, keeping local")
+	case "remote":
+		add(actionDownload, rel, "conflict, keeping remote")
+	case "newer":
+		if s.local[rel].modTime.After(s.stored[rel].UploadedAt) {
+			add(actionUpload, rel, "conflict, local is newer")
+		} else {
+			add(actionDownload, rel, "conflict, remote is newer")
+		}
+	default:
+		add(actionConflict, rel, "changed on both sides")
+	}
+}
+
+// record stores the current state of rel after it was synced; stored is the
+// new remote metadata when this run uploaded it.
+func (s *syncer) record(rel string, stored *crates.FileInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if stored != nil {
+		s.stored[rel] = *stored
+	}
+	file, remote := s.local[rel], s.stored[rel]
+	sum, _ := s.localHash(rel)
+	s.state.Files[rel] = &syncEntry{
+		Size:         file.size,
+		ModTime:      file.modTime,
+		SHA256:       sum,
+		RemoteSHA256: remote.SHA256,
+		UploadedAt:   remote.UploadedAt,
+	}
+}
+
+// forget drops rel from the state once it is gone on both sides.
+func (s *syncer) forget(rel string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.state.Files, rel)
+}
+
+// run carries out the plans with up to parallel transfers at once.
+func (s *syncer) run(ctx context.Context, plans []syncPlan, parallel int) {
+	work := make(chan *syncPlan)
+	var wg sync.WaitGroup
+	for range parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for plan := range work {
+				if err := s.apply(ctx, plan); err != nil {
+					plan.Error = err.Error()
+				}
+			}
+		}()
+	}
+	for i := range plans {
+		if plans[i].Action == actionConflict {
+			continue
+		}
+		if ctx.Err() != nil {
+			plans[i].Error = ctx.Err().Error()
+			continue
+		}
+		work <- &plans[i]
+	}
+	close(work)
+	wg.Wait()
+}
+
+func (s *syncer) apply(ctx context.Context, plan *syncPlan) error {
+	rel := plan.Path
+	localPath := filepath.Join(s.root, filepath.FromSlash(rel))
+
+	switch plan.Action {
+	case actionUpload:
+		file, err := os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		stored, err := s.remote.Upload(ctx, s.prefix+rel, file)
+		if err != nil {
+			return err
+		}
+		s.record(rel, stored)
+
+	case actionDownload:
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+		if _, err := downloadOne(ctx, s.remote, &clientOptions{quiet: true}, s.prefix+rel, localPath); err != nil {
+			return err
+		}
+		// Stamp with the upload time so "newer" compares like with like
+		s.mutex.Lock()
+		stored := s.stored[rel]
+		s.mutex.Unlock()
+		os.Chtimes(localPath, stored.UploadedAt, stored.UploadedAt)
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		s.local[rel] = &localFile{size: info.Size(), modTime: info.ModTime()}
+		s.mutex.Unlock()
+		s.record(rel, nil)
+
+	case actionDeleteRemote:
+		if err := s.remote.Delete(ctx, s.prefix+rel); err != nil && !errors.Is(err, crates.ErrNotFound) {
+			return err
+		}
+		s.forget(rel)
+
+	case actionDeleteLocal:
+		if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.forget(rel)
+	}
+	return nil
+}
+
+// report prints the plans and returns 1 if anything failed or conflicted.
+func (s *syncer) report(opts *clientOptions, plans []syncPlan, dryRun bool) int {
+	code := 0
+	counts := make(map[syncAction]int)
+	for _, plan := range plans {
+		if plan.Error != "" || plan.Action == actionConflict {
+			code = 1
+		}
+		if plan.Error == "" {
+			counts[plan.Action]++
+		}
+	}
+
+	if opts.json {
+		if plans == nil {
+			plans = []syncPlan{}
+		}
+		if err := printJSON(plans); err != nil {
+			return 1
+		}
+		return code
+	}
+
+	for _, plan := range plans {
+		switch {
+		case plan.Error != "":
+			fmt.Fprintf(os.Stderr, "%-13s %s: %s\n", plan.Action, plan.Path, plan.Error)
+		case plan.Action == actionConflict:
+			fmt.Fprintf(os.Stderr, "%-13s %s (%s)\n", plan.Action, plan.Path, plan.Reason)
+		case !opts.quiet:
+			fmt.Printf("%-13s %s (%s)\n", plan.Action, plan.Path, plan.Reason)
+		}
+	}
+	if !opts.quiet {
+		verb := "synced"
+		if dryRun {
+			verb = "would sync (dry run)"
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d uploaded, %d downloaded, %d deleted, %d conflicts\n", verb,
+			counts[actionUpload], counts[actionDownload], counts[actionDeleteRemote]+counts[actionDeleteLocal], counts[actionConflict])
+	}
+	return code
+}
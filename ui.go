@@ -0,0 +1,28 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// registerUI serves the embedded web UI under /ui, with the admin dashboard
+// at /admin. Both are single pages working against the JSON routes.
+func registerUI(r *gin.Engine) {
+	web, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err) // The directory is embedded at build time
+	}
+	r.StaticFS("/ui", http.FS(web))
+	r.GET("/", func(ctx *gin.Context) {
+		ctx.Redirect(http.StatusFound, "/ui/")
+	})
+	r.GET("/admin", func(ctx *gin.Context) {
+		ctx.Redirect(http.StatusFound, "/ui/admin.html")
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"io"
+	"strings"
+	"tempo/crates"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// findUser returns the configured user called name.
+func findUser(name string) (User, bool) {
+	for _, user := range currentConfig().Users {
+		if user.Name == name {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// namespace returns the folder the user is confined to, "" for all of it.
+func (u User) namespace() string {
+	switch u.Namespace {
+	case "":
+		return u.Name
+	case "/":
+		return ""
+	}
+	return strings.Trim(u.Namespace, "/")
+}
+
+// checkPassword reports whether password is the user's; users without one
+// can only log in with a key.
+func (u User) checkPassword(password string) bool {
+	return u.Password != "" && subtle.ConstantTimeCompare([]byte(password), []byte(u.Password)) == 1
+}
+
+// authorizedKey reports whether key is one of the user's authorized keys.
+func (u User) authorizedKey(key ssh.PublicKey) bool {
+	for _, line := range u.AuthorizedKeys {
+		authorized, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err == nil && bytes.Equal(authorized.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceStore shows the files below prefix of store as if they were at
+// its root. An empty prefix shows everything.
+type namespaceStore struct {
+	store  crates.Backend
+	prefix string // "" or ending in "/"
+}
+
+func newNamespaceStore(store crates.Backend, namespace string) crates.Backend {
+	if namespace == "" {
+		return store
+	}
+	return namespaceStore{store: store, prefix: namespace + "/"}
+}
+
+func (n namespaceStore) List(ctx context.Context) ([]crates.FileInfo, error) {
+	infos, err := n.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var inside []crates.FileInfo
+	for _, info := range infos {
+		if name, ok := strings.CutPrefix(info.Name, n.prefix); ok {
+			info.Name = name
+			inside = append(inside, info)
+		}
+	}
+	return inside, nil
+}
+
+func (n namespaceStore) Stat(ctx context.Context, name string) (*crates.FileInfo, error) {
+	info, err := n.store.Stat(ctx, n.prefix+name)
+	if err != nil {
+		return nil, err
+	}
+	info.Name = name
+	return info, nil
+}
+
+func (n namespaceStore) Upload(ctx context.Context, name string, r io.Reader) (*crates.FileInfo, error) {
+	info, err := n.store.Upload(ctx, n.prefix+name, r)
+	if err != nil {
+		return nil, err
+	}
+	info.Name = name
+	return info, nil
+}
+
+func (n namespaceStore) Download(ctx context.Context, name string, w io.Writer) (int64, error) {
+	return n.store.Download(ctx, n.prefix+name, w)
+}
+
+func (n namespaceStore) DownloadRange(ctx context.Context, name string, offset, length int64, w io.Writer) (int64, error) {
+	return n.store.DownloadRange(ctx, n.prefix+name, offset, length, w)
+}
+
+func (n namespaceStore) Rename(ctx context.Context, oldName, newName string) error {
+	return n.store.Rename(ctx, n.prefix+oldName, n.prefix+newName)
+}
+
+func (n namespaceStore) Delete(ctx context.Context, name string) error {
+	return n.store.Delete(ctx, n.prefix+name)
+}
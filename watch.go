@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// defaultWatchState is the state file kept in the watched directory.
+const defaultWatchState = ".tempo-watch.json"
+
+// watchEntry records one file that was uploaded.
+type watchEntry struct {
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+	SHA256     string    `json:"sha256"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// watcher uploads files that appear in a directory once they stop changing.
+type watcher struct {
+	root      string
+	prefix    string
+	after     string // none, delete or move
+	moveTo    string
+	debounce  time.Duration
+	include   patternList
+	exclude   patternList
+	statePath string
+
+	remote Remote
+	logger *slog.Logger
+
+	mutex   sync.Mutex
+	sent    map[string]*watchEntry // Keyed by path relative to root
+	pending map[string]time.Time   // Last change seen for files not yet uploaded
+}
+
+func watchCommand(args []string) int {
+	flags, opts := newClientFlags("watch")
+	w := &watcher{}
+	scan := flags.Bool("scan", true, "upload files already in the directory at startup")
+	flags.DurationVar(&w.debounce, "debounce", 2*time.Second, "how long a file must stay unchanged before it is uploaded")
+	flags.StringVar(&w.statePath, "state", "", "state file (default <dir>/"+defaultWatchState+")")
+	flags.StringVar(&w.prefix, "prefix", "", "remote folder uploads go into, e.g. scans/")
+	flags.StringVar(&w.after, "after", "none", "what to do with a file after a verified upload: none, delete or move")
+	flags.StringVar(&w.moveTo, "move-to", "", "directory for -after move (default <dir>/uploaded)")
+	flags.Var(&w.include, "include", "only upload paths matching this glob (repeatable)")
+	flags.Var(&w.exclude, "exclude", "skip paths matching this glob (repeatable)")
+	if code, ok := parseClientFlags(flags, opts, args, 1); !ok {
+		return code
+	}
+	switch w.after {
+	case "none", "delete", "move":
+	default:
+		return fail("watch", fmt.Errorf("-after: %q must be none, delete or move", w.after))
+	}
+	if w.debounce <= 0 {
+		return fail("watch", errors.New("-debounce must be positive"))
+	}
+	if w.prefix != "" {
+		prefix, err := cleanName(w.prefix)
+		if err != nil {
+			return fail("watch", fmt.Errorf("-prefix: %w", err))
+		}
+		w.prefix = prefix + "/"
+	}
+
+	w.root = flags.Arg(0)
+	if info, err := os.Stat(w.root); err != nil {
+		return fail("watch", err)
+	} else if !info.IsDir() {
+		return fail("watch", fmt.Errorf("%s is not a directory", w.root))
+	}
+	if w.statePath == "" {
+		w.statePath = filepath.Join(w.root, defaultWatchState)
+	}
+	if w.moveTo == "" {
+		w.moveTo = filepath.Join(w.root, "uploaded")
+	}
+
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, nil)
+	if opts.json {
+		handler = slog.NewJSONHandler(os.Stdout, nil)
+	}
+	w.logger = slog.New(handler).With("component", "watch")
+
+	remote, err := opts.remote()
+	if err != nil {
+		return fail("watch", err)
+	}
+	w.remote = remote
+	defer remote.Close(context.Background())
+
+	if err := w.loadState(); err != nil {
+		return fail("watch", err)
+	}
+
+	ctx, stop := cliContext()
+	defer stop()
+	if err := w.run(ctx, *scan); err != nil {
+		return fail("watch", err)
+	}
+	return 0
+}
+
+func (w *watcher) loadState() error {
+	w.sent = make(map[string]*watchEntry)
+	w.pending = make(map[string]time.Time)
+
+	data, err := os.ReadFile(w.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read watch state: %w", err)
+	}
+	if err := json.Unmarshal(data, &w.sent); err != nil {
+		return fmt.Errorf("failed to parse watch state %s: %w", w.statePath, err)
+	}
+	if w.sent == nil {
+		w.sent = make(map[string]*watchEntry)
+	}
+	return nil
+}
+
+// saveState writes the state file; the caller holds the mutex.
+func (w *watcher) saveState() error {
+	data, err := json.MarshalIndent(w.sent, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := w.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.statePath)
+}
+
+// relPath returns p relative to the root, or false for files that are not
+// ours to upload.
+func (w *watcher) relPath(p string) (string, bool) {
+	rel, err := filepath.Rel(w.root, p)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	if abs, _ := filepath.Abs(p); abs == w.absPath(w.statePath) || abs == w.absPath(w.statePath)+".tmp" {
+		return "", false
+	}
+	if w.after == "move" && w.within(p, w.moveTo) {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	base := filepath.Base(p)
+	// Editors and browsers write to hidden or partial files first
+	if strings.HasPrefix(base, ".") || strings.HasSuffix(base, "~") ||
+		strings.HasSuffix(base, ".part") || strings.HasSuffix(base, ".crdownload") || strings.HasSuffix(base, ".tmp") {
+		return "", false
+	}
+	if w.exclude.matchAny(rel) || (len(w.include) > 0 && !w.include.matchAny(rel)) {
+		return "", false
+	}
+	return rel, true
+}
+
+func (w *watcher) absPath(p string) string {
+	abs, _ := filepath.Abs(p)
+	return abs
+}
+
+// within reports whether p is dir or inside it.
+func (w *watcher) within(p, dir string) bool {
+	rel, err := filepath.Rel(w.absPath(dir), w.absPath(p))
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+// run watches the tree until ctx is cancelled.
+func (w *watcher) run(ctx context.Context, scan bool) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to start watcher: %w", err)
+	}
+	defer fsw.Close()
+
+	// Watch every directory; new ones are added as they appear
+	if err := w.addTree(fsw, w.root, scan); err != nil {
+		return err
+	}
+	w.logger.Info("Watching for new files", "dir", w.root, "debounce", w.debounce, "after", w.after)
+
+	ticker := time.NewTicker(max(w.debounce/4, 100*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.logger.Info("Watch stopped")
+			return nil
+
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			w.handleEvent(fsw, event)
+
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			w.logger.Error("Watcher error", "error", err)
+
+		case <-ticker.C:
+			w.uploadSettled(ctx)
+		}
+	}
+}
+
+// addTree watches dir and its subdirectories, marking existing files as
+// pending when mark is set.
+func (w *watcher) addTree(fsw *fsnotify.Watcher, dir string, mark bool) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != w.root && (strings.HasPrefix(d.Name(), ".") || (w.after == "move" && w.within(p, w.moveTo))) {
+				return filepath.SkipDir
+			}
+			if err := fsw.Add(p); err != nil {
+				return fmt.Errorf("failed to watch %s: %w", p, err)
+			}
+			return nil
+		}
+		if mark && d.Type().IsRegular() {
+			w.touch(p)
+		}
+		return nil
+	})
+}
+
+func (w *watcher) handleEvent(fsw *fsnotify.Watcher, event fsnotify.Event) {
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			// Files can land in a new directory before we watch it, so scan it too
+			if err := w.addTree(fsw, event.Name, true); err != nil {
+				w.logger.Error("Failed to watch new directory", "dir", event.Name, "error", err)
+			}
+			return
+		}
+	}
+	if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) || event.Has(fsnotify.Chmod) {
+		w.touch(event.Name)
+	}
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		if rel, ok := w.relPath(event.Name); ok {
+			w.mutex.Lock()
+			delete(w.pending, rel)
+			w.mutex.Unlock()
+		}
+	}
+}
+
+// touch restarts the debounce timer for p.
+func (w *watcher) touch(p string) {
+	rel, ok := w.relPath(p)
+	if !ok {
+		return
+	}
+	w.mutex.Lock()
+	w.pending[rel] = time.Now()
+	w.mutex.Unlock()
+}
+
+// uploadSettled uploads every pending file that has not changed for the
+// debounce period.
+func (w *watcher) uploadSettled(ctx context.Context) {
+	w.mutex.Lock()
+	var ready []string
+	for rel, last := range w.pending {
+		if time.Since(last) >= w.debounce {
+			ready = append(ready, rel)
+		}
+	}
+	w.mutex.Unlock()
+
+	for _, rel := range ready {
+		if ctx.Err() != nil {
+			return
+		}
+		w.mutex.Lock()
+		delete(w.pending, rel)
+		w.mutex.Unlock()
+
+		if err := w.upload(ctx, rel); err != nil {
+			w.logger.Error("Upload failed, will retry", "path", rel, "error", err)
+			w.mutex.Lock()
+			w.pending[rel] = time.Now()
+			w.mutex.Unlock()
+		}
+	}
+}
+
+// upload sends rel unless it was already sent unchanged, verifies the stored
+// checksum and then applies -after.
+func (w *watcher) upload(ctx context.Context, rel string) error {
+	localPath := filepath.Join(w.root, filepath.FromSlash(rel))
+	info, err := os.Stat(localPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // Gone before it settled
+	} else if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	w.mutex.Lock()
+	entry := w.sent[rel]
+	w.mutex.Unlock()
+	if entry != nil && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		return w.afterUpload(rel, localPath) // Sent before a restart, finish the job
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	stored, err := w.remote.Upload(ctx, w.prefix+rel, io.TeeReader(file, hash))
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	// Only trust the upload if the server stored exactly what we read, or
+	// says it received that before changing it (metadata stripping, hooks)
+	switch {
+	case stored == nil:
+		return errors.New("no file info returned for the upload")
+	case stored.OriginalSHA256 != "":
+		if stored.OriginalSHA256 != sum {
+			return errors.New("checksum received by the server does not match the local file")
+		}
+	case stored.SHA256 != sum || stored.Size != info.Size():
+		return errors.New("stored checksum does not match the local file")
+	}
+	if after, err := os.Stat(localPath); err != nil || after.Size() != info.Size() || !after.ModTime().Equal(info.ModTime()) {
+		w.touch(localPath) // Changed while uploading, send it again once settled
+		return nil
+	}
+
+	w.mutex.Lock()
+	w.sent[rel] = &watchEntry{Size: info.Size(), ModTime: info.ModTime(), SHA256: sum, UploadedAt: stored.UploadedAt}
+	err = w.saveState()
+	w.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to save watch state: %w", err)
+	}
+
+	w.logger.Info("File uploaded", "path", rel, "name", stored.Name, "bytes", stored.Size, "sha256", sum)
+	return w.afterUpload(rel, localPath)
+}
+
+// afterUpload deletes or moves a verified upload as -after asks.
+func (w *watcher) afterUpload(rel, localPath string) error {
+	switch w.after {
+	case "delete":
+		if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		w.logger.Info("Deleted local copy", "path", rel)
+	case "move":
+		dest := filepath.Join(w.moveTo, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(localPath, dest); err != nil {
+			return err
+		}
+		w.logger.Info("Moved local copy", "path", rel, "to", dest)
+	default:
+		return nil
+	}
+
+	// The file is no longer here, so its entry would never match again
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.sent, rel)
+	return w.saveState()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tempo/crates"
+)
+
+// storeRemote uploads through StoreFile, as the files API does.
+type storeRemote struct {
+	Remote
+	app *App
+}
+
+func (r storeRemote) Upload(ctx context.Context, name string, body io.Reader) (*crates.FileInfo, error) {
+	_, info, err := r.app.StoreFile(ctx, name, body, false)
+	return info, err
+}
+
+func TestWatchAcceptsStrippedUpload(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.Images.StripMetadata = true })
+	app, store := newTestApp(t)
+	root := t.TempDir()
+	w := &watcher{
+		root:      root,
+		after:     "delete",
+		statePath: filepath.Join(t.TempDir(), defaultWatchState),
+		remote:    storeRemote{app: app},
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	if err := w.loadState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A PNG with a text chunk, which the server drops
+	signature := []byte("\x89PNG\r\n\x1a\n")
+	text := []byte("\x00\x00\x00\x0atEXtComment\x00hi\x00\x00\x00\x00")
+	end := []byte("\x00\x00\x00\x00IEND\xae\x42\x60\x82")
+	local := bytes.Join([][]byte{signature, text, end}, nil)
+	if err := os.WriteFile(filepath.Join(root, "photo.png"), local, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.upload(context.Background(), "photo.png"); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	var stored bytes.Buffer
+	if _, err := store.Download(context.Background(), "photo.png", &stored); err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Join([][]byte{signature, end}, nil); !bytes.Equal(stored.Bytes(), want) {
+		t.Fatalf("stored %q, want the stripped %q", stored.Bytes(), want)
+	}
+	if _, err := os.Stat(filepath.Join(root, "photo.png")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("local file kept after the upload: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+// Tempo admin dashboard: renders GET /admin/stats, signed in with the admin
+// password, and refreshes it every 30 seconds.
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+const refreshEvery = 30 * 1000;
+
+let token = sessionStorage.getItem("tempo-admin") || "";
+let timer = null;
+
+function el(tag, props = {}, ...children) {
+  const node = Object.assign(document.createElement(tag), props);
+  node.append(...children);
+  return node;
+}
+
+function formatSize(bytes) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return (i === 0 ? bytes : bytes.toFixed(1)) + " " + units[i];
+}
+
+function formatUptime(seconds) {
+  const days = Math.floor(seconds / 86400);
+  const hours = Math.floor((seconds % 86400) / 3600);
+  const minutes = Math.floor((seconds % 3600) / 60);
+  return (days ? days + "d " : "") + (days || hours ? hours + "h " : "") + minutes + "m";
+}
+
+const time = (value) => new Date(value).toLocaleString();
+
+function row(...cells) {
+  return el("tr", {}, ...cells.map((cell) =>
+    typeof cell === "object" ? cell : el("td", { textContent: cell })));
+}
+
+function sizeCell(text) {
+  return el("td", { className: "size", textContent: text });
+}
+
+function fill(id, rows, empty) {
+  const columns = $(id).closest("table").querySelectorAll("th").length;
+  $(id).replaceChildren(...(rows.length ? rows : [el("tr", {}, el("td", { colSpan: columns, className: "empty", textContent: empty }))]));
+}
+
+function card(label, value, status) {
+  return el("div", { className: "card" + (status ? " " + status : "") },
+    el("span", { className: "label", textContent: label }),
+    el("strong", { textContent: value }));
+}
+
+function showSignIn(message) {
+  clearTimeout(timer);
+  $("signin").hidden = false;
+  $("dashboard").hidden = true;
+  $("toolbar").hidden = true;
+  $("signin-error").textContent = message || "";
+  $("token").focus();
+}
+
+$("signin").addEventListener("submit", (event) => {
+  event.preventDefault();
+  token = $("token").value;
+  sessionStorage.setItem("tempo-admin", token);
+  $("token").value = "";
+  load();
+});
+
+$("signout").addEventListener("click", () => {
+  token = "";
+  sessionStorage.removeItem("tempo-admin");
+  showSignIn();
+});
+
+$("refresh").addEventListener("click", () => load());
+
+async function load() {
+  clearTimeout(timer);
+  if (!token) {
+    showSignIn();
+    return;
+  }
+  let stats;
+  try {
+    const resp = await fetch("/admin/stats", { headers: { Authorization: "Bearer " + token } });
+    if (resp.status === 401) {
+      token = "";
+      sessionStorage.removeItem("tempo-admin");
+      showSignIn("The password was not accepted.");
+      return;
+    }
+    if (!resp.ok) throw new Error((await resp.json()).error || resp.statusText);
+    stats = await resp.json();
+  } catch (err) {
+    $("updated").textContent = "Update failed: " + err.message;
+    timer = setTimeout(load, refreshEvery);
+    return;
+  }
+  $("signin").hidden = true;
+  $("dashboard").hidden = false;
+  $("toolbar").hidden = false;
+  render(stats);
+  $("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+  timer = setTimeout(load, refreshEvery);
+}
+
+function render(stats) {
+  const mongo = stats.mongo;
+  const disk = stats.disk;
+  const lowDisk = disk.free_bytes !== undefined && disk.free_bytes < disk.min_free_bytes;
+  $("cards").replaceChildren(
+    card("Files stored", stats.totals.files.toLocaleString()),
+    card("Bytes stored", formatSize(stats.totals.bytes)),
+    card("Queue depth", stats.queue_depth.toLocaleString()),
+    card("Free disk", disk.free_bytes === undefined ? "n/a" : formatSize(disk.free_bytes), lowDisk ? "bad" : ""),
+    card("MongoDB", mongo.status === "ok" ? "connected (" + mongo.latency_ms + " ms)" : mongo.status === "skipped" ? mongo.detail : "down",
+      mongo.status === "fail" ? "bad" : ""),
+    card("State", stats.state, stats.state === "ready" ? "" : "bad"),
+    card("Uptime", formatUptime(stats.uptime_seconds)));
+
+  const most = Math.max(1, ...stats.uploads_per_day.map((day) => day.files));
+  $("days").replaceChildren(...stats.uploads_per_day.map((day) =>
+    el("div", { className: "bar", title: day.date + ": " + day.files + " files, " + formatSize(day.bytes) },
+      el("span", { style: "height:" + (100 * day.files / most) + "%" }))));
+
+  const buckets = stats.buckets.map((bucket) => row(bucket.name, sizeCell(bucket.files.toLocaleString()), sizeCell(formatSize(bucket.bytes))));
+  buckets.push(row("upload directory", sizeCell(stats.upload_dir.files.toLocaleString()), sizeCell(formatSize(stats.upload_dir.bytes))));
+  fill("buckets", buckets, "");
+
+  fill("largest", stats.largest_files.map((file) => row(file.name, file.bucket, sizeCell(formatSize(file.size)))), "No files stored.");
+  fill("uploaders", stats.top_uploaders.map((up) =>
+    row(up.name, sizeCell(up.files.toLocaleString()), sizeCell(formatSize(up.bytes)), time(up.last_upload))), "No uploads since the server started.");
+  fill("cleanups", stats.cleanup_history.map((run) =>
+    row(time(run.time), run.job, el("td", { className: run.outcome === "error" ? "error" : "", textContent: run.outcome }), run.detail || "")),
+    "No cleanup has run yet.");
+  fill("errors", stats.recent_errors.map((err) =>
+    row(time(err.time), el("td", {}, el("strong", { textContent: err.message }), el("div", { className: "empty", textContent: err.attrs || "" })))),
+    "No errors since the server started.");
+}
+
+load();
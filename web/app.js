@@ -0,0 +1,355 @@
+// Tempo web UI: a file browser over the JSON API under /api/v1, signed in
+// with the admin password or an API key secret used as bearer token.
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+const imageTypes = ["png", "jpg", "jpeg", "gif", "webp", "svg", "bmp", "avif", "ico", "tif", "tiff"];
+const thumbTypes = ["png", "jpg", "jpeg", "gif", "bmp", "tif", "tiff"]; // Server makes thumbnails of these
+const textTypes = ["txt", "md", "json", "csv", "log", "yaml", "yml", "xml", "html", "css", "js",
+  "ts", "go", "py", "sh", "ini", "toml", "conf", "sql", "env"];
+const previewBytes = 256 * 1024; // Text previews show the start of the file
+
+let token = sessionStorage.getItem("tempo-token") || "";
+let prefix = decodeURIComponent(location.hash.slice(1));
+let uploadQueue = Promise.resolve();
+
+function api(path, options = {}) {
+  options.headers = Object.assign({ Authorization: "Bearer " + token }, options.headers);
+  return fetch("/api/v1" + path, options).then((resp) => {
+    if (resp.status === 401) {
+      signOut("The token was not accepted.");
+      throw new Error("authentication failed");
+    }
+    return resp;
+  });
+}
+
+async function apiError(resp) {
+  try {
+    return (await resp.json()).error || resp.statusText;
+  } catch {
+    return resp.statusText;
+  }
+}
+
+const fileURL = (name) => "/files/" + encodeURIComponent(name);
+
+function extension(name) {
+  const dot = name.lastIndexOf(".");
+  return dot < 0 ? "" : name.slice(dot + 1).toLowerCase();
+}
+
+function formatSize(bytes) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return (i === 0 ? bytes : bytes.toFixed(1)) + " " + units[i];
+}
+
+function el(tag, props = {}, ...children) {
+  const node = Object.assign(document.createElement(tag), props);
+  node.append(...children);
+  return node;
+}
+
+// Sign in and out
+
+function showSignIn(message) {
+  $("signin").hidden = false;
+  $("browser").hidden = true;
+  $("toolbar").hidden = true;
+  $("crumbs").replaceChildren();
+  $("signin-error").textContent = message || "";
+  $("token").focus();
+}
+
+function signOut(message) {
+  token = "";
+  sessionStorage.removeItem("tempo-token");
+  showSignIn(message);
+}
+
+$("signin").addEventListener("submit", (event) => {
+  event.preventDefault();
+  token = $("token").value;
+  sessionStorage.setItem("tempo-token", token);
+  $("token").value = "";
+  load();
+});
+
+$("signout").addEventListener("click", () => signOut());
+
+// Browsing
+
+function go(folder) {
+  prefix = folder;
+  history.pushState(null, "", "#" + encodeURIComponent(prefix));
+  load();
+}
+
+window.addEventListener("popstate", () => {
+  prefix = decodeURIComponent(location.hash.slice(1));
+  load();
+});
+
+function renderCrumbs() {
+  const crumbs = [el("a", { textContent: "All files", onclick: () => go("") })];
+  let path = "";
+  for (const part of prefix.split("/").filter(Boolean)) {
+    path += part + "/";
+    const target = path;
+    crumbs.push(el("span", { textContent: "/" }), el("a", { textContent: part, onclick: () => go(target) }));
+  }
+  $("crumbs").replaceChildren(...crumbs);
+}
+
+async function load() {
+  if (!token) {
+    showSignIn();
+    return;
+  }
+  let files;
+  try {
+    const resp = await api("/files?prefix=" + encodeURIComponent(prefix));
+    if (!resp.ok) throw new Error(await apiError(resp));
+    files = (await resp.json()).files || [];
+  } catch (err) {
+    if (token) $("empty").textContent = "Failed to list files: " + err.message;
+    return;
+  }
+  $("signin").hidden = true;
+  $("browser").hidden = false;
+  $("toolbar").hidden = false;
+  renderCrumbs();
+
+  // Names below the prefix that contain "/" are shown as folders
+  const folders = new Map();
+  const rows = [];
+  for (const file of files) {
+    const rest = file.name.slice(prefix.length);
+    const slash = rest.indexOf("/");
+    if (slash >= 0) {
+      const folder = folders.get(rest.slice(0, slash)) || { count: 0, size: 0 };
+      folder.count++;
+      folder.size += file.size;
+      folders.set(rest.slice(0, slash), folder);
+    } else {
+      rows.push(fileRow(file, rest));
+    }
+  }
+  const folderRows = [...folders.keys()].sort().map((name) => {
+    const folder = folders.get(name);
+    return el("tr", {},
+      el("td", { className: "name" }, el("a", { className: "folder", textContent: name + "/", onclick: () => go(prefix + name + "/") })),
+      el("td", { className: "size", textContent: formatSize(folder.size) }),
+      el("td", { textContent: folder.count + (folder.count === 1 ? " file" : " files") }),
+      el("td"));
+  });
+  $("files").replaceChildren(...folderRows, ...rows);
+  $("empty").textContent = "Nothing here yet. Drop files anywhere on the page to upload them.";
+  $("empty").hidden = files.length > 0;
+}
+
+function fileRow(file, label) {
+  const tool = (text, onclick, className = "quiet") => el("button", { type: "button", className, textContent: text, onclick });
+  return el("tr", {},
+    el("td", { className: "name" }, el("a", { textContent: label, title: "Preview", onclick: () => preview(file) })),
+    el("td", { className: "size", textContent: formatSize(file.size) }),
+    el("td", { textContent: new Date(file.uploaded_at).toLocaleString() }),
+    el("td", { className: "tools" },
+      tool("Download", () => download(file)),
+      tool("Share", () => openShare(file)),
+      tool("Delete", () => remove(file), "danger")));
+}
+
+$("refresh").addEventListener("click", load);
+
+// Previews
+
+async function preview(file) {
+  const body = $("preview-body");
+  $("preview-title").textContent = file.name;
+  body.replaceChildren(el("p", { className: "empty", textContent: "Loading…" }));
+  $("preview").showModal();
+
+  const ext = extension(file.name);
+  try {
+    if (imageTypes.includes(ext)) {
+      // Large photos load faster as a thumbnail, the original is a download away
+      let resp = thumbTypes.includes(ext) ? await api(fileURL(file.name) + "/thumb?w=1024") : null;
+      if (!resp || !resp.ok) resp = await api(fileURL(file.name) + "/content");
+      if (!resp.ok) throw new Error(await apiError(resp));
+      const img = el("img", { alt: file.name, src: URL.createObjectURL(await resp.blob()) });
+      img.onload = () => URL.revokeObjectURL(img.src);
+      body.replaceChildren(img);
+    } else if (textTypes.includes(ext)) {
+      const resp = await api(fileURL(file.name) + "/content", { headers: { Range: "bytes=0-" + (previewBytes - 1) } });
+      if (!resp.ok) throw new Error(await apiError(resp));
+      let text = await resp.text();
+      if (file.size > previewBytes) text += "\n…";
+      body.replaceChildren(el("pre", { textContent: text }));
+    } else {
+      body.replaceChildren(el("p", { className: "empty", textContent: "No preview for this kind of file." }));
+    }
+  } catch (err) {
+    body.replaceChildren(el("p", { className: "error", textContent: "Failed to load the preview: " + err.message }));
+  }
+}
+
+// Downloading, sharing and deleting
+
+async function createShare(name, ttl) {
+  const resp = await api("/shares", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ name, ttl }),
+  });
+  if (!resp.ok) throw new Error(await apiError(resp));
+  return resp.json();
+}
+
+// download goes through a short-lived share link so the browser streams the
+// file to disk instead of holding it in memory.
+async function download(file) {
+  try {
+    location.href = (await createShare(file.name, "5m")).url;
+  } catch (err) {
+    alert("Failed to download " + file.name + ": " + err.message);
+  }
+}
+
+let sharing = null;
+
+function openShare(file) {
+  sharing = file;
+  $("share-name").textContent = file.name;
+  $("share-result").hidden = true;
+  $("share-error").textContent = "";
+  $("share").showModal();
+}
+
+$("share-create").addEventListener("click", async () => {
+  try {
+    const share = await createShare(sharing.name, $("share-ttl").value);
+    $("share-url").value = share.url;
+    $("share-result").hidden = false;
+    $("share-error").textContent = "Expires " + new Date(share.expires_at).toLocaleString();
+    $("share-url").select();
+  } catch (err) {
+    $("share-error").textContent = err.message;
+  }
+});
+
+$("share-copy").addEventListener("click", () => {
+  navigator.clipboard.writeText($("share-url").value);
+  $("share-copy").textContent = "Copied";
+  setTimeout(() => ($("share-copy").textContent = "Copy"), 1500);
+});
+
+async function remove(file) {
+  if (!confirm("Delete " + file.name + "? This cannot be undone.")) return;
+  try {
+    const resp = await api(fileURL(file.name), { method: "DELETE" });
+    if (!resp.ok) throw new Error(await apiError(resp));
+  } catch (err) {
+    alert("Failed to delete " + file.name + ": " + err.message);
+  }
+  load();
+}
+
+for (const button of document.querySelectorAll("[data-close]")) {
+  button.addEventListener("click", () => button.closest("dialog").close());
+}
+
+// Uploading, one file at a time into the folder being shown
+
+function upload(files) {
+  for (const file of files) {
+    const name = prefix + file.name;
+    const bar = el("progress", { max: 1, value: 0 });
+    const status = el("span", { textContent: "Waiting" });
+    $("uploads").append(el("li", {}, el("span", { textContent: name }), bar, status));
+    uploadQueue = uploadQueue.then(() => sendFile(file, name, bar, status));
+  }
+  uploadQueue = uploadQueue.then(load);
+}
+
+function sendFile(file, name, bar, status) {
+  return new Promise((resolve) => {
+    const xhr = new XMLHttpRequest(); // fetch cannot report upload progress
+    xhr.open("PUT", "/api/v1" + fileURL(name));
+    xhr.setRequestHeader("Authorization", "Bearer " + token);
+    xhr.upload.onprogress = (event) => {
+      if (event.lengthComputable) {
+        bar.value = event.loaded / event.total;
+        status.textContent = Math.floor(bar.value * 100) + "%";
+      }
+    };
+    xhr.onload = () => {
+      if (xhr.status >= 200 && xhr.status < 300) {
+        bar.value = 1;
+        status.textContent = "Done";
+        setTimeout(() => bar.parentElement.remove(), 3000);
+      } else {
+        let message = xhr.statusText;
+        try {
+          message = JSON.parse(xhr.responseText).error || message;
+        } catch {}
+        status.textContent = "Failed";
+        status.className = "failed";
+        status.title = message;
+      }
+      resolve();
+    };
+    xhr.onerror = () => {
+      status.textContent = "Failed";
+      status.className = "failed";
+      resolve();
+    };
+    status.textContent = "0%";
+    xhr.send(file);
+  });
+}
+
+$("picker").addEventListener("change", (event) => {
+  upload(event.target.files);
+  event.target.value = "";
+});
+
+// Drag and drop anywhere on the page
+
+let dragDepth = 0;
+
+function dragsFiles(event) {
+  return event.dataTransfer && [...event.dataTransfer.types].includes("Files");
+}
+
+window.addEventListener("dragenter", (event) => {
+  if (!dragsFiles(event) || !token) return;
+  event.preventDefault();
+  dragDepth++;
+  $("dropzone").hidden = false;
+});
+
+window.addEventListener("dragover", (event) => {
+  if (dragsFiles(event)) event.preventDefault();
+});
+
+window.addEventListener("dragleave", () => {
+  dragDepth = Math.max(0, dragDepth - 1);
+  if (dragDepth === 0) $("dropzone").hidden = true;
+});
+
+window.addEventListener("drop", (event) => {
+  if (!dragsFiles(event)) return;
+  event.preventDefault();
+  dragDepth = 0;
+  $("dropzone").hidden = true;
+  if (token) upload(event.dataTransfer.files);
+});
+
+load();
@@ -0,0 +1,32 @@
+// Tempo connect page: shows the QR code of the preferred URL and lets the
+// other addresses of the server be shown instead.
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+function show(url, code) {
+  $("url").href = url;
+  $("url").textContent = url;
+  if (code) $("qr").src = "/connect/qr.png?url=" + encodeURIComponent(url);
+}
+
+async function load() {
+  const resp = await fetch("/connect/info");
+  if (!resp.ok) return;
+  const info = await resp.json();
+  show(info.url, false);
+  const others = info.urls.filter((url) => url !== info.url);
+  $("urls").replaceChildren(...others.map((url) => {
+    const link = Object.assign(document.createElement("a"), { href: url, textContent: url });
+    link.addEventListener("click", (event) => {
+      event.preventDefault();
+      show(url, true);
+    });
+    const item = document.createElement("li");
+    item.append(link);
+    return item;
+  }));
+  $("others").hidden = others.length === 0;
+}
+
+load();
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Webhook deliveries are retried after webhookRetryBase, doubling up to
+// webhookRetryMax, and each subscription keeps its last webhookLogSize
+// finished deliveries.
+const (
+	webhookRetryBase = 30 * time.Second
+	webhookRetryMax  = time.Hour
+	webhookLogSize   = 100
+)
+
+// Delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// eventTypes are the event types webhooks can subscribe to.
+var eventTypes = []string{EventUploaded, EventDownloaded, EventDeleted, EventRenamed, EventCleanedUp}
+
+// errInvalidWebhook is returned for subscriptions that cannot be created.
+var errInvalidWebhook = errors.New("invalid webhook")
+
+// Webhook is a subscription: matching events are POSTed as JSON to URL with
+// an HMAC-SHA256 signature made with Secret.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events,omitempty"` // Empty for every type
+	Prefix    string    `json:"prefix,omitempty"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Delivery is one event on its way to a webhook. It stays in the queue until
+// the receiver accepts it or the attempts run out, then moves to the log.
+type Delivery struct {
+	ID          string    `json:"id"`
+	Webhook     string    `json:"webhook"`
+	Event       Event     `json:"event"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	StatusCode  int       `json:"status_code,omitempty"` // Of the last attempt
+	Error       string    `json:"error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitzero"`
+	CreatedAt   time.Time `json:"created_at"`
+	FinishedAt  time.Time `json:"finished_at,omitzero"`
+}
+
+// webhookState is what Webhooks persists.
+type webhookState struct {
+	Webhooks []*Webhook             `json:"webhooks"`
+	Queue    []*Delivery            `json:"queue"`
+	Log      map[string][]*Delivery `json:"log"`
+}
+
+// Webhooks keeps the subscriptions, the queue of pending deliveries and the
+// delivery logs, persisted to a JSON file so nothing is lost on restart.
+type Webhooks struct {
+	path   string
+	logger *slog.Logger
+	client *http.Client
+	wake   chan struct{}
+
+	mutex sync.Mutex
+	state webhookState
+}
+
+// NewWebhooks loads the webhooks saved at path.
+func NewWebhooks(path string, logger *slog.Logger) (*Webhooks, error) {
+	w := &Webhooks{
+		path:   path,
+		logger: logger,
+		client: &http.Client{},
+		wake:   make(chan struct{}, 1),
+		state:  webhookState{Log: make(map[string][]*Delivery)},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return w, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read webhooks: %w", err)
+	}
+	if err := json.Unmarshal(data, &w.state); err != nil {
+		return nil, fmt.Errorf("failed to parse webhooks: %w", err)
+	}
+	if w.state.Log == nil {
+		w.state.Log = make(map[string][]*Delivery)
+	}
+	return w, nil
+}
+
+// Create validates and adds a subscription, generating a secret if it has
+// none. The returned copy includes the secret.
+func (w *Webhooks) Create(hook Webhook) (Webhook, error) {
+	target, err := url.Parse(hook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return Webhook{}, fmt.Errorf("%w: url must be an absolute http or https URL", errInvalidWebhook)
+	}
+	for _, event := range hook.Events {
+		if !slices.Contains(eventTypes, event) {
+			return Webhook{}, fmt.Errorf("%w: unknown event type %q", errInvalidWebhook, event)
+		}
+	}
+	if hook.Secret == "" {
+		if hook.Secret, err = randomHex(24); err != nil {
+			return Webhook{}, err
+		}
+	}
+	if hook.ID, err = randomHex(8); err != nil {
+		return Webhook{}, err
+	}
+	hook.CreatedAt = time.Now().UTC()
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.state.Webhooks = append(w.state.Webhooks, &hook)
+	return hook, w.save()
+}
+
+// List returns the subscriptions without their secrets.
+func (w *Webhooks) List() []Webhook {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	hooks := make([]Webhook, 0, len(w.state.Webhooks))
+	for _, hook := range w.state.Webhooks {
+		listed := *hook
+		listed.Secret = ""
+		hooks = append(hooks, listed)
+	}
+	return hooks
+}
+
+// Remove deletes a subscription with its pending deliveries and log, and
+// reports whether it existed.
+func (w *Webhooks) Remove(id string) (bool, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	i := slices.IndexFunc(w.state.Webhooks, func(hook *Webhook) bool { return hook.ID == id })
+	if i < 0 {
+		return false, nil
+	}
+	w.state.Webhooks = slices.Delete(w.state.Webhooks, i, i+1)
+	w.state.Queue = slices.DeleteFunc(w.state.Queue, func(d *Delivery) bool { return d.Webhook == id })
+	delete(w.state.Log, id)
+	return true, w.save()
+}
+
+// Deliveries returns the pending and the logged deliveries of a
+// subscription, newest first, or false if there is no such subscription.
+func (w *Webhooks) Deliveries(id string) ([]Delivery, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.find(id) == nil {
+		return nil, false
+	}
+	var deliveries []Delivery
+	for _, d := range w.state.Queue {
+		if d.Webhook == id {
+			deliveries = append(deliveries, *d)
+		}
+	}
+	for _, d := range w.state.Log[id] {
+		deliveries = append(deliveries, *d)
+	}
+	slices.SortStableFunc(deliveries, func(a, b Delivery) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return deliveries, true
+}
+
+// Run queues a delivery for every event matching a subscription and sends
+// them until ctx is cancelled. Deliveries still pending then are sent after
+// the next start.
+func (w *Webhooks) Run(ctx context.Context, events *Events) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.deliverLoop(ctx)
+	}()
+	defer wg.Wait()
+
+	lastID := uint64(math.MaxUint64) // New events only
+	missed, ch, unsubscribe := events.Subscribe(lastID)
+	defer func() { unsubscribe() }()
+	for {
+		for _, event := range missed {
+			w.enqueue(event)
+			lastID = event.ID
+		}
+		missed = nil
+
+		select {
+		case <-ctx.Done():
+			w.logger.Info("Webhooks shutting down")
+			return
+		case event, ok := <-ch:
+			if !ok {
+				// Fell behind, pick up again from the kept events
+				w.logger.Warn("Webhooks: event subscriber fell behind, resuming", "last_event_id", lastID)
+				unsubscribe()
+				missed, ch, unsubscribe = events.Subscribe(lastID)
+				continue
+			}
+			w.enqueue(event)
+			lastID = event.ID
+		}
+	}
+}
+
+// enqueue adds a delivery of event for every subscription it matches.
+func (w *Webhooks) enqueue(event Event) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	added := false
+	for _, hook := range w.state.Webhooks {
+		if !(eventFilter{prefix: hook.Prefix, types: hook.Events}).match(event) {
+			continue
+		}
+		id, err := randomHex(8)
+		if err != nil {
+			w.logger.Error("Webhooks: failed to queue delivery", "webhook", hook.ID, "error", err)
+			continue
+		}
+		now := time.Now().UTC()
+		w.state.Queue = append(w.state.Queue, &Delivery{
+			ID:          id,
+			Webhook:     hook.ID,
+			Event:       event,
+			Status:      DeliveryPending,
+			NextAttempt: now,
+			CreatedAt:   now,
+		})
+		added = true
+	}
+	if !added {
+		return
+	}
+	if err := w.save(); err != nil {
+		w.logger.Error("Webhooks: failed to save queue", "error", err)
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverLoop sends due deliveries whenever one is queued or a retry is due.
+func (w *Webhooks) deliverLoop(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+		case <-timer.C:
+		}
+		next := w.deliverDue(ctx)
+		timer.Stop()
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// deliverDue makes one attempt at every due delivery and returns when the
+// next retry is due, zero if nothing is pending.
+func (w *Webhooks) deliverDue(ctx context.Context) time.Time {
+	type job struct {
+		delivery Delivery
+		hook     Webhook
+	}
+	w.mutex.Lock()
+	var jobs []job
+	now := time.Now()
+	for _, d := range w.state.Queue {
+		if hook := w.find(d.Webhook); hook != nil && !d.NextAttempt.After(now) {
+			jobs = append(jobs, job{*d, *hook})
+		}
+	}
+	w.mutex.Unlock()
+
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		code, err := w.send(ctx, job.hook, job.delivery)
+		if ctx.Err() != nil {
+			break // Interrupted by shutdown, not the receiver's fault
+		}
+		w.record(job.delivery.ID, code, err)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var next time.Time
+	for _, d := range w.state.Queue {
+		if next.IsZero() || d.NextAttempt.Before(next) {
+			next = d.NextAttempt
+		}
+	}
+	return next
+}
+
+// send POSTs a delivery to its webhook and returns the response status.
+func (w *Webhooks) send(ctx context.Context, hook Webhook, d Delivery) (int, error) {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, currentConfig().Webhook.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tempo-webhook")
+	req.Header.Set("X-Tempo-Event", d.Event.Type)
+	req.Header.Set("X-Tempo-Delivery", d.ID)
+	// Receivers check the body with the HMAC-SHA256 of it under the shared secret
+	req.Header.Set("X-Tempo-Signature", "sha256="+hex.EncodeToString(hmacSHA256([]byte(hook.Secret), string(body))))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// record stores the outcome of an attempt, scheduling a retry or moving the
+// delivery to its webhook's log.
+func (w *Webhooks) record(id string, code int, err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	i := slices.IndexFunc(w.state.Queue, func(d *Delivery) bool { return d.ID == id })
+	if i < 0 {
+		return // Webhook removed meanwhile
+	}
+	d := w.state.Queue[i]
+	d.Attempts++
+	d.StatusCode = code
+	d.Error = ""
+	log := w.logger.With("webhook", d.Webhook, "delivery", d.ID, "event", d.Event.Type,
+		"filename", d.Event.Name, "attempt", d.Attempts)
+
+	switch {
+	case err == nil:
+		d.Status = DeliveryDelivered
+		webhookDeliveries.WithLabelValues("delivered").Inc()
+		log.Info("Webhook delivered", "status", code)
+	case d.Attempts >= currentConfig().Webhook.MaxAttempts:
+		d.Status = DeliveryFailed
+		d.Error = err.Error()
+		webhookDeliveries.WithLabelValues("failed").Inc()
+		log.Error("Webhook delivery failed, giving up", "error", err)
+	default:
+		d.Error = err.Error()
+		delay := min(webhookRetryBase<<(d.Attempts-1), webhookRetryMax)
+		d.NextAttempt = time.Now().UTC().Add(delay)
+		webhookDeliveries.WithLabelValues("retry").Inc()
+		log.Warn("Webhook delivery failed, retrying", "error", err, "retry_in", delay)
+	}
+
+	if d.Status != DeliveryPending {
+		d.NextAttempt = time.Time{}
+		d.FinishedAt = time.Now().UTC()
+		w.state.Queue = slices.Delete(w.state.Queue, i, i+1)
+		entries := append(w.state.Log[d.Webhook], d)
+		if len(entries) > webhookLogSize {
+			entries = entries[len(entries)-webhookLogSize:]
+		}
+		w.state.Log[d.Webhook] = entries
+	}
+	if err := w.save(); err != nil {
+		w.logger.Error("Webhooks: failed to save queue", "error", err)
+	}
+}
+
+// find returns the webhook with id; the caller holds the mutex.
+func (w *Webhooks) find(id string) *Webhook {
+	for _, hook := range w.state.Webhooks {
+		if hook.ID == id {
+			return hook
+		}
+	}
+	return nil
+}
+
+// save writes the state to disk through a temporary file, so a crash never
+// leaves half a queue behind; the caller holds the mutex.
+func (w *Webhooks) save() error {
+	data, err := json.MarshalIndent(w.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := w.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.path)
+}
+
+// randomHex returns n random bytes as hex.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
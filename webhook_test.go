@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedHook is one request seen by a webhookReceiver.
+type receivedHook struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver answers with the statuses in turn, then with 204, and
+// hands every request it gets to received.
+type webhookReceiver struct {
+	mutex    sync.Mutex
+	statuses []int
+	received chan receivedHook
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) (*httptest.Server, *webhookReceiver) {
+	t.Helper()
+	receiver := &webhookReceiver{statuses: statuses, received: make(chan receivedHook, 16)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receiver.received <- receivedHook{header: r.Header.Clone(), body: body}
+		receiver.mutex.Lock()
+		status := http.StatusNoContent
+		if len(receiver.statuses) > 0 {
+			status, receiver.statuses = receiver.statuses[0], receiver.statuses[1:]
+		}
+		receiver.mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, receiver
+}
+
+func (r *webhookReceiver) next(t *testing.T) receivedHook {
+	t.Helper()
+	select {
+	case got := <-r.received:
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook delivered")
+		return receivedHook{}
+	}
+}
+
+func newTestWebhooks(t *testing.T, path string) *Webhooks {
+	t.Helper()
+	w, err := NewWebhooks(path, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// onlyDelivery returns the single delivery of hook.
+func onlyDelivery(t *testing.T, w *Webhooks, hook string) Delivery {
+	t.Helper()
+	deliveries, ok := w.Deliveries(hook)
+	if !ok || len(deliveries) != 1 {
+		t.Fatalf("deliveries of %s: %+v, want one", hook, deliveries)
+	}
+	return deliveries[0]
+}
+
+func TestWebhookSignature(t *testing.T) {
+	useConfig(t, nil)
+	server, receiver := newWebhookReceiver(t)
+	w := newTestWebhooks(t, filepath.Join(t.TempDir(), "webhooks.json"))
+	hook, err := w.Create(Webhook{URL: server.URL, Secret: "shared"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.enqueue(Event{ID: 1, Type: EventUploaded, Name: "a.txt"})
+	w.deliverDue(context.Background())
+	got := receiver.next(t)
+
+	mac := hmac.New(sha256.New, []byte("shared"))
+	mac.Write(got.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); got.header.Get("X-Tempo-Signature") != want {
+		t.Errorf("signature %q, want %q", got.header.Get("X-Tempo-Signature"), want)
+	}
+	if got.header.Get("X-Tempo-Event") != EventUploaded {
+		t.Errorf("X-Tempo-Event %q", got.header.Get("X-Tempo-Event"))
+	}
+	var event Event
+	if err := json.Unmarshal(got.body, &event); err != nil || event.Name != "a.txt" {
+		t.Errorf("body %s: %v", got.body, err)
+	}
+	if d := onlyDelivery(t, w, hook.ID); d.Status != DeliveryDelivered || d.Attempts != 1 {
+		t.Errorf("delivery %+v, want delivered at the first attempt", d)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	useConfig(t, func(cfg *Config) { cfg.Webhook.MaxAttempts = 3 })
+	server, receiver := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable)
+	w := newTestWebhooks(t, filepath.Join(t.TempDir(), "webhooks.json"))
+	hook, err := w.Create(Webhook{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.enqueue(Event{ID: 1, Type: EventDeleted, Name: "a.txt"})
+
+	// Every failure pushes the next attempt back twice as far
+	for attempt, delay := range []time.Duration{webhookRetryBase, 2 * webhookRetryBase} {
+		start := time.Now()
+		next := w.deliverDue(context.Background())
+		receiver.next(t)
+		d := onlyDelivery(t, w, hook.ID)
+		if d.Status != DeliveryPending || d.Attempts != attempt+1 || d.StatusCode < 500 {
+			t.Fatalf("after attempt %d: %+v", attempt+1, d)
+		}
+		if wait := d.NextAttempt.Sub(start); wait < delay || wait > delay+5*time.Second {
+			t.Fatalf("after attempt %d: retry in %v, want %v", attempt+1, wait, delay)
+		}
+		if !next.Equal(d.NextAttempt) {
+			t.Fatalf("deliverDue returned %v, want the retry time %v", next, d.NextAttempt)
+		}
+
+		// Nothing is sent before the retry is due
+		w.deliverDue(context.Background())
+		select {
+		case <-receiver.received:
+			t.Fatal("retried before the backoff elapsed")
+		default:
+		}
+		w.mutex.Lock()
+		w.state.Queue[0].NextAttempt = time.Now()
+		w.mutex.Unlock()
+	}
+
+	// The last attempt gives up
+	w.deliverDue(context.Background())
+	receiver.next(t)
+	if d := onlyDelivery(t, w, hook.ID); d.Status != DeliveryFailed || d.Attempts != 3 || d.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("delivery %+v, want failed after 3 attempts", d)
+	}
+}
+
+func TestWebhookQueueSurvivesRestart(t *testing.T) {
+	useConfig(t, nil)
+	server, receiver := newWebhookReceiver(t)
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+
+	// Queued, but the server stops before sending it
+	before := newTestWebhooks(t, path)
+	hook, err := before.Create(Webhook{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before.enqueue(Event{ID: 7, Type: EventRenamed, Name: "b.txt", From: "a.txt"})
+
+	after := newTestWebhooks(t, path)
+	if d := onlyDelivery(t, after, hook.ID); d.Status != DeliveryPending {
+		t.Fatalf("reloaded delivery %+v, want pending", d)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		after.Run(ctx, NewEvents())
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	got := receiver.next(t)
+	var event Event
+	if err := json.Unmarshal(got.body, &event); err != nil || event.ID != 7 || event.From != "a.txt" {
+		t.Fatalf("replayed %s: %v", got.body, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for onlyDelivery(t, after, hook.ID).Status != DeliveryDelivered {
+		if time.Now().After(deadline) {
+			t.Fatal("replayed delivery not recorded as delivered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// And it is not sent again by the next start
+	if d := onlyDelivery(t, newTestWebhooks(t, path), hook.ID); d.Status != DeliveryDelivered {
+		t.Fatalf("after another restart: %+v", d)
+	}
+}